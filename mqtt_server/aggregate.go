@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// feedbackAggregator buffers move feedback and hands it to flush in batches,
+// at most interval after the first feedback of each batch was added, so
+// agents sending many moves get one message per interval instead of one per
+// move.
+type feedbackAggregator struct {
+	interval time.Duration
+	flush    func([]MoveCompletionFeedback)
+
+	mu      sync.Mutex
+	pending []MoveCompletionFeedback
+	timer   *time.Timer // Runs flushPending once interval has passed, nil while nothing is pending
+}
+
+// newFeedbackAggregator returns an aggregator passing feedback to flush in
+// batches every interval.
+func newFeedbackAggregator(interval time.Duration, flush func([]MoveCompletionFeedback)) *feedbackAggregator {
+	return &feedbackAggregator{interval: interval, flush: flush}
+}
+
+// add buffers feedback until the next flush.
+func (a *feedbackAggregator) add(feedback MoveCompletionFeedback) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending = append(a.pending, feedback)
+	if a.timer == nil {
+		a.timer = time.AfterFunc(a.interval, a.flushPending)
+	}
+}
+
+// flushPending passes the buffered feedback to flush straight away, if there
+// is any. It is called when the interval passes, and on shutdown so no
+// feedback is lost.
+func (a *feedbackAggregator) flushPending() {
+	a.mu.Lock()
+	pending := a.pending
+	a.pending = nil
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	a.mu.Unlock()
+
+	if len(pending) > 0 {
+		a.flush(pending)
+	}
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"gopkg.in/yaml.v3"
+)
+
+// brokerState tracks whether the MQTT server is serving, for health checks.
+type brokerState struct {
+	mu      sync.RWMutex
+	serving bool
+	started time.Time
+}
+
+// setServing records the server starting or stopping.
+func (s *brokerState) setServing(serving bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serving = serving
+	if serving {
+		s.started = time.Now()
+	}
+}
+
+// requestTracker counts in-flight HTTP requests, so shutdown can report how
+// many were drained.
+type requestTracker struct {
+	inFlight atomic.Int64
+}
+
+// wrap returns next wrapped to count its in-flight requests.
+func (t *requestTracker) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.inFlight.Add(1)
+		defer t.inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// originAllowed returns true if origins contains origin or "*".
+func originAllowed(origins []string, origin string) bool {
+	return slices.Contains(origins, "*") || slices.Contains(origins, origin)
+}
+
+// corsHandler returns next wrapped to allow cross-origin requests from
+// browsers on the given origins, where "*" allows any origin. Preflight
+// requests are answered without calling next.
+func corsHandler(origins []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		allowed := originAllowed(origins, origin)
+		switch {
+		case slices.Contains(origins, "*"):
+			h.Set("Access-Control-Allow-Origin", "*")
+		case allowed:
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if !allowed {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", "Content-Type")
+			h.Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if allowed {
+			h.Set("Access-Control-Expose-Headers", "X-Total-Count")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Health is the response body of the /healthz endpoint.
+type Health struct {
+	Status           string  `json:"status"`
+	Serving          bool    `json:"serving"`
+	ClientsConnected int64   `json:"clients_connected"`
+	UptimeSeconds    float64 `json:"uptime_seconds"`
+}
+
+// writeJSON writes v as a JSON response body.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to encode HTTP response", "error", err)
+	}
+}
+
+// writeError writes a JSON error response body.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// queryInt returns the integer query parameter name, or def if it is absent.
+// It returns an error if the value isn't a non-negative integer.
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %q", name, v)
+	}
+	return n, nil
+}
+
+// Page size limits for the /moves/history endpoint.
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// handleMoveHistory serves recorded moves and their outcomes, newest first.
+// It supports limit and offset query parameters for pagination and
+// object_name and status filters, and sets X-Total-Count to the number of
+// matching records.
+func handleMoveHistory(history *MoveHistory) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if history == nil {
+			writeError(w, http.StatusNotFound, "move history is not enabled, start the server with -history-file")
+			return
+		}
+
+		limit, err := queryInt(r, "limit", defaultHistoryLimit)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		offset, err := queryInt(r, "offset", 0)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		limit = min(limit, maxHistoryLimit)
+
+		filter := HistoryFilter{
+			ObjectName: r.URL.Query().Get("object_name"),
+			Status:     r.URL.Query().Get("status"),
+		}
+		records, total, err := history.Query(filter, offset, limit)
+		if err != nil {
+			slog.Error("failed to query move history", "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to read move history")
+			return
+		}
+
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		writeJSON(w, http.StatusOK, records)
+	}
+}
+
+// handleYearlyYields serves the yearly yields from the JSON file at path,
+// rereading it on each request so the data can be updated without a restart.
+// If path is empty or the file doesn't exist the built-in yields are served.
+func handleYearlyYields(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if path == "" {
+			writeJSON(w, http.StatusOK, defaultYearlyYields)
+			return
+		}
+
+		yields, err := loadYearlyYields(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.Warn("yields file not found, serving built-in yields", "path", path)
+			writeJSON(w, http.StatusOK, defaultYearlyYields)
+			return
+		}
+		if err != nil {
+			slog.Error("failed to load yields", "path", path, "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to load yields")
+			return
+		}
+		writeJSON(w, http.StatusOK, yields)
+	}
+}
+
+// PublishRequest is the request body of the /publish endpoint.
+type PublishRequest struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	Retain  bool   `json:"retain"`
+	Qos     byte   `json:"qos"`
+}
+
+// validate returns an error if the message can't be published.
+func (p PublishRequest) validate() error {
+	if p.Topic == "" {
+		return errors.New("topic must not be empty")
+	}
+	if strings.ContainsAny(p.Topic, "+#") {
+		return fmt.Errorf("topic %q must not contain wildcards", p.Topic)
+	}
+	if p.Qos > 2 {
+		return fmt.Errorf("qos must be 0, 1 or 2, got %d", p.Qos)
+	}
+	return nil
+}
+
+// maxPublishBodyBytes bounds the size of a /publish or /moves request body.
+const maxPublishBodyBytes = 1 << 20
+
+// handlePublish publishes a message to the broker on behalf of services which
+// can't speak MQTT. It responds 202 once the message has been accepted. The
+// message is published by the inline client, bypassing the auth ledger, so
+// requests must carry token as a bearer token if it is set.
+func handlePublish(token string, server *mqtt.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizedIfSet(w, r, token) {
+			return
+		}
+
+		var req PublishRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+			return
+		}
+		if err := req.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := server.Publish(req.Topic, []byte(req.Payload), req.Retain, req.Qos); err != nil {
+			slog.Error("failed to publish HTTP message", "topic", req.Topic, "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to publish message")
+			return
+		}
+		slog.Info("published HTTP message", "topic", req.Topic, "retain", req.Retain, "qos", req.Qos)
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "accepted"})
+	}
+}
+
+// newRequestID returns a random request ID for moves submitted without one.
+func newRequestID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// handleMoves returns a handler which publishes a move command to the command
+// topic, so REST clients can move objects without building MQTT payloads. A
+// request ID is assigned if the command has none, and returned so the client
+// can match the feedback. Requests must carry token as a bearer token if it
+// is set.
+func handleMoves(token string, server *mqtt.Server, hook *MoveCommandHook) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizedIfSet(w, r, token) {
+			return
+		}
+
+		var cmd MoveCommand
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPublishBodyBytes)).Decode(&cmd); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid move command: %v", err))
+			return
+		}
+		if cmd.ObjectName == "" {
+			writeError(w, http.StatusBadRequest, "object_name is required")
+			return
+		}
+		if _, reason := cmd.validate(); reason != "" {
+			writeError(w, http.StatusBadRequest, reason)
+			return
+		}
+		if cmd.RequestID == "" {
+			id, err := newRequestID()
+			if err != nil {
+				slog.Error("failed to generate request ID", "error", err)
+				writeError(w, http.StatusInternalServerError, "failed to generate request ID")
+				return
+			}
+			cmd.RequestID = id
+		}
+
+		payload, err := json.Marshal(cmd)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to encode move command")
+			return
+		}
+		topic := hook.topic(&hook.commandTopic)
+		if err := server.Publish(topic, payload, false, 0); err != nil {
+			slog.Error("failed to publish HTTP move command", "topic", topic, "request_id", cmd.RequestID, "error", err)
+			writeError(w, http.StatusInternalServerError, "failed to publish move command")
+			return
+		}
+		slog.Info("published HTTP move command", "topic", topic, "object_name", cmd.ObjectName, "request_id", cmd.RequestID)
+		writeJSON(w, http.StatusAccepted, map[string]string{"request_id": cmd.RequestID})
+	}
+}
+
+// ClientInfo describes a connected MQTT client in the /clients endpoint.
+type ClientInfo struct {
+	ID            string    `json:"id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	Listener      string    `json:"listener"`
+	Username      string    `json:"username,omitempty"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	LastPacketAt  time.Time `json:"last_packet_at"`
+	Subscriptions []string  `json:"subscriptions"`
+}
+
+// handleClients serves the connected MQTT clients, sorted by ID. The topic
+// query parameter limits the list to clients subscribed to that topic.
+func handleClients(server *mqtt.Server, conns *ConnectionHook) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		topic := r.URL.Query().Get("topic")
+
+		clients := []ClientInfo{}
+		for _, cl := range server.Clients.GetAll() {
+			connectedAt, lastPacket, ok := conns.Activity(cl)
+			if !ok || cl.Net.Inline {
+				continue
+			}
+
+			info := ClientInfo{
+				ID:            cl.ID,
+				RemoteAddr:    cl.Net.Remote,
+				Listener:      cl.Net.Listener,
+				Username:      string(cl.Properties.Username),
+				ConnectedAt:   connectedAt,
+				LastPacketAt:  lastPacket,
+				Subscriptions: []string{},
+			}
+			subscribed := topic == ""
+			for filter := range cl.State.Subscriptions.GetAll() {
+				info.Subscriptions = append(info.Subscriptions, filter)
+				if _, matched := auth.MatchTopic(filter, topic); matched {
+					subscribed = true
+				}
+			}
+			if !subscribed {
+				continue
+			}
+			sort.Strings(info.Subscriptions)
+			clients = append(clients, info)
+		}
+
+		sort.Slice(clients, func(i, j int) bool {
+			return clients[i].ID < clients[j].ID
+		})
+		writeJSON(w, http.StatusOK, clients)
+	}
+}
+
+// Time windows of the /topics endpoint.
+const (
+	defaultTopicWindow = 5 * time.Minute
+	maxTopicWindow     = topicActivityMinutes * time.Minute
+)
+
+// handleTopics serves the topics with messages published recently, sorted by
+// name, with their message and current subscriber counts. The window query
+// parameter, such as 15m, sets how far back to look, 5 minutes by default.
+func handleTopics(server *mqtt.Server, topics *TopicHook) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		window := defaultTopicWindow
+		if v := r.URL.Query().Get("window"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 || d > maxTopicWindow {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("window must be a duration up to %v, got %q", maxTopicWindow, v))
+				return
+			}
+			window = d
+		}
+		writeJSON(w, http.StatusOK, topics.Topics(server, window))
+	}
+}
+
+// handleConfig serves the config in effect, as reloaded on SIGHUP, with
+// secrets redacted. It is encoded as a config file would be, so durations
+// read as e.g. "5s" and the output can be saved as a config file.
+func handleConfig(reloader *Reloader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := yaml.Marshal(reloader.Config().redacted())
+		var cfg map[string]any
+		if err == nil {
+			err = yaml.Unmarshal(data, &cfg)
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("encoding config: %v", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, cfg)
+	}
+}
+
+// handleActiveMoves serves the moves which are still awaiting completion
+// feedback, with the time elapsed since each was received.
+func handleActiveMoves(h *MoveCommandHook) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, h.ActiveMoves())
+	}
+}
+
+// handleObjectPosition serves the last known position of the object named in
+// the path, where its last successful move left it, or 404 if it hasn't
+// moved yet.
+func handleObjectPosition(h *MoveCommandHook) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		pos, ok := h.Position(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("no known position for object %q", name))
+			return
+		}
+		writeJSON(w, http.StatusOK, pos)
+	}
+}
+
+// handleHealthz reports whether the broker is serving, for liveness and
+// readiness probes. It responds 503 before the server has started serving and
+// after it has been closed.
+func handleHealthz(conns *ConnectionHook, state *brokerState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		state.mu.RLock()
+		health := Health{
+			Status:           "unavailable",
+			Serving:          state.serving,
+			ClientsConnected: conns.ActiveConnections(),
+		}
+		if state.serving {
+			health.Status = "ok"
+			health.UptimeSeconds = time.Since(state.started).Seconds()
+		}
+		state.mu.RUnlock()
+
+		status := http.StatusOK
+		if !health.Serving {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, health)
+	}
+}
+
+// authorized reports whether r carries token as a bearer token, writing a
+// 401 Unauthorized response if it doesn't. With no token set every request
+// is refused with 403 Forbidden.
+func authorized(w http.ResponseWriter, r *http.Request, token string) bool {
+	if token == "" {
+		writeError(w, http.StatusForbidden, "this endpoint is disabled until MQTT_ADMIN_TOKEN is set")
+		return false
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "a valid bearer token is required")
+		return false
+	}
+	return true
+}
+
+// authorizedIfSet is authorized for endpoints which are open while no token
+// is set.
+func authorizedIfSet(w http.ResponseWriter, r *http.Request, token string) bool {
+	return token == "" || authorized(w, r, token)
+}
+
+// handleAdminShutdown triggers a graceful shutdown, as SIGTERM does, for test
+// harnesses which can't signal the process. Requests must carry token as a
+// bearer token, and are all refused if it isn't set.
+func handleAdminShutdown(token string, shutdown chan<- struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r, token) {
+			return
+		}
+
+		slog.Info("shutdown requested over HTTP", "remote_addr", r.RemoteAddr)
+		select {
+		case shutdown <- struct{}{}:
+		default: // A shutdown is already pending
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "shutting down"})
+	}
+}
+
+// handleMetricsReset zeroes the move command counters and histograms between
+// load test runs. Requests must carry token as a bearer token, and are all
+// refused if it isn't set.
+func handleMetricsReset(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(w, r, token) {
+			return
+		}
+
+		resetMetrics()
+		slog.Info("metrics reset over HTTP", "remote_addr", r.RemoteAddr)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
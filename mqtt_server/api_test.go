@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPublishToken(t *testing.T) {
+	t.Parallel()
+	server, _ := newTestServer(t)
+	body := `{"topic":"unity/status","payload":"up","qos":0}`
+
+	tests := []struct {
+		name   string
+		token  string // Admin token the endpoint is served with
+		header string // Authorization header sent
+		want   int
+	}{
+		{name: "no token set", want: http.StatusAccepted},
+		{name: "token sent", token: "secret", header: "Bearer secret", want: http.StatusAccepted},
+		{name: "token missing", token: "secret", want: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", header: "Bearer guess", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/publish", strings.NewReader(body))
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handlePublish(tt.token, server)(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got status %d (%s), want %d", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestMovesToken(t *testing.T) {
+	t.Parallel()
+	server, hook, _ := newMoveTestServer(t, nil)
+	body := `{"object_name":"Cube","target_position":[0,5,0],"duration":0}`
+
+	for _, token := range []string{"", "secret"} {
+		r := httptest.NewRequest(http.MethodPost, "/moves", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		handleMoves(token, server, hook)(w, r)
+		want := http.StatusAccepted
+		if token != "" {
+			want = http.StatusUnauthorized
+		}
+		if w.Code != want {
+			t.Errorf("got status %d (%s) without a token header when the token is %q, want %d", w.Code, w.Body, token, want)
+		}
+	}
+}
+
+func TestAdminShutdownToken(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{name: "no token set", header: "Bearer ", want: http.StatusForbidden},
+		{name: "token sent", token: "secret", header: "Bearer secret", want: http.StatusAccepted},
+		{name: "wrong token", token: "secret", header: "Bearer guess", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shutdown := make(chan struct{}, 1)
+			r := httptest.NewRequest(http.MethodPost, "/admin/shutdown", nil)
+			r.Header.Set("Authorization", tt.header)
+			w := httptest.NewRecorder()
+			handleAdminShutdown(tt.token, shutdown)(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got status %d (%s), want %d", w.Code, w.Body, tt.want)
+			}
+			if requested := len(shutdown) == 1; requested != (tt.want == http.StatusAccepted) {
+				t.Errorf("got shutdown requested %v for status %d", requested, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"gopkg.in/yaml.v3"
+)
+
+// loadAuthLedger reads the authentication and topic ACL rules from a YAML or
+// JSON auth file in mochi's ledger format. Unlike the ledger's own Unmarshal,
+// unknown keys are errors, so a misspelt acl section can't silently leave
+// every topic open.
+func loadAuthLedger(path string) (*auth.Ledger, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading auth file: %w", err)
+	}
+
+	ledger := new(auth.Ledger)
+	if data = bytes.TrimSpace(data); len(data) > 0 && data[0] == '{' {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(ledger)
+	} else {
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err = dec.Decode(ledger); errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing auth file %s: %w", path, err)
+	}
+	if err := validateLedger(ledger); err != nil {
+		return nil, fmt.Errorf("invalid auth file %s: %w", path, err)
+	}
+	return ledger, nil
+}
+
+// validateLedger checks that a ledger lets some client connect and that its
+// ACL rules grant known access levels.
+func validateLedger(ledger *auth.Ledger) error {
+	if len(ledger.Users) == 0 && len(ledger.Auth) == 0 {
+		return errors.New("no users or auth rules, so every client would be refused")
+	}
+	for name, user := range ledger.Users {
+		if err := validateFilters(user.ACL); err != nil {
+			return fmt.Errorf("user %q: %w", name, err)
+		}
+	}
+	for i, rule := range ledger.ACL {
+		if len(rule.Filters) == 0 {
+			return fmt.Errorf("acl rule %d has no filters", i)
+		}
+		if err := validateFilters(rule.Filters); err != nil {
+			return fmt.Errorf("acl rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// validateFilters checks that every filter is non-empty and grants an access
+// level from deny to read/write.
+func validateFilters(filters auth.Filters) error {
+	for filter, access := range filters {
+		if filter == "" {
+			return errors.New("empty topic filter")
+		}
+		if access > auth.ReadWrite {
+			return fmt.Errorf("filter %q has access %d, expected 0 (deny) to 3 (read/write)", filter, access)
+		}
+	}
+	return nil
+}
+
+// ACLHook enforces an auth ledger, logging clients which are denied access to
+// a topic. The ledger hook only logs ACL violations at debug level, which
+// hides buggy clients flooding topics they shouldn't touch.
+type ACLHook struct {
+	auth.Hook
+	wildcardPolicy
+}
+
+// OnACLCheck returns true if the client may publish (write) or subscribe to topic.
+func (h *ACLHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	if h.denied(&h.HookBase, cl, topic, write) {
+		return false
+	}
+	if h.Hook.OnACLCheck(cl, topic, write) {
+		return true
+	}
+
+	action := "subscribe"
+	if write {
+		action = "publish"
+	}
+	h.Log.Warn("denied topic access", "client_id", cl.ID, "username", string(cl.Properties.Username),
+		"remote_addr", cl.Net.Remote, "topic", topic, "action", action)
+	return false
+}
+
+// AllowHook allows all clients to connect and use any topic, subject only to
+// the wildcard policy.
+type AllowHook struct {
+	auth.AllowHook
+	wildcardPolicy
+}
+
+// OnACLCheck returns true if the client may publish (write) or subscribe to topic.
+func (h *AllowHook) OnACLCheck(cl *mqtt.Client, topic string, write bool) bool {
+	return !h.denied(&h.HookBase, cl, topic, write)
+}
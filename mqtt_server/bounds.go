@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Modes for handling move targets outside the scene bounds.
+const (
+	BoundsClamp  = "clamp"  // move to the nearest point inside the bounds
+	BoundsReject = "reject" // reject the command with status out_of_bounds
+)
+
+// Bounds is an axis-aligned bounding box limiting where objects may be moved.
+type Bounds struct {
+	Min [3]float64 `yaml:"min" json:"min"` // lowest allowed x, y, z
+	Max [3]float64 `yaml:"max" json:"max"` // highest allowed x, y, z
+}
+
+// validate returns an error if the box is inverted on any axis.
+func (b Bounds) validate() error {
+	for i, axis := range []string{"x", "y", "z"} {
+		if b.Min[i] > b.Max[i] {
+			return fmt.Errorf("bounds min %s (%g) is greater than max %s (%g)", axis, b.Min[i], axis, b.Max[i])
+		}
+	}
+	return nil
+}
+
+// contains returns true if pos lies inside the box. pos must have 3 elements.
+func (b Bounds) contains(pos []float64) bool {
+	for i, v := range pos {
+		if v < b.Min[i] || v > b.Max[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// roundPosition returns pos with each component rounded to decimals decimal
+// places, or pos itself if decimals is negative. Components rounding to zero
+// are positive zero, so they aren't shown as -0.
+func roundPosition(pos []float64, decimals int) []float64 {
+	if decimals < 0 {
+		return pos
+	}
+	scale := math.Pow10(decimals)
+	rounded := make([]float64, len(pos))
+	for i, v := range pos {
+		if rounded[i] = math.Round(v*scale) / scale; rounded[i] == 0 {
+			rounded[i] = 0
+		}
+	}
+	return rounded
+}
+
+// clamp returns the point inside the box nearest to pos. pos must have 3 elements.
+func (b Bounds) clamp(pos []float64) []float64 {
+	clamped := make([]float64, len(pos))
+	for i, v := range pos {
+		clamped[i] = math.Min(math.Max(v, b.Min[i]), b.Max[i])
+	}
+	return clamped
+}
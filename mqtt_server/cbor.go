@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+// Encodings of command payloads.
+const (
+	EncodingJSON = "json"
+	EncodingCBOR = "cbor"
+)
+
+// MQTT v5 content types of command and feedback payloads.
+const (
+	contentTypeJSON = "application/json"
+	contentTypeCBOR = "application/cbor"
+)
+
+// CBOR (RFC 8949) is only transcoded to and from JSON, so commands and
+// feedback keep a single definition in their JSON struct tags. Only the data
+// model JSON can represent is supported: tags are ignored, byte strings
+// become base64 strings like []byte in encoding/json, and map keys must be
+// text strings.
+
+// cborMaxDepth is how deeply arrays and maps may be nested in a CBOR payload.
+const cborMaxDepth = 32
+
+// errCBORTruncated is returned for a payload which ends mid-item.
+var errCBORTruncated = errors.New("cbor: unexpected end of payload")
+
+// cborBreak is the stop code ending an indefinite-length item.
+const cborBreak = 0xff
+
+// cborToJSON transcodes a CBOR payload holding a single item to JSON.
+func cborToJSON(data []byte) ([]byte, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.item(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(d.data) {
+		return nil, fmt.Errorf("cbor: %d unexpected bytes after the payload", len(d.data)-d.pos)
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("cbor: %w", err)
+	}
+	return out, nil
+}
+
+// cborDecoder decodes CBOR items from data into the values encoding/json
+// marshals.
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+// head reads an item's initial byte, split into its major type and additional
+// info, and its argument. indefinite is set for an indefinite-length item,
+// which has no argument.
+func (d *cborDecoder) head() (major, info byte, arg uint64, indefinite bool, err error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, 0, false, errCBORTruncated
+	}
+	ib := d.data[d.pos]
+	d.pos++
+	major, info = ib>>5, ib&0x1f
+
+	var size int
+	switch {
+	case info < 24:
+		return major, info, uint64(info), false, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	case info == 31 && major >= 2 && major != 6:
+		return major, info, 0, true, nil
+	default:
+		return 0, 0, 0, false, fmt.Errorf("cbor: invalid initial byte 0x%02x", ib)
+	}
+	if len(d.data)-d.pos < size {
+		return 0, 0, 0, false, errCBORTruncated
+	}
+	b := d.data[d.pos : d.pos+size]
+	d.pos += size
+	switch size {
+	case 1:
+		arg = uint64(b[0])
+	case 2:
+		arg = uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		arg = uint64(binary.BigEndian.Uint32(b))
+	default:
+		arg = binary.BigEndian.Uint64(b)
+	}
+	return major, info, arg, false, nil
+}
+
+// atBreak consumes the stop code if it is next, reporting whether it was.
+func (d *cborDecoder) atBreak() (bool, error) {
+	if d.pos >= len(d.data) {
+		return false, errCBORTruncated
+	}
+	if d.data[d.pos] == cborBreak {
+		d.pos++
+		return true, nil
+	}
+	return false, nil
+}
+
+// length checks that n items of at least one byte each can follow.
+func (d *cborDecoder) length(n uint64) (int, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return 0, errCBORTruncated
+	}
+	return int(n), nil
+}
+
+// item decodes the next item, nested depth arrays, maps or tags deep.
+func (d *cborDecoder) item(depth int) (any, error) {
+	if depth > cborMaxDepth {
+		return nil, fmt.Errorf("cbor: nested more than %d deep", cborMaxDepth)
+	}
+	major, info, arg, indefinite, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case 0: // Unsigned integer
+		return arg, nil
+	case 1: // Negative integer, -1 - arg
+		if arg > math.MaxInt64 {
+			return nil, errors.New("cbor: negative integer out of range")
+		}
+		return -1 - int64(arg), nil
+	case 2, 3: // Byte and text strings
+		s, err := d.str(major, arg, indefinite)
+		if err != nil {
+			return nil, err
+		}
+		if major == 2 {
+			return s, nil
+		}
+		return string(s), nil
+	case 4: // Array
+		arr := []any{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite {
+				if done, err := d.atBreak(); err != nil || done {
+					return arr, err
+				}
+			} else if i == 0 {
+				if _, err := d.length(arg); err != nil {
+					return nil, err
+				}
+			}
+			v, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return arr, nil
+	case 5: // Map
+		m := map[string]any{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite {
+				if done, err := d.atBreak(); err != nil || done {
+					return m, err
+				}
+			} else if i == 0 {
+				if _, err := d.length(arg); err != nil {
+					return nil, err
+				}
+			}
+			k, err := d.item(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("cbor: map key %v is not a text string", k)
+			}
+			if m[key], err = d.item(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case 6: // Tag, ignored, but counted towards the depth so chains of them end
+		return d.item(depth + 1)
+	}
+
+	// Major type 7: simple values, and floats whose bits are the argument.
+	switch {
+	case indefinite:
+		return nil, errors.New("cbor: unexpected break")
+	case info == 25:
+		return float16(uint16(arg)), nil
+	case info == 26:
+		return float64(math.Float32frombits(uint32(arg))), nil
+	case info == 27:
+		return math.Float64frombits(arg), nil
+	case arg == 20:
+		return false, nil
+	case arg == 21:
+		return true, nil
+	case arg == 22 || arg == 23: // null and undefined
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cbor: unsupported simple value %d", arg)
+}
+
+// str decodes the contents of a byte or text string, joining the chunks of
+// an indefinite-length one.
+func (d *cborDecoder) str(major byte, arg uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		n, err := d.length(arg)
+		if err != nil {
+			return nil, err
+		}
+		s := d.data[d.pos : d.pos+n]
+		d.pos += n
+		return s, nil
+	}
+	var buf []byte
+	for {
+		if done, err := d.atBreak(); err != nil || done {
+			return buf, err
+		}
+		m, _, n, chunkIndefinite, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if m != major || chunkIndefinite {
+			return nil, errors.New("cbor: invalid chunk in indefinite-length string")
+		}
+		chunk, err := d.str(m, n, false)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, chunk...)
+	}
+}
+
+// float16 converts IEEE 754 half-precision bits to a float64.
+func float16(bits uint16) float64 {
+	sign := 1.0
+	if bits&0x8000 != 0 {
+		sign = -1
+	}
+	exp := int(bits>>10) & 0x1f
+	frac := float64(bits & 0x3ff)
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(frac, -24)
+	case 0x1f:
+		if frac != 0 {
+			return math.NaN()
+		}
+		return sign * math.Inf(1)
+	}
+	return sign * math.Ldexp(frac+1024, exp-25)
+}
+
+// jsonToCBOR transcodes a JSON payload to CBOR. Integers are encoded as CBOR
+// integers, other numbers as 64-bit floats, and map keys are sorted.
+func jsonToCBOR(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encodeCBOR(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeCBOR appends the CBOR encoding of a value decoded from JSON.
+func encodeCBOR(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if v {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			if i < 0 {
+				cborHead(buf, 1, uint64(-1-i))
+			} else {
+				cborHead(buf, 0, uint64(i))
+			}
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return fmt.Errorf("cbor: %w", err)
+		}
+		buf.WriteByte(0xfb)
+		_ = binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		cborHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case []any:
+		cborHead(buf, 4, uint64(len(v)))
+		for _, e := range v {
+			if err := encodeCBOR(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		cborHead(buf, 5, uint64(len(v)))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.SortFunc(keys, strings.Compare)
+		for _, k := range keys {
+			cborHead(buf, 3, uint64(len(k)))
+			buf.WriteString(k)
+			if err := encodeCBOR(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: unsupported type %T", v)
+	}
+	return nil
+}
+
+// cborHead appends an item's initial byte and argument in its shortest form.
+func cborHead(buf *bytes.Buffer, major byte, arg uint64) {
+	major <<= 5
+	switch {
+	case arg < 24:
+		buf.WriteByte(major | byte(arg))
+	case arg <= math.MaxUint8:
+		buf.Write([]byte{major | 24, byte(arg)})
+	case arg <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		_ = binary.Write(buf, binary.BigEndian, uint16(arg))
+	case arg <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		_ = binary.Write(buf, binary.BigEndian, uint32(arg))
+	default:
+		buf.WriteByte(major | 27)
+		_ = binary.Write(buf, binary.BigEndian, arg)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCBORToJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		cbor string // Hex
+		want string // Empty if decoding should fail
+	}{
+		{name: "unsigned integer", cbor: "1864", want: `100`},
+		{name: "negative integer", cbor: "3863", want: `-100`},
+		{name: "text string", cbor: "63616263", want: `"abc"`},
+		{name: "byte string", cbor: "43010203", want: `"AQID"`},
+		{name: "simple values", cbor: "83f4f5f6", want: `[false,true,null]`},
+		{name: "float16", cbor: "f93e00", want: `1.5`},
+		{name: "float16 largest", cbor: "f97bff", want: `65504`},
+		{name: "float16 subnormal", cbor: "f90001", want: `5.960464477539063e-8`},
+		{name: "float32", cbor: "fa47c35000", want: `100000`},
+		{name: "float64", cbor: "fb3ff199999999999a", want: `1.1`},
+		{name: "map", cbor: "a2616101616282f4f6", want: `{"a":1,"b":[false,null]}`},
+		{name: "indefinite array", cbor: "9f0102ff", want: `[1,2]`},
+		{name: "indefinite map", cbor: "bf616101ff", want: `{"a":1}`},
+		{name: "indefinite text string", cbor: "7f6261626163ff", want: `"abc"`},
+		{name: "tag ignored", cbor: "c11a514b67b0", want: `1363896240`},
+		{name: "nested to the limit", cbor: strings.Repeat("81", cborMaxDepth) + "00", want: strings.Repeat("[", cborMaxDepth) + "0" + strings.Repeat("]", cborMaxDepth)},
+
+		{name: "empty", cbor: ""},
+		{name: "truncated text string", cbor: "6261"},
+		{name: "truncated argument", cbor: "1901"},
+		{name: "truncated array", cbor: "830102"},
+		{name: "array longer than the payload", cbor: "9affffffff00"},
+		{name: "indefinite array without break", cbor: "9f0102"},
+		{name: "unexpected break", cbor: "ff"},
+		{name: "invalid chunk in indefinite string", cbor: "7f4161ff"},
+		{name: "trailing bytes", cbor: "0102"},
+		{name: "non-string map key", cbor: "a10102"},
+		{name: "invalid initial byte", cbor: "1c"},
+		{name: "unsupported simple value", cbor: "f0"},
+		{name: "nested too deep", cbor: strings.Repeat("81", cborMaxDepth+1) + "00"},
+		{name: "chain of tags", cbor: strings.Repeat("c0", 1<<20) + "00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := hex.DecodeString(tt.cbor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := cborToJSON(data)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("got %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONToCBOR(t *testing.T) {
+	tests := []struct {
+		json string
+		want string // Hex
+	}{
+		{json: `0`, want: "00"},
+		{json: `500`, want: "1901f4"},
+		{json: `-1`, want: "20"},
+		{json: `1.5`, want: "fb3ff8000000000000"},
+		{json: `"a"`, want: "6161"},
+		{json: `[true,false,null]`, want: "83f5f4f6"},
+		{json: `{"b":1,"a":2}`, want: "a2616102616201"},
+	}
+
+	for _, tt := range tests {
+		got, err := jsonToCBOR([]byte(tt.json))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.json, err)
+			continue
+		}
+		if want, _ := hex.DecodeString(tt.want); !bytes.Equal(got, want) {
+			t.Errorf("%s: got %x, want %s", tt.json, got, tt.want)
+		}
+	}
+
+	if _, err := jsonToCBOR([]byte(`{"a":`)); err == nil {
+		t.Error("got no error for truncated JSON")
+	}
+}
+
+func TestCBORRoundTrip(t *testing.T) {
+	payload := `{"object_name":"Cube","target_position":[1.5,-2,300000],"duration":0.25,` +
+		`"request_id":"r-1","feedback_retain":true,"tags":{"fleet":"a","note":null},"steps":[]}`
+
+	encoded, err := jsonToCBOR([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := cborToJSON(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var want, got any
+	if err := json.Unmarshal([]byte(payload), &want); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(decoded, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip gave %s, want %s", decoded, payload)
+	}
+}
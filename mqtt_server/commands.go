@@ -0,0 +1,99 @@
+package main
+
+import (
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// CommandHandler handles one type of command, such as moves. Each PUBLISH
+// the MoveCommandHook receives is given to the first handler matching its
+// topic, once the checks common to every command have passed: it isn't
+// looping back from the bridge, the server isn't draining, and its payload is
+// within the size limit and decoded from CBOR if need be.
+type CommandHandler interface {
+	// Match reports whether commands published on topic are for the handler.
+	Match(topic string) bool
+
+	// Kind names the command type, e.g. "move", which the handling time is
+	// recorded under.
+	Kind() string
+
+	// Handle handles the command cl published as pk, returning its feedback
+	// for the hook to publish. Commands which take a while to carry out
+	// return nil and publish their feedback once done. An error means the
+	// command couldn't be handled at all; it is logged and the command is
+	// sent to the dead-letter topic.
+	Handle(cl *mqtt.Client, pk packets.Packet) (*CommandFeedback, error)
+}
+
+// CommandFeedback is the feedback of a command handled by a CommandHandler.
+type CommandFeedback struct {
+	Topic     string       // Feedback topic, under the hook's namespace
+	Payload   any          // Marshalled to JSON, and to CBOR if the command was
+	RequestID string       // Request ID of the command, for logging and replays
+	Status    string       // Status of the command, for logging
+	Reply     replyContext // How the command was published, which the feedback mirrors
+}
+
+// Kinds of the hook's own commands.
+const (
+	commandKindMove   = "move"
+	commandKindBatch  = "batch"
+	commandKindCancel = "cancel"
+)
+
+// topicCommand is one of the hook's own command types, received on one of its
+// configurable topics.
+type topicCommand struct {
+	hook   *MoveCommandHook
+	kind   string
+	topic  *string // Guarded by hook.topicsMu, as SetTopics may change it
+	handle func(*mqtt.Client, packets.Packet)
+}
+
+// Match reports whether topic is the command's topic, under the namespace.
+func (c topicCommand) Match(topic string) bool {
+	t := c.hook.topic(c.topic)
+	return t != "" && t == topic
+}
+
+// Kind returns the command type.
+func (c topicCommand) Kind() string {
+	return c.kind
+}
+
+// Handle handles the command, which always succeeds as errors are answered
+// with feedback. The hook's own commands publish all their feedback
+// themselves, as it goes through history, the feedback cache and batching.
+func (c topicCommand) Handle(cl *mqtt.Client, pk packets.Packet) (*CommandFeedback, error) {
+	c.handle(cl, pk)
+	return nil, nil
+}
+
+// builtinCommands returns handlers for the hook's own move, batch and cancel
+// commands.
+func (h *MoveCommandHook) builtinCommands() []CommandHandler {
+	return []CommandHandler{
+		topicCommand{hook: h, kind: commandKindMove, topic: &h.commandTopic, handle: h.handleMove},
+		topicCommand{hook: h, kind: commandKindBatch, topic: &h.batchCommandTopic, handle: h.handleBatch},
+		topicCommand{hook: h, kind: commandKindCancel, topic: &h.cancelTopic, handle: h.handleCancel},
+	}
+}
+
+// Register adds a handler for another type of command. Handlers are tried
+// after the hook's own commands, in the order they were registered. It must
+// be called before the hook is added to the server.
+func (h *MoveCommandHook) Register(handler CommandHandler) {
+	h.handlers = append(h.handlers, handler)
+}
+
+// commandHandler returns the handler for commands published on topic, or nil
+// if there is none.
+func (h *MoveCommandHook) commandHandler(topic string) CommandHandler {
+	for _, handler := range h.handlers {
+		if handler.Match(topic) {
+			return handler
+		}
+	}
+	return nil
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config contains the server configuration. It is loaded from a YAML or JSON
+// file passed with -config; any values not present in the file keep their
+// defaults.
+type Config struct {
+	MQTTAddr       string   `yaml:"mqtt_addr" json:"mqtt_addr"`               // address of the plaintext MQTT listener
+	MQTTTLSAddr    string   `yaml:"mqtt_tls_addr" json:"mqtt_tls_addr"`       // address of the MQTT listener when TLS is enabled
+	MQTTListenerID string   `yaml:"mqtt_listener_id" json:"mqtt_listener_id"` // id of the TCP listener
+	WSAddr         string   `yaml:"ws_addr" json:"ws_addr"`                   // address of the MQTT over WebSocket listener
+	WSPath         string   `yaml:"ws_path" json:"ws_path"`                   // HTTP path the WebSocket listener is mounted at
+	WSListenerID   string   `yaml:"ws_listener_id" json:"ws_listener_id"`     // id of the WebSocket listener
+	HTTPAddr       string   `yaml:"http_addr" json:"http_addr"`               // address of the HTTP API server
+	GRPCAddr       string   `yaml:"grpc_addr" json:"grpc_addr"`               // address of the gRPC API server, over TLS when configured, empty to disable
+	CORSOrigins    []string `yaml:"cors_origins" json:"cors_origins"`         // origins browsers may call the HTTP API from, "*" for any, empty to disallow cross-origin requests
+	AuthFile       string   `yaml:"auth_file" json:"auth_file"`               // auth ledger with client credentials and topic ACLs, empty to allow all
+	InlineClientID string   `yaml:"inline_client_id" json:"inline_client_id"` // client ID the bridge publishes its own messages as
+
+	RejectRootWildcards bool    `yaml:"reject_root_wildcards" json:"reject_root_wildcards"` // reject subscriptions to filters starting with # or +
+	KeepaliveMultiplier float64 `yaml:"keepalive_multiplier" json:"keepalive_multiplier"`   // clients silent for this many times their keepalive are disconnected
+	MaxPacketBytes      int     `yaml:"max_packet_bytes" json:"max_packet_bytes"`           // clients sending larger MQTT packets are disconnected, 0 for no limit
+	MaxClients          int     `yaml:"max_clients" json:"max_clients"`                     // new clients are refused while this many are connected, 0 for no limit
+
+	MaxRetainedBytes       int    `yaml:"max_retained_bytes" json:"max_retained_bytes"`             // retained publishes with a larger payload are rejected, 0 for no limit
+	RetainedRejectionTopic string `yaml:"retained_rejection_topic" json:"retained_rejection_topic"` // topic a notice of each rejected retained publish is sent to, empty to disable
+
+	Namespace     string `yaml:"namespace" json:"namespace"`           // prefix of the command and feedback topics, e.g. sceneA, empty for none
+	CommandTopic  string `yaml:"command_topic" json:"command_topic"`   // topic move commands are received on
+	FeedbackTopic string `yaml:"feedback_topic" json:"feedback_topic"` // topic move feedback is published to, may contain {object_name} and {request_id}
+	ErrorTopic    string `yaml:"error_topic" json:"error_topic"`       // dead-letter topic for unattributable malformed commands
+	FeedbackQos   byte   `yaml:"feedback_qos" json:"feedback_qos"`     // QoS feedback is delivered with, 0-2
+
+	BatchCommandTopic  string `yaml:"batch_command_topic" json:"batch_command_topic"`   // topic batches of move commands are received on
+	BatchFeedbackTopic string `yaml:"batch_feedback_topic" json:"batch_feedback_topic"` // topic batch results are published to
+	CancelTopic        string `yaml:"cancel_topic" json:"cancel_topic"`                 // topic requests to cancel in-flight moves are received on
+	StatusTopic        string `yaml:"status_topic" json:"status_topic"`                 // retained online/offline status of the bridge, empty to disable
+
+	RotateCommandTopic  string `yaml:"rotate_command_topic" json:"rotate_command_topic"`   // topic rotate commands are received on, empty to disable them
+	RotateFeedbackTopic string `yaml:"rotate_feedback_topic" json:"rotate_feedback_topic"` // topic rotate feedback is published to
+
+	SpawnCommandTopic    string `yaml:"spawn_command_topic" json:"spawn_command_topic"`       // topic spawn commands are received on, empty to disable spawning and despawning
+	SpawnFeedbackTopic   string `yaml:"spawn_feedback_topic" json:"spawn_feedback_topic"`     // topic spawn feedback is published to
+	DespawnCommandTopic  string `yaml:"despawn_command_topic" json:"despawn_command_topic"`   // topic despawn commands are received on
+	DespawnFeedbackTopic string `yaml:"despawn_feedback_topic" json:"despawn_feedback_topic"` // topic despawn feedback is published to
+
+	ClearRetainedOnShutdown []string `yaml:"clear_retained_on_shutdown" json:"clear_retained_on_shutdown"` // topic filters whose retained messages are cleared on graceful shutdown
+
+	FeedbackFlushInterval  time.Duration `yaml:"feedback_flush_interval" json:"feedback_flush_interval"`   // how long move feedback is buffered to publish together, 0 to publish each on its own
+	AggregateFeedbackTopic string        `yaml:"aggregate_feedback_topic" json:"aggregate_feedback_topic"` // topic buffered move feedback is published to as a JSON array
+
+	FeedbackCacheTTL  time.Duration `yaml:"feedback_cache_ttl" json:"feedback_cache_ttl"`   // how long feedback is kept to replay to clients which reconnect, 0 to disable
+	FeedbackCacheSize int           `yaml:"feedback_cache_size" json:"feedback_cache_size"` // feedback messages kept per request ID
+
+	MaxMoveDuration time.Duration `yaml:"max_move_duration" json:"max_move_duration"` // longest duration a move may ask for, e.g. 60s, longer moves are rejected, 0 for no limit
+	DedupWindow     time.Duration `yaml:"dedup_window" json:"dedup_window"`           // how long request IDs are remembered to answer retransmits from cache, 0 to disable
+	MoveWorkers     int           `yaml:"move_workers" json:"move_workers"`           // moves simulated at once, 0 for no limit
+	MoveQueueSize   int           `yaml:"move_queue_size" json:"move_queue_size"`     // moves which may wait for a worker before new ones are rejected as busy
+	MaxQueueWait    time.Duration `yaml:"max_queue_wait" json:"max_queue_wait"`       // longest a move may wait to start before it is rejected as stale, 0 for no limit
+	MaxPayloadBytes int           `yaml:"max_payload_bytes" json:"max_payload_bytes"` // largest command payload processed, 0 for no limit
+	ProgressSteps   int           `yaml:"progress_steps" json:"progress_steps"`       // in_progress updates published at even intervals during each move, 0 to disable
+	MoveFailureRate float64       `yaml:"move_failure_rate" json:"move_failure_rate"` // fraction of moves which randomly report failed, 0-1, for testing agent error handling
+	FeedbackDelayMs int           `yaml:"feedback_delay_ms" json:"feedback_delay_ms"` // milliseconds a finished move's feedback is held back, to emulate latency
+	NoOpEpsilon     float64       `yaml:"no_op_epsilon" json:"no_op_epsilon"`         // distance from an object's position within which a move is answered at once with status no_op, 0 to disable
+	CommandRate     float64       `yaml:"command_rate" json:"command_rate"`           // move commands per second each client may send, 0 for no limit
+	CommandBurst    int           `yaml:"command_burst" json:"command_burst"`         // move commands a client may send at once before command_rate applies
+	GlobalRate      float64       `yaml:"global_rate" json:"global_rate"`             // move commands per second processed across all clients, 0 for no limit
+	GlobalBurst     int           `yaml:"global_burst" json:"global_burst"`           // move commands processed at once across all clients before global_rate applies
+	TimestampFormat string        `yaml:"timestamp_format" json:"timestamp_format"`   // feedback timestamp format: rfc3339, rfc3339nano, unix or unixmilli
+
+	SlowCommandThreshold time.Duration `yaml:"slow_command_threshold" json:"slow_command_threshold"` // time handling a command above which it is logged as slow, 0 to disable
+	PublishLogSample     int           `yaml:"publish_log_sample" json:"publish_log_sample"`         // log 1 in this many routine command and feedback messages, 0 for none, rejections and errors are always logged
+	ShutdownGracePeriod  time.Duration `yaml:"shutdown_grace_period" json:"shutdown_grace_period"`   // how long shutdown waits for in-flight moves to finish before interrupting them
+	DefaultMoveDuration  time.Duration `yaml:"default_move_duration" json:"default_move_duration"`   // duration of moves which don't give one
+	EchoUserProperties   []string      `yaml:"echo_user_properties" json:"echo_user_properties"`     // MQTT v5 user properties copied from commands onto their feedback
+	CommandEncoding      string        `yaml:"command_encoding" json:"command_encoding"`             // json or cbor, for commands without an MQTT v5 content type
+
+	Bounds     *Bounds `yaml:"bounds" json:"bounds"`           // scene bounding box move targets must lie within, unset for no limit
+	BoundsMode string  `yaml:"bounds_mode" json:"bounds_mode"` // clamp or reject targets outside the bounds
+
+	PositionDecimals *int `yaml:"position_decimals" json:"position_decimals"` // decimal places move targets are rounded to, unset for no rounding
+
+	CoordinateTransform *CoordinateTransform `yaml:"coordinate_transform" json:"coordinate_transform"` // converts agent positions to scene positions and back, unset for none
+
+	CommandHandlers []CommandHandlerConfig `yaml:"command_handlers" json:"command_handlers"` // extra handlers for fleets with their own command topic, bounds and allowed objects
+
+	AllowedObjects []string `yaml:"allowed_objects" json:"allowed_objects"` // object names move commands may target, empty to allow any
+
+	CommandSchemaFile string `yaml:"command_schema_file" json:"command_schema_file"` // JSON Schema move command payloads must match, empty to skip the check
+
+	TracingEndpoint string `yaml:"tracing_endpoint" json:"tracing_endpoint"` // OTLP/HTTP traces URL move command spans are exported to, empty to disable tracing
+
+	HistoryFile     string `yaml:"history_file" json:"history_file"`           // JSONL file every move and its feedback is appended to, empty to disable
+	HistoryMaxBytes int64  `yaml:"history_max_bytes" json:"history_max_bytes"` // size the history file is rotated at, 0 for no limit
+
+	StoreFile string `yaml:"store_file" json:"store_file"` // file retained messages and sessions are persisted to, empty to keep them in memory
+
+	YieldsFile string `yaml:"yields_file" json:"yields_file"` // JSON file /yearly_yields is served from, reread on each request
+
+	Sensors        []Sensor      `yaml:"sensors" json:"sensors"`                 // sensors simulated with -simulate
+	SensorInterval time.Duration `yaml:"sensor_interval" json:"sensor_interval"` // time between simulated sensor readings
+}
+
+// DefaultConfig returns the configuration used when no config file is given.
+func DefaultConfig() *Config {
+	return &Config{
+		MQTTAddr:       ":1883",
+		MQTTTLSAddr:    ":8883",
+		MQTTListenerID: "mqtt",
+		WSAddr:         ":1882",
+		WSPath:         "/mqtt",
+		WSListenerID:   "ws",
+		HTTPAddr:       ":8080",
+		CORSOrigins:    []string{"*"},
+		InlineClientID: mqtt.InlineClientId,
+
+		KeepaliveMultiplier: 1.5,
+		MaxPacketBytes:      1 << 20,
+		CommandTopic:        "unity/commands/move",
+		FeedbackTopic:       "unity/feedback/move_complete",
+		ErrorTopic:          "unity/feedback/errors",
+		FeedbackQos:         1,
+
+		BatchCommandTopic:  "unity/commands/move_batch",
+		BatchFeedbackTopic: "unity/feedback/move_batch_complete",
+		CancelTopic:        "unity/commands/cancel",
+		StatusTopic:        "system/status/mqtt_bridge",
+
+		RotateCommandTopic:  "unity/commands/rotate",
+		RotateFeedbackTopic: "unity/feedback/rotate_complete",
+
+		SpawnCommandTopic:    "unity/commands/spawn",
+		SpawnFeedbackTopic:   "unity/feedback/spawn_complete",
+		DespawnCommandTopic:  "unity/commands/despawn",
+		DespawnFeedbackTopic: "unity/feedback/despawn_complete",
+
+		AggregateFeedbackTopic: "unity/feedback/move_complete_batch",
+
+		FeedbackCacheSize: 10,
+
+		MaxMoveDuration: 60 * time.Second,
+		DedupWindow:     5 * time.Minute,
+		MoveWorkers:     64,
+		MoveQueueSize:   1024,
+		MaxPayloadBytes: 64 << 10,
+		NoOpEpsilon:     0.001,
+		CommandBurst:    10,
+		GlobalBurst:     100,
+		TimestampFormat: TimestampRFC3339,
+		BoundsMode:      BoundsClamp,
+
+		SlowCommandThreshold: 100 * time.Millisecond,
+		PublishLogSample:     1,
+		ShutdownGracePeriod:  10 * time.Second,
+		EchoUserProperties:   []string{"correlation-id", "trace-id"},
+		CommandEncoding:      EncodingJSON,
+
+		HistoryMaxBytes: 10 << 20,
+
+		Sensors: []Sensor{
+			{Topic: "sludge_pool/ammonia", Min: 0, Max: 40, Unit: "mg/L"},
+			{Topic: "sludge_pool/nitrate", Min: 0, Max: 50, Unit: "mg/L"},
+			{Topic: "sludge_pool/phosphate", Min: 0, Max: 12, Unit: "mg/L"},
+			{Topic: "chemical_tank/ammonia", Min: 0, Max: 25, Unit: "mg/L"},
+			{Topic: "chemical_tank/iron", Min: 0, Max: 3, Unit: "mg/L"},
+			{Topic: "chemical_tank/chlorine", Min: 0.2, Max: 4, Unit: "mg/L"},
+		},
+		SensorInterval: 5 * time.Second,
+	}
+}
+
+// LoadConfig reads a YAML or JSON config file over the default configuration.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	// JSON is a subset of YAML, so the YAML decoder handles both formats.
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing config %s: %w", path, err)
+	}
+
+	return cfg, nil
+}
+
+// redacted returns a copy of c which is safe to show, with any credentials in
+// URLs masked. Client credentials live in the auth file rather than the
+// config, so only its path is shown.
+func (c *Config) redacted() *Config {
+	r := *c
+	r.TracingEndpoint = redactURL(c.TracingEndpoint)
+	return &r
+}
+
+// redactURL masks the password and query parameter values of rawURL, which
+// may carry tokens. A user name without a password is masked too, as it is
+// usually a token itself.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || rawURL == "" {
+		return rawURL
+	}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "REDACTED")
+		} else {
+			u.User = url.User("REDACTED")
+		}
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query.Set(key, "REDACTED")
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// validateAddr returns an error if addr isn't a valid host:port listen address.
+func validateAddr(key, addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%s %q is not a valid address: %w", key, addr, err)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return fmt.Errorf("%s %q has an invalid port: %w", key, addr, err)
+	}
+	return nil
+}
+
+// validateFeedbackTopic returns an error if topic contains wildcards or
+// placeholders other than {object_name} and {request_id}.
+func validateFeedbackTopic(topic string) error {
+	if strings.ContainsAny(topic, "#+") {
+		return fmt.Errorf("feedback_topic must not contain wildcards, got %q", topic)
+	}
+	rest := strings.NewReplacer(placeholderObjectName, "", placeholderRequestID, "").Replace(topic)
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("feedback_topic may only contain the placeholders %s and %s, got %q",
+			placeholderObjectName, placeholderRequestID, topic)
+	}
+	return nil
+}
+
+// Validate returns an error if the configuration contains invalid values.
+func (c *Config) Validate() error {
+	addrs := []struct{ key, addr string }{
+		{"mqtt_addr", c.MQTTAddr},
+		{"mqtt_tls_addr", c.MQTTTLSAddr},
+		{"ws_addr", c.WSAddr},
+		{"http_addr", c.HTTPAddr},
+	}
+	if c.GRPCAddr != "" {
+		addrs = append(addrs, struct{ key, addr string }{"grpc_addr", c.GRPCAddr})
+	}
+	for _, a := range addrs {
+		if err := validateAddr(a.key, a.addr); err != nil {
+			return err
+		}
+	}
+	if !(c.KeepaliveMultiplier >= 1) {
+		return fmt.Errorf("keepalive_multiplier must be at least 1, got %g", c.KeepaliveMultiplier)
+	}
+	if c.InlineClientID == "" {
+		return fmt.Errorf("inline_client_id must not be empty")
+	}
+	if c.MaxClients < 0 {
+		return fmt.Errorf("max_clients must not be negative, got %d", c.MaxClients)
+	}
+	if c.MaxPacketBytes < 0 {
+		return fmt.Errorf("max_packet_bytes must not be negative, got %d", c.MaxPacketBytes)
+	}
+	if c.MaxRetainedBytes < 0 {
+		return fmt.Errorf("max_retained_bytes must not be negative, got %d", c.MaxRetainedBytes)
+	}
+	if strings.ContainsAny(c.RetainedRejectionTopic, "#+") {
+		return fmt.Errorf("retained_rejection_topic must not contain wildcards, got %q", c.RetainedRejectionTopic)
+	}
+	if strings.ContainsAny(c.Namespace, "#+") || strings.HasPrefix(c.Namespace, "/") || strings.HasSuffix(c.Namespace, "/") {
+		return fmt.Errorf("namespace must not contain wildcards or start or end with /, got %q", c.Namespace)
+	}
+	if err := validateFeedbackTopic(c.FeedbackTopic); err != nil {
+		return err
+	}
+	if c.RotateCommandTopic != "" && (c.RotateFeedbackTopic == "" || strings.ContainsAny(c.RotateFeedbackTopic, "#+")) {
+		return fmt.Errorf("rotate_feedback_topic must be a topic without wildcards when rotate_command_topic is set, got %q", c.RotateFeedbackTopic)
+	}
+	if c.SpawnCommandTopic != "" {
+		for name, topic := range map[string]string{
+			"spawn_feedback_topic":   c.SpawnFeedbackTopic,
+			"despawn_command_topic":  c.DespawnCommandTopic,
+			"despawn_feedback_topic": c.DespawnFeedbackTopic,
+		} {
+			if topic == "" || strings.ContainsAny(topic, "#+") {
+				return fmt.Errorf("%s must be a topic without wildcards when spawn_command_topic is set, got %q", name, topic)
+			}
+		}
+	}
+	if c.FeedbackQos > 2 {
+		return fmt.Errorf("feedback_qos must be 0, 1 or 2, got %d", c.FeedbackQos)
+	}
+	for _, filter := range c.ClearRetainedOnShutdown {
+		if !mqtt.IsValidFilter(filter, false) {
+			return fmt.Errorf("clear_retained_on_shutdown contains an invalid topic filter %q", filter)
+		}
+	}
+	for _, name := range c.AllowedObjects {
+		if name == "" {
+			return fmt.Errorf("allowed_objects must not contain empty names")
+		}
+	}
+	if c.BoundsMode != BoundsClamp && c.BoundsMode != BoundsReject {
+		return fmt.Errorf("bounds_mode must be %q or %q, got %q", BoundsClamp, BoundsReject, c.BoundsMode)
+	}
+	if c.CommandEncoding != EncodingJSON && c.CommandEncoding != EncodingCBOR {
+		return fmt.Errorf("command_encoding must be %q or %q, got %q", EncodingJSON, EncodingCBOR, c.CommandEncoding)
+	}
+	if !validTimestampFormat(c.TimestampFormat) {
+		return fmt.Errorf("timestamp_format must be %q, %q, %q or %q, got %q",
+			TimestampRFC3339, TimestampRFC3339Nano, TimestampUnix, TimestampUnixMilli, c.TimestampFormat)
+	}
+	if c.MaxPayloadBytes < 0 {
+		return fmt.Errorf("max_payload_bytes must not be negative, got %d", c.MaxPayloadBytes)
+	}
+	if !(c.MoveFailureRate >= 0 && c.MoveFailureRate <= 1) {
+		return fmt.Errorf("move_failure_rate must be between 0 and 1, got %g", c.MoveFailureRate)
+	}
+	if c.CommandRate < 0 {
+		return fmt.Errorf("command_rate must not be negative, got %g", c.CommandRate)
+	}
+	if c.CommandRate > 0 && c.CommandBurst < 1 {
+		return fmt.Errorf("command_burst must be at least 1 when command_rate is set, got %d", c.CommandBurst)
+	}
+	if c.GlobalRate < 0 {
+		return fmt.Errorf("global_rate must not be negative, got %g", c.GlobalRate)
+	}
+	if c.GlobalRate > 0 && c.GlobalBurst < 1 {
+		return fmt.Errorf("global_burst must be at least 1 when global_rate is set, got %d", c.GlobalBurst)
+	}
+	if c.PublishLogSample < 0 {
+		return fmt.Errorf("publish_log_sample must not be negative, got %d", c.PublishLogSample)
+	}
+	if c.SlowCommandThreshold < 0 {
+		return fmt.Errorf("slow_command_threshold must not be negative, got %v", c.SlowCommandThreshold)
+	}
+	if c.MaxMoveDuration < 0 {
+		return fmt.Errorf("max_move_duration must not be negative, got %v", c.MaxMoveDuration)
+	}
+	if c.DefaultMoveDuration < 0 {
+		return fmt.Errorf("default_move_duration must not be negative, got %v", c.DefaultMoveDuration)
+	}
+	if c.MaxMoveDuration > 0 && c.DefaultMoveDuration > c.MaxMoveDuration {
+		return fmt.Errorf("default_move_duration %v is longer than max_move_duration %v", c.DefaultMoveDuration, c.MaxMoveDuration)
+	}
+	if c.MoveWorkers < 0 {
+		return fmt.Errorf("move_workers must not be negative, got %d", c.MoveWorkers)
+	}
+	if c.MaxQueueWait < 0 {
+		return fmt.Errorf("max_queue_wait must not be negative, got %v", c.MaxQueueWait)
+	}
+	if c.MoveQueueSize < 0 {
+		return fmt.Errorf("move_queue_size must not be negative, got %d", c.MoveQueueSize)
+	}
+	if c.MoveWorkers > 0 && c.MoveQueueSize < 1 {
+		// Every move waits in the queue for a worker, however briefly.
+		return fmt.Errorf("move_queue_size must be at least 1 when move_workers is set, got %d", c.MoveQueueSize)
+	}
+	if c.ShutdownGracePeriod < 0 {
+		return fmt.Errorf("shutdown_grace_period must not be negative, got %v", c.ShutdownGracePeriod)
+	}
+	if c.FeedbackFlushInterval < 0 {
+		return fmt.Errorf("feedback_flush_interval must not be negative, got %v", c.FeedbackFlushInterval)
+	}
+	if c.FeedbackFlushInterval > 0 && (c.AggregateFeedbackTopic == "" || strings.ContainsAny(c.AggregateFeedbackTopic, "#+")) {
+		return fmt.Errorf("aggregate_feedback_topic must be a topic without wildcards when feedback_flush_interval is set, got %q", c.AggregateFeedbackTopic)
+	}
+	if c.FeedbackCacheTTL < 0 {
+		return fmt.Errorf("feedback_cache_ttl must not be negative, got %v", c.FeedbackCacheTTL)
+	}
+	if c.FeedbackCacheTTL > 0 && c.FeedbackCacheSize < 1 {
+		return fmt.Errorf("feedback_cache_size must be at least 1 when feedback_cache_ttl is set, got %d", c.FeedbackCacheSize)
+	}
+	if c.PositionDecimals != nil && (*c.PositionDecimals < 0 || *c.PositionDecimals > 15) {
+		return fmt.Errorf("position_decimals must be from 0 to 15, got %d", *c.PositionDecimals)
+	}
+	if c.NoOpEpsilon < 0 {
+		return fmt.Errorf("no_op_epsilon must not be negative, got %g", c.NoOpEpsilon)
+	}
+	if c.FeedbackDelayMs < 0 {
+		return fmt.Errorf("feedback_delay_ms must not be negative, got %d", c.FeedbackDelayMs)
+	}
+	if c.ProgressSteps < 0 {
+		return fmt.Errorf("progress_steps must not be negative, got %d", c.ProgressSteps)
+	}
+	if c.HistoryMaxBytes < 0 {
+		return fmt.Errorf("history_max_bytes must not be negative, got %d", c.HistoryMaxBytes)
+	}
+	if c.Bounds != nil {
+		if err := c.Bounds.validate(); err != nil {
+			return err
+		}
+	}
+	if c.CoordinateTransform != nil {
+		if err := c.CoordinateTransform.validate(); err != nil {
+			return err
+		}
+	}
+	if c.TracingEndpoint != "" {
+		if u, err := url.Parse(c.TracingEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("tracing_endpoint must be an http or https URL, got %q", c.TracingEndpoint)
+		}
+	}
+	if err := c.validateCommandHandlers(); err != nil {
+		return err
+	}
+	for _, s := range c.Sensors {
+		if err := s.validate(); err != nil {
+			return err
+		}
+	}
+	if c.SensorInterval <= 0 {
+		return fmt.Errorf("sensor_interval must be positive, got %s", c.SensorInterval)
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// ConnectionHook logs clients connecting and disconnecting, refuses clients
+// over the connection limit, rejects oversized retained messages, counts the
+// active connections for the /healthz endpoint, and tracks when each client
+// connected and last sent a packet for the /clients endpoint.
+type ConnectionHook struct {
+	mqtt.HookBase
+	server *mqtt.Server // Reference to the MQTT server to refuse connections with
+	active atomic.Int64 // Clients with an established session
+
+	// New clients are refused while this many are connected. Zero for no
+	// limit.
+	maxClients int
+
+	// Clients are disconnected once they have sent nothing for this many
+	// times their keepalive. Zero keeps mochi's default of 1.5.
+	keepaliveMultiplier float64
+
+	// Clients sending a packet larger than this many bytes are disconnected
+	// before it is processed. Zero for no limit.
+	maxPacketBytes int
+
+	// Retained publishes with a payload larger than this many bytes are
+	// rejected, so they aren't kept in memory and sent to every new
+	// subscriber. Zero for no limit.
+	maxRetainedBytes int
+
+	// Topic a RetainedRejection notice is published to for each rejected
+	// retained publish. Empty to disable.
+	rejectionTopic string
+
+	mu      sync.RWMutex
+	clients map[string]*clientActivity // Activity of connected clients, keyed on client ID
+}
+
+// clientActivity records when a client connected and last sent a packet.
+type clientActivity struct {
+	client      *mqtt.Client
+	connectedAt time.Time
+	lastPacket  atomic.Int64 // Unix nanoseconds
+}
+
+// ID returns the ID of the hook.
+func (h *ConnectionHook) ID() string {
+	return "ConnectionHook"
+}
+
+// Provides indicates the methods that the hook provides.
+func (h *ConnectionHook) Provides(p byte) bool {
+	return p == mqtt.OnConnect || p == mqtt.OnSessionEstablished || p == mqtt.OnDisconnect || p == mqtt.OnPacketRead ||
+		p == mqtt.OnWillSent || p == mqtt.OnPublish
+}
+
+// Init initializes the hook's internal state. It is called by server.AddHook.
+func (h *ConnectionHook) Init(config any) error {
+	h.clients = make(map[string]*clientActivity)
+	return nil
+}
+
+// OnConnect is called when a client sends a CONNECT packet, before it is
+// authenticated.
+func (h *ConnectionHook) OnConnect(cl *mqtt.Client, pk packets.Packet) error {
+	cn := peerCommonName(cl)
+	h.Log.Info("client connecting", "client_id", cl.ID, "remote_addr", cl.Net.Remote,
+		"listener", cl.Net.Listener, "clean_session", pk.Connect.Clean, "keepalive", cl.State.Keepalive,
+		"client_cn", cn)
+	if cn != "" {
+		// The auth ledger's rules match on username, so a client with a
+		// verified certificate is identified by its CN rather than whatever
+		// username it claims.
+		cl.Properties.Username = []byte(cn)
+	}
+	if existing, ok := h.server.Clients.Get(cl.ID); ok && existing.Net.Inline {
+		// Taking over the inline client's session would leave the bridge
+		// publishing feedback as this client.
+		h.Log.Warn("refused connection using the inline client's ID", "client_id", cl.ID,
+			"remote_addr", cl.Net.Remote, "listener", cl.Net.Listener)
+		return h.refuse(cl, packets.ErrClientIdentifierNotValid)
+	}
+	if h.full(cl) {
+		h.Log.Warn("refused connection over the client limit", "client_id", cl.ID, "remote_addr", cl.Net.Remote,
+			"listener", cl.Net.Listener, "active_connections", h.active.Load(), "limit", h.maxClients)
+		// MQTT 3 has no busy code, so mochi's own client limit sends
+		// server unavailable instead.
+		code := packets.ErrServerBusy
+		if cl.Properties.ProtocolVersion < 5 {
+			code = packets.ErrServerUnavailable
+		}
+		return h.refuse(cl, code)
+	}
+	if cl.State.Keepalive > 0 && h.keepaliveMultiplier > 0 {
+		cl.State.Keepalive = scaleKeepalive(cl.State.Keepalive, h.keepaliveMultiplier)
+	}
+	return nil
+}
+
+// full reports whether the connection limit is reached. A client taking over
+// the session of a connected client with the same ID doesn't add a
+// connection, so is let in.
+func (h *ConnectionHook) full(cl *mqtt.Client) bool {
+	if h.maxClients <= 0 || h.active.Load() < int64(h.maxClients) {
+		return false
+	}
+	h.mu.RLock()
+	_, takeover := h.clients[cl.ID]
+	h.mu.RUnlock()
+	return !takeover
+}
+
+// refuse sends a client a CONNACK with the reason code it is refused for,
+// returning the code to reject the connection.
+func (h *ConnectionHook) refuse(cl *mqtt.Client, code packets.Code) error {
+	if err := h.server.SendConnack(cl, code, false, nil); err != nil {
+		h.Log.Error("failed to send refusal", "client_id", cl.ID, "error", err)
+	}
+	return code
+}
+
+// scaleKeepalive returns the keepalive to give mochi so that a client which
+// negotiated keepalive is disconnected after multiplier times as long without
+// a packet. mochi itself allows 1.5 times the keepalive, rounded down to
+// whole seconds.
+func scaleKeepalive(keepalive uint16, multiplier float64) uint16 {
+	timeout := math.Ceil(float64(keepalive) * multiplier)
+	k := math.Ceil(timeout / 1.5)
+	for k+math.Floor(k/2) < timeout {
+		k++
+	}
+	return uint16(min(k, math.MaxUint16))
+}
+
+// OnSessionEstablished is called once a client has been accepted. Connections
+// are counted here rather than in OnConnect, as a client which fails
+// authentication is never passed to OnDisconnect.
+func (h *ConnectionHook) OnSessionEstablished(cl *mqtt.Client, pk packets.Packet) {
+	now := time.Now()
+	activity := &clientActivity{client: cl, connectedAt: now}
+	activity.lastPacket.Store(now.UnixNano())
+	h.mu.Lock()
+	h.clients[cl.ID] = activity
+	h.mu.Unlock()
+
+	active := h.active.Add(1)
+	h.Log.Info("client connected", "client_id", cl.ID, "remote_addr", cl.Net.Remote,
+		"listener", cl.Net.Listener, "active_connections", active)
+}
+
+// OnPacketRead is called when a packet is received from a client. Clients
+// sending a packet over the size limit are disconnected before it reaches the
+// other hooks.
+func (h *ConnectionHook) OnPacketRead(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if size := packetSize(pk.FixedHeader); h.maxPacketBytes > 0 && size > h.maxPacketBytes {
+		h.Log.Warn("disconnecting client for oversized packet", "client_id", cl.ID, "remote_addr", cl.Net.Remote,
+			"type", packets.PacketNames[pk.FixedHeader.Type], "size", size, "limit", h.maxPacketBytes)
+		return pk, fmt.Errorf("%w: %d byte packet is larger than the limit of %d", packets.ErrRejectPacket, size, h.maxPacketBytes)
+	}
+
+	h.mu.RLock()
+	activity, ok := h.clients[cl.ID]
+	h.mu.RUnlock()
+	if ok && activity.client == cl {
+		activity.lastPacket.Store(time.Now().UnixNano())
+	}
+	return pk, nil
+}
+
+// packetSize returns the size in bytes of the packet with header fh,
+// including the fixed header itself.
+func packetSize(fh packets.FixedHeader) int {
+	size := 1 + fh.Remaining // Type and flags byte, and the rest of the packet
+	for n := fh.Remaining; ; n >>= 7 {
+		size++ // Each byte of the remaining length holds 7 bits
+		if n < 128 {
+			return size
+		}
+	}
+}
+
+// OnDisconnect is called when a client with an established session disconnects.
+func (h *ConnectionHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.mu.Lock()
+	// A client taken over by a new connection with the same ID is
+	// disconnected after its replacement has been recorded.
+	if activity, ok := h.clients[cl.ID]; ok && activity.client == cl {
+		delete(h.clients, cl.ID)
+	}
+	h.mu.Unlock()
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		k := time.Duration(cl.State.Keepalive)
+		h.Log.Warn("client keepalive expired", "client_id", cl.ID, "remote_addr", cl.Net.Remote,
+			"timeout", (k+k/2)*time.Second)
+	}
+
+	active := h.active.Add(-1)
+	h.Log.Info("client disconnected", "client_id", cl.ID, "remote_addr", cl.Net.Remote,
+		"listener", cl.Net.Listener, "error", err, "session_expired", expire, "active_connections", active)
+}
+
+// RetainedRejection is the notice published to the rejection topic when a
+// retained publish is rejected for its size.
+type RetainedRejection struct {
+	ClientID  string `json:"client_id"`
+	Topic     string `json:"topic"`
+	Size      int    `json:"size"`  // Payload size in bytes
+	Limit     int    `json:"limit"` // Largest retained payload allowed, in bytes
+	Timestamp string `json:"timestamp"`
+}
+
+// OnPublish rejects retained publishes with a payload over the retained size
+// limit before they are stored or delivered. MQTT v5 clients publishing at
+// QoS 1 or 2 are told why in the acknowledgement; other publishes are dropped
+// silently, as MQTT 3 has no way to refuse a publish. The bridge's own
+// messages are never rejected.
+func (h *ConnectionHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	if h.maxRetainedBytes <= 0 || !pk.FixedHeader.Retain || len(pk.Payload) <= h.maxRetainedBytes || cl.Net.Inline {
+		return pk, nil
+	}
+
+	retainedRejected.Inc()
+	h.Log.Warn("rejected oversized retained message", "client_id", cl.ID, "remote_addr", cl.Net.Remote,
+		"topic", pk.TopicName, "size", len(pk.Payload), "limit", h.maxRetainedBytes)
+	h.publishRejection(RetainedRejection{
+		ClientID:  cl.ID,
+		Topic:     pk.TopicName,
+		Size:      len(pk.Payload),
+		Limit:     h.maxRetainedBytes,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	})
+	if cl.Properties.ProtocolVersion == 5 && pk.FixedHeader.Qos > 0 {
+		return pk, packets.ErrPacketTooLarge
+	}
+	return pk, packets.ErrRejectPacket
+}
+
+// publishRejection publishes notice to the rejection topic, if one is
+// configured.
+func (h *ConnectionHook) publishRejection(notice RetainedRejection) {
+	if h.rejectionTopic == "" {
+		return
+	}
+	payload, err := json.Marshal(notice)
+	if err != nil {
+		h.Log.Error("failed to encode retained rejection", "error", err)
+		return
+	}
+	if err := h.server.Publish(h.rejectionTopic, payload, false, 0); err != nil {
+		h.Log.Error("failed to publish retained rejection", "topic", h.rejectionTopic, "error", err)
+	}
+}
+
+// willPreviewBytes is how much of a will message's payload is logged.
+const willPreviewBytes = 128
+
+// OnWillSent logs and counts the will message published for a client which
+// disconnected without sending DISCONNECT, to help trace unexpected
+// disconnects.
+func (h *ConnectionHook) OnWillSent(cl *mqtt.Client, pk packets.Packet) {
+	willsSent.Inc()
+	h.Log.Warn("published will message", "client_id", cl.ID, "remote_addr", cl.Net.Remote,
+		"listener", cl.Net.Listener, "topic", pk.TopicName, "retain", pk.FixedHeader.Retain,
+		"qos", pk.FixedHeader.Qos, "payload_size", len(pk.Payload), "payload", payloadPreview(pk.Payload, willPreviewBytes))
+}
+
+// payloadPreview returns the start of payload as text, cut to at most max
+// bytes on a character boundary and marked with "..." if cut.
+func payloadPreview(payload []byte, max int) string {
+	if len(payload) <= max {
+		return string(payload)
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(payload[cut]) {
+		cut--
+	}
+	return string(payload[:cut]) + "..."
+}
+
+// ActiveConnections returns the number of clients currently connected.
+func (h *ConnectionHook) ActiveConnections() int64 {
+	return h.active.Load()
+}
+
+// Activity returns when the client connected and last sent a packet. It
+// returns false if the client isn't connected.
+func (h *ConnectionHook) Activity(cl *mqtt.Client) (connectedAt, lastPacket time.Time, ok bool) {
+	h.mu.RLock()
+	activity, ok := h.clients[cl.ID]
+	h.mu.RUnlock()
+	if !ok || activity.client != cl {
+		return time.Time{}, time.Time{}, false
+	}
+	return activity.connectedAt, time.Unix(0, activity.lastPacket.Load()), true
+}
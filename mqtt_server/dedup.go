@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// recentRequests remembers the request IDs of recently received move
+// commands and their feedback, so a command retransmitted by the agent is
+// answered from the cache instead of being simulated again.
+type recentRequests struct {
+	window time.Duration // How long a request ID is remembered after it was last seen
+
+	mu        sync.Mutex
+	entries   map[string]*recentRequest
+	lastSweep time.Time
+}
+
+// recentRequest is a remembered request. feedback is nil until the move completes.
+type recentRequest struct {
+	feedback *MoveCompletionFeedback
+	seenAt   time.Time
+}
+
+// newRecentRequests returns a cache remembering request IDs for window.
+func newRecentRequests(window time.Duration) *recentRequests {
+	return &recentRequests{
+		window:    window,
+		entries:   make(map[string]*recentRequest),
+		lastSweep: time.Now(),
+	}
+}
+
+// check records requestID as seen, returning true if it was already seen
+// within the window along with its feedback, which is nil if the original
+// move hasn't completed yet. Empty request IDs are never duplicates.
+func (r *recentRequests) check(requestID string) (*MoveCompletionFeedback, bool) {
+	if r == nil || requestID == "" {
+		return nil, false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastSweep) >= r.window {
+		for id, e := range r.entries {
+			if now.Sub(e.seenAt) >= r.window {
+				delete(r.entries, id)
+			}
+		}
+		r.lastSweep = now
+	}
+
+	if e, ok := r.entries[requestID]; ok && now.Sub(e.seenAt) < r.window {
+		return e.feedback, true
+	}
+	r.entries[requestID] = &recentRequest{seenAt: now}
+	return nil, false
+}
+
+// forget removes requestID, so a retry of a command which was turned away
+// isn't mistaken for a duplicate.
+func (r *recentRequests) forget(requestID string) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, requestID)
+}
+
+// complete caches the feedback for requestID, restarting its window.
+func (r *recentRequests) complete(requestID string, feedback MoveCompletionFeedback) {
+	if r == nil || requestID == "" {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[requestID] = &recentRequest{feedback: &feedback, seenAt: time.Now()}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// dryRunTally counts the outcomes of commands validated in dry-run mode.
+type dryRunTally struct {
+	mu     sync.Mutex
+	counts map[string]int // Commands keyed on the status they would have got
+}
+
+// add counts a command with the given outcome.
+func (t *dryRunTally) add(status string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.counts == nil {
+		t.counts = make(map[string]int)
+	}
+	t.counts[status]++
+}
+
+// logArgs returns the counts as alternating keys and values for logging,
+// sorted by status.
+func (t *dryRunTally) logArgs() []any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	total := 0
+	var args []any
+	for _, status := range slices.Sorted(maps.Keys(t.counts)) {
+		args = append(args, status, t.counts[status])
+		total += t.counts[status]
+	}
+	return append([]any{"total", total}, args...)
+}
+
+// handleDryRun validates a command as it would be processed and logs the
+// outcome, without publishing feedback or changing any state. Oversize
+// payloads have already been turned away by OnPublish.
+func (h *MoveCommandHook) handleDryRun(cl *mqtt.Client, pk packets.Packet, batch bool) {
+	pk, ok := h.decodePayload(cl, pk)
+	if !ok {
+		return
+	}
+
+	// A single command is checked against the schema before unmarshalling,
+	// and each command of a batch once the batch has been, as when serving.
+	if !batch && h.dryRunSchemaInvalid(cl, pk, pk.Payload) {
+		return
+	}
+
+	var cmds []MoveCommand
+	var raw []json.RawMessage
+	var err error
+	if batch {
+		if err = json.Unmarshal(pk.Payload, &cmds); err == nil {
+			_ = json.Unmarshal(pk.Payload, &raw)
+		}
+	} else {
+		cmds = make([]MoveCommand, 1)
+		err = json.Unmarshal(pk.Payload, &cmds[0])
+	}
+	if err != nil {
+		h.Log.Info("dry run: would reject malformed command", "topic", pk.TopicName, "client_id", cl.ID, "error", err)
+		h.dryRunResults.add("malformed")
+		return
+	}
+
+	for i, cmd := range cmds {
+		if batch && h.dryRunSchemaInvalid(cl, pk, raw[i]) {
+			continue
+		}
+		status, detail := h.dryRunMove(cmd)
+		h.Log.Info("dry run: validated move command", "topic", pk.TopicName, "client_id", cl.ID,
+			"object_name", cmd.ObjectName, "request_id", cmd.RequestID, "status", status, "detail", detail)
+		h.dryRunResults.add(status)
+	}
+}
+
+// dryRunSchemaInvalid logs and counts a command payload which doesn't match
+// the command schema, reporting whether it doesn't.
+func (h *MoveCommandHook) dryRunSchemaInvalid(cl *mqtt.Client, pk packets.Packet, payload []byte) bool {
+	errs := h.schemaErrors(payload)
+	if errs == nil {
+		return false
+	}
+	h.Log.Info("dry run: would reject command not matching the schema", "topic", pk.TopicName,
+		"client_id", cl.ID, "request_id", extractRequestID(payload), "errors", errs)
+	h.dryRunResults.add("schema_invalid")
+	return true
+}
+
+// dryRunMove returns the status a move command would get and a description of
+// what would happen to it. It mirrors checkMove without logging or metrics.
+func (h *MoveCommandHook) dryRunMove(cmd MoveCommand) (string, string) {
+	if cmd.ObjectName = strings.TrimSpace(cmd.ObjectName); cmd.ObjectName == "" {
+		return "invalid_object_name", "object_name must not be empty or whitespace"
+	}
+	if cmd.RequestID == "" {
+		return "invalid_request_id", "request_id must not be empty"
+	}
+	if _, reason := cmd.validate(); reason != "" {
+		return "rejected", reason
+	}
+	if !h.objectAllowed(cmd.ObjectName) {
+		return "unknown_object", fmt.Sprintf("object %q is not one of the allowed objects", cmd.ObjectName)
+	}
+	target := h.transform.toScene(roundPosition(cmd.TargetPosition, h.positionDecimals))
+	cmd.TargetPosition = target
+	if h.bounds != nil && !h.bounds.contains(target) {
+		if h.boundsMode == BoundsReject {
+			return "out_of_bounds", fmt.Sprintf("target_position %v is outside the scene bounds", target)
+		}
+		cmd.TargetPosition = h.bounds.clamp(target)
+	}
+	if _, reason := h.resolveDuration(&cmd); reason != "" {
+		return "rejected", reason
+	}
+	if position, ok := h.alreadyAt(cmd); ok {
+		return "no_op", fmt.Sprintf("object is already at %v", position)
+	}
+	if !slices.Equal(target, cmd.TargetPosition) {
+		return "clamped", fmt.Sprintf("would move to %v over %v, clamped from %v", cmd.TargetPosition, h.moveDuration(cmd), target)
+	}
+	return "valid", fmt.Sprintf("would move to %v over %v", cmd.TargetPosition, h.moveDuration(cmd))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// feedbackCache keeps the last few feedback messages published for each
+// request ID, so a client which reconnects can be sent the QoS 0 feedback
+// it missed while it was away.
+type feedbackCache struct {
+	size int           // Messages kept per request ID
+	ttl  time.Duration // How long a message is kept after it was published
+
+	mu        sync.Mutex
+	entries   map[string][]cachedFeedback // Feedback keyed on request ID, oldest first
+	away      map[string]time.Time        // Since when each disconnected client may have missed feedback, keyed on client ID
+	lastSweep time.Time
+}
+
+// cachedFeedback is a published feedback message, as it was sent.
+type cachedFeedback struct {
+	topic       string
+	payload     []byte
+	reply       replyContext
+	publishedAt time.Time
+}
+
+// newFeedbackCache returns a cache keeping size messages per request ID for
+// ttl, or nil if ttl is 0 and caching is disabled.
+func newFeedbackCache(size int, ttl time.Duration) *feedbackCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &feedbackCache{
+		size:      size,
+		ttl:       ttl,
+		entries:   make(map[string][]cachedFeedback),
+		away:      make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// add caches a feedback message published for requestID, dropping the oldest
+// message for it once there are more than the cache size. Messages without a
+// request ID aren't cached.
+func (c *feedbackCache) add(requestID, topic string, payload []byte, reply replyContext) {
+	if c == nil || requestID == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.sweep(now)
+	msgs := append(c.entries[requestID], cachedFeedback{topic: topic, payload: payload, reply: reply, publishedAt: now})
+	if len(msgs) > c.size {
+		msgs = slices.Delete(msgs, 0, len(msgs)-c.size)
+	}
+	c.entries[requestID] = msgs
+}
+
+// sweep drops expired messages and absences. c.mu must be held.
+func (c *feedbackCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < c.ttl {
+		return
+	}
+	for id, msgs := range c.entries {
+		msgs = slices.DeleteFunc(msgs, func(m cachedFeedback) bool { return now.Sub(m.publishedAt) >= c.ttl })
+		if len(msgs) == 0 {
+			delete(c.entries, id)
+		} else {
+			c.entries[id] = msgs
+		}
+	}
+	for id, since := range c.away {
+		if now.Sub(since) >= c.ttl {
+			delete(c.away, id)
+		}
+	}
+	c.lastSweep = now
+}
+
+// disconnected records that a client went away. Feedback published from
+// since onwards is replayed if it subscribes again within the TTL. Absences
+// are swept here too, as clients which never come back would otherwise be
+// kept for good when no feedback is published.
+func (c *feedbackCache) disconnected(clientID string, since time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sweep(time.Now())
+	c.away[clientID] = since
+}
+
+// missed returns the unexpired messages matching any of filters which were
+// published since clientID went away, oldest first. The absence is forgotten
+// once messages have been returned for it, so they are replayed only once.
+func (c *feedbackCache) missed(clientID string, filters []string) []cachedFeedback {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	since, ok := c.away[clientID]
+	if !ok {
+		return nil
+	}
+
+	// Matched as the broker does, shared subscriptions included.
+	index := mqtt.NewTopicsIndex()
+	for _, filter := range filters {
+		index.Subscribe(clientID, packets.Subscription{Filter: filter})
+	}
+
+	now := time.Now()
+	var missed []cachedFeedback
+	for _, msgs := range c.entries {
+		for _, m := range msgs {
+			if m.publishedAt.Before(since) || now.Sub(m.publishedAt) >= c.ttl {
+				continue
+			}
+			if subs := index.Subscribers(m.topic); len(subs.Subscriptions) > 0 || len(subs.Shared) > 0 {
+				missed = append(missed, m)
+			}
+		}
+	}
+	if len(missed) > 0 {
+		delete(c.away, clientID)
+	}
+	slices.SortFunc(missed, func(a, b cachedFeedback) int { return a.publishedAt.Compare(b.publishedAt) })
+	return missed
+}
+
+// OnDisconnect records when a client went away, so the feedback it missed
+// can be replayed when it subscribes again. Feedback published during the
+// last keepalive period may have been lost on a dead connection too, so
+// that is counted as missed.
+func (h *MoveCommandHook) OnDisconnect(cl *mqtt.Client, err error, expire bool) {
+	h.feedbackCache.disconnected(cl.ID, time.Now().Add(-time.Duration(cl.State.Keepalive)*time.Second))
+}
+
+// OnSubscribed replays the cached feedback a reconnecting client missed on
+// the topics it subscribed to. It is sent at QoS 0 to that client only, so
+// other subscribers don't see it twice. OnSubscribe can't be used, as it is
+// called before the subscriptions exist.
+func (h *MoveCommandHook) OnSubscribed(cl *mqtt.Client, pk packets.Packet, reasonCodes []byte) {
+	var filters []string
+	for i, sub := range pk.Filters {
+		if i < len(reasonCodes) && reasonCodes[i] < packets.ErrUnspecifiedError.Code {
+			filters = append(filters, sub.Filter)
+		}
+	}
+
+	missed := h.feedbackCache.missed(cl.ID, filters)
+	for _, m := range missed {
+		if err := cl.WritePacket(replyPacket(m.topic, m.payload, 0, false, m.reply)); err != nil {
+			h.Log.Warn("failed to replay cached feedback", "client_id", cl.ID, "topic", m.topic, "error", err)
+			return
+		}
+	}
+	if len(missed) > 0 {
+		feedbackReplayed.Add(float64(len(missed)))
+		h.Log.Info("replayed cached feedback", "client_id", cl.ID, "messages", len(missed))
+	}
+}
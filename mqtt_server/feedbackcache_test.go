@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFeedbackCacheForgetsAbsences(t *testing.T) {
+	c := newFeedbackCache(10, 10*time.Millisecond)
+	for i := range 100 {
+		c.disconnected(fmt.Sprintf("client-%d", i), time.Now())
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// No feedback is published, but the next disconnect sweeps the expired
+	// absences.
+	c.disconnected("last", time.Now())
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.away) != 1 {
+		t.Errorf("got %d absences, want only the unexpired one", len(c.away))
+	}
+}
+
+func TestFeedbackCacheMissedFilters(t *testing.T) {
+	c := newFeedbackCache(10, time.Minute)
+	clients := []string{"wildcard", "shared", "parent"}
+	for _, id := range clients {
+		c.disconnected(id, time.Now().Add(-time.Second))
+	}
+	c.add("req-1", "unity/feedback/move_complete", []byte("1"), replyContext{})
+	c.add("req-2", "$SYS/feedback", []byte("2"), replyContext{})
+	c.add("req-3", "other/topic", []byte("3"), replyContext{})
+
+	for _, tt := range []struct {
+		clientID string
+		filters  []string
+		want     []string
+	}{
+		// Top level wildcards don't match $ topics.
+		{"wildcard", []string{"#"}, []string{"other/topic", "unity/feedback/move_complete"}},
+		{"shared", []string{"$share/agents/unity/+/move_complete"}, []string{"unity/feedback/move_complete"}},
+		{"parent", []string{"unity/feedback"}, nil},
+	} {
+		var got []string
+		for _, m := range c.missed(tt.clientID, tt.filters) {
+			got = append(got, m.topic)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("got missed feedback on %v for %v, want %v", got, tt.filters, tt.want)
+		}
+	}
+}
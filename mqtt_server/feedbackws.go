@@ -0,0 +1,162 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Timeouts for WebSocket feedback clients.
+const (
+	feedbackWriteTimeout = 10 * time.Second
+	feedbackPingInterval = 30 * time.Second
+	feedbackPongTimeout  = feedbackPingInterval + 10*time.Second
+)
+
+// feedbackBuffer is how many messages may be queued for a WebSocket client
+// before it is considered too slow and disconnected.
+const feedbackBuffer = 64
+
+// FeedbackBroadcaster pushes move feedback to WebSocket clients, for browsers
+// watching moves without an MQTT library.
+type FeedbackBroadcaster struct {
+	mu      sync.Mutex
+	clients map[*feedbackClient]struct{}
+	closed  bool
+}
+
+// feedbackClient is a connected WebSocket client and its queue of messages.
+type feedbackClient struct {
+	conn *websocket.Conn
+	send chan []byte // Closed when the client is removed
+}
+
+// NewFeedbackBroadcaster returns a broadcaster with no clients.
+func NewFeedbackBroadcaster() *FeedbackBroadcaster {
+	return &FeedbackBroadcaster{clients: make(map[*feedbackClient]struct{})}
+}
+
+// Broadcast queues payload for every connected client. Clients whose queue is
+// full are disconnected rather than holding up feedback. It is a no-op on a
+// nil broadcaster.
+func (b *FeedbackBroadcaster) Broadcast(payload []byte) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for c := range b.clients {
+		select {
+		case c.send <- payload:
+		default:
+			slog.Warn("disconnecting slow feedback WebSocket client", "remote_addr", c.conn.RemoteAddr())
+			b.remove(c)
+		}
+	}
+}
+
+// add registers a client, returning false if the broadcaster is closed.
+func (b *FeedbackBroadcaster) add(c *feedbackClient) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false
+	}
+	b.clients[c] = struct{}{}
+	return true
+}
+
+// remove unregisters a client and closes its queue. b.mu must be held.
+func (b *FeedbackBroadcaster) remove(c *feedbackClient) {
+	if _, ok := b.clients[c]; ok {
+		delete(b.clients, c)
+		close(c.send)
+	}
+}
+
+// Close disconnects every client and refuses new ones.
+func (b *FeedbackBroadcaster) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for c := range b.clients {
+		b.remove(c)
+	}
+}
+
+// handleFeedbackWebSocket upgrades the request to a WebSocket and pushes move
+// feedback to it as JSON text messages until the client disconnects. Browsers
+// may connect from the given origins, as for CORS.
+func handleFeedbackWebSocket(b *FeedbackBroadcaster, origins []string) http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			return origin == "" || originAllowed(origins, origin)
+		},
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return // Upgrade has already replied with an error
+		}
+		defer conn.Close()
+
+		c := &feedbackClient{conn: conn, send: make(chan []byte, feedbackBuffer)}
+		if !b.add(c) {
+			return
+		}
+		slog.Info("feedback WebSocket client connected", "remote_addr", conn.RemoteAddr())
+
+		go c.write()
+		c.read()
+
+		b.mu.Lock()
+		b.remove(c)
+		b.mu.Unlock()
+		slog.Info("feedback WebSocket client disconnected", "remote_addr", conn.RemoteAddr())
+	}
+}
+
+// read discards messages from the client until it disconnects or stops
+// answering pings.
+func (c *feedbackClient) read() {
+	_ = c.conn.SetReadDeadline(time.Now().Add(feedbackPongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(feedbackPongTimeout))
+	})
+	for {
+		if _, _, err := c.conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+// write sends queued messages and periodic pings to the client until its
+// queue is closed, then closes the connection.
+func (c *feedbackClient) write() {
+	ticker := time.NewTicker(feedbackPingInterval)
+	defer ticker.Stop()
+	defer c.conn.Close()
+
+	for {
+		select {
+		case payload, ok := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(feedbackWriteTimeout))
+			if !ok {
+				_ = c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-ticker.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(feedbackWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
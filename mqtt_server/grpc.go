@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+
+	bridgepb "mqtt_server/proto"
+)
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative proto/bridge.proto
+
+// grpcMaxMessageBytes is the largest request message accepted, matching the
+// HTTP API's limit on request bodies.
+const grpcMaxMessageBytes = maxPublishBodyBytes
+
+// grpcFeedbackCheck is how often a Move call checks that feedback is still
+// to come, while waiting for it.
+const grpcFeedbackCheck = 5 * time.Second
+
+// bridgeService implements the Bridge service defined in proto/bridge.proto.
+type bridgeService struct {
+	bridgepb.UnimplementedBridgeServer
+	server *mqtt.Server
+	hook   *MoveCommandHook
+}
+
+// newGRPCServer returns a gRPC server for the Bridge service, moving objects
+// through hook. It is served over TLS with tlsConfig, or in plaintext if
+// tlsConfig is nil.
+func newGRPCServer(server *mqtt.Server, hook *MoveCommandHook, tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{grpc.MaxRecvMsgSize(grpcMaxMessageBytes)}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	s := grpc.NewServer(opts...)
+	bridgepb.RegisterBridgeServer(s, &bridgeService{server: server, hook: hook})
+	return s
+}
+
+// Move publishes the requested move command and streams its feedback back
+// until the move finishes.
+func (b *bridgeService) Move(req *bridgepb.MoveRequest, stream grpc.ServerStreamingServer[bridgepb.MoveFeedback]) error {
+	hook := b.hook
+	cmd := moveCommandFromProto(req)
+	if cmd.ObjectName == "" {
+		return status.Error(codes.InvalidArgument, "object_name is required")
+	}
+	if _, reason := cmd.validate(); reason != "" {
+		return status.Error(codes.InvalidArgument, reason)
+	}
+	if cmd.RequestID == "" {
+		var err error
+		if cmd.RequestID, err = newRequestID(); err != nil {
+			return status.Errorf(codes.Internal, "generating request ID: %v", err)
+		}
+	}
+	if hook.dryRun {
+		// Moves are only validated and logged, so no feedback would come.
+		return status.Error(codes.FailedPrecondition, "the bridge is in dry-run mode and doesn't simulate moves")
+	}
+
+	// Watch before publishing, so feedback sent straight away isn't missed.
+	feedback, unwatch := hook.watch(cmd.RequestID)
+	defer unwatch()
+
+	payload, err := json.Marshal(cmd)
+	if err != nil {
+		return status.Errorf(codes.Internal, "encoding move command: %v", err)
+	}
+	topic := hook.topic(&hook.commandTopic)
+	if err := b.server.Publish(topic, payload, false, 0); err != nil {
+		slog.Error("failed to publish gRPC move command", "topic", topic, "request_id", cmd.RequestID, "error", err)
+		return status.Error(codes.Unavailable, "failed to publish move command")
+	}
+	slog.Info("published gRPC move command", "topic", topic, "object_name", cmd.ObjectName, "request_id", cmd.RequestID)
+
+	// Some commands are never answered, such as a retransmit of a move
+	// which has already been forgotten. Give up once no move with the
+	// request ID has been queued or running for a whole check interval, as
+	// its feedback would have arrived by then.
+	check := time.NewTicker(grpcFeedbackCheck + hook.flushInterval)
+	defer check.Stop()
+	idle := false
+
+	for {
+		select {
+		case f := <-feedback:
+			if err := stream.Send(moveFeedbackToProto(f)); err != nil {
+				return err
+			}
+			if f.Status != "in_progress" {
+				return nil
+			}
+		case <-stream.Context().Done():
+			return status.FromContextError(stream.Context().Err()).Err()
+		case <-check.C:
+			if hook.isActive(cmd.RequestID) {
+				idle = false
+				continue
+			}
+			if idle {
+				slog.Warn("gave up waiting for gRPC move feedback", "object_name", cmd.ObjectName, "request_id", cmd.RequestID)
+				return status.Error(codes.DeadlineExceeded, "the move command was not answered")
+			}
+			idle = true
+		}
+	}
+}
+
+// isActive reports whether a move with requestID is queued or running.
+func (h *MoveCommandHook) isActive(requestID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, ok := h.active[requestID]
+	return ok
+}
+
+// moveCommandFromProto returns the move command req asks for.
+func moveCommandFromProto(req *bridgepb.MoveRequest) MoveCommand {
+	cmd := MoveCommand{
+		ObjectName:     req.GetObjectName(),
+		TargetPosition: req.GetTargetPosition(),
+		RequestID:      req.GetRequestId(),
+		Priority:       int(req.GetPriority()),
+	}
+	if req.Duration != nil {
+		duration := req.GetDuration()
+		cmd.Duration = &duration
+	}
+	if req.Speed != nil {
+		speed := req.GetSpeed()
+		cmd.Speed = &speed
+	}
+	return cmd
+}
+
+// moveFeedbackToProto returns f as a MoveFeedback message.
+func moveFeedbackToProto(f MoveCompletionFeedback) *bridgepb.MoveFeedback {
+	return &bridgepb.MoveFeedback{
+		ObjectName:    f.ObjectName,
+		FinalPosition: f.FinalPosition,
+		Status:        f.Status,
+		Timestamp:     f.Timestamp,
+		RequestId:     f.RequestID,
+		Reason:        f.Reason,
+		Field:         f.Field,
+		Progress:      f.Progress,
+		Clamped:       f.Clamped,
+		Duration:      f.Duration,
+		Errors:        f.Errors,
+	}
+}
+
+// feedbackWatchers delivers the feedback of individual requests to callers
+// waiting on it, such as gRPC streams.
+type feedbackWatchers struct {
+	mu       sync.Mutex
+	watchers map[string][]chan MoveCompletionFeedback // Keyed on request ID
+}
+
+// watch returns a channel receiving the feedback published for requestID,
+// and a function to stop watching which must be called.
+func (h *MoveCommandHook) watch(requestID string) (<-chan MoveCompletionFeedback, func()) {
+	// Buffered for every progress update and the final feedback, so
+	// notifying a slow stream never blocks publishing.
+	ch := make(chan MoveCompletionFeedback, h.progressSteps+1)
+	w := &h.watchers
+	w.mu.Lock()
+	if w.watchers == nil {
+		w.watchers = make(map[string][]chan MoveCompletionFeedback)
+	}
+	w.watchers[requestID] = append(w.watchers[requestID], ch)
+	w.mu.Unlock()
+
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		chans := w.watchers[requestID]
+		for i, c := range chans {
+			if c == ch {
+				chans = append(chans[:i], chans[i+1:]...)
+				break
+			}
+		}
+		if len(chans) == 0 {
+			delete(w.watchers, requestID)
+		} else {
+			w.watchers[requestID] = chans
+		}
+	}
+}
+
+// notifyWatchers passes feedback to anyone watching its request. Watchers
+// whose buffer is full miss it rather than holding up publishing.
+func (h *MoveCommandHook) notifyWatchers(feedback MoveCompletionFeedback) {
+	if feedback.RequestID == "" {
+		return
+	}
+	w := &h.watchers
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, ch := range w.watchers[feedback.RequestID] {
+		select {
+		case ch <- feedback:
+		default:
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+
+	bridgepb "mqtt_server/proto"
+)
+
+// dialGRPC serves the Bridge API for hook in plaintext over an in-memory
+// listener and returns a client connected to it.
+func dialGRPC(t *testing.T, hook *MoveCommandHook) bridgepb.BridgeClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	s := newGRPCServer(hook.server, hook, nil)
+	go func() { _ = s.Serve(lis) }()
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return bridgepb.NewBridgeClient(conn)
+}
+
+// callGRPCMove calls the Move method with req and returns the feedback
+// streamed back, and the error ending the stream, if any.
+func callGRPCMove(t *testing.T, client bridgepb.BridgeClient, req *bridgepb.MoveRequest) ([]*bridgepb.MoveFeedback, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Move(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var feedback []*bridgepb.MoveFeedback
+	for {
+		f, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return feedback, nil
+		}
+		if err != nil {
+			return feedback, err
+		}
+		feedback = append(feedback, f)
+	}
+}
+
+func TestMoveCommandFromProto(t *testing.T) {
+	cmd := moveCommandFromProto(&bridgepb.MoveRequest{
+		ObjectName:     "Cube",
+		TargetPosition: []float64{1, -2.5, 3},
+		Duration:       proto.Float64(0.5),
+		RequestId:      "grpc-1",
+		Priority:       -3,
+	})
+	if cmd.ObjectName != "Cube" || cmd.RequestID != "grpc-1" || cmd.Priority != -3 {
+		t.Errorf("got %+v, want Cube with request ID grpc-1 and priority -3", cmd)
+	}
+	if want := []float64{1, -2.5, 3}; !slices.Equal(cmd.TargetPosition, want) {
+		t.Errorf("got target position %v, want %v", cmd.TargetPosition, want)
+	}
+	if cmd.Duration == nil || *cmd.Duration != 0.5 || cmd.Speed != nil {
+		t.Errorf("got duration %v and speed %v, want a duration of 0.5 and no speed", cmd.Duration, cmd.Speed)
+	}
+}
+
+func TestGRPCMove(t *testing.T) {
+	t.Parallel()
+	_, hook, _ := newMoveTestServer(t, nil)
+	client := dialGRPC(t, hook)
+
+	feedback, err := callGRPCMove(t, client, &bridgepb.MoveRequest{
+		ObjectName:     "Cube",
+		TargetPosition: []float64{1, 2, 3},
+		RequestId:      "grpc-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feedback) == 0 {
+		t.Fatal("got no feedback")
+	}
+	last := feedback[len(feedback)-1]
+	if last.GetStatus() != "success" || last.GetRequestId() != "grpc-1" {
+		t.Errorf("got final feedback %v, want success for grpc-1", last)
+	}
+	if want := []float64{1, 2, 3}; !slices.Equal(last.GetFinalPosition(), want) {
+		t.Errorf("got final position %v, want %v", last.GetFinalPosition(), want)
+	}
+}
+
+func TestGRPCMoveInvalid(t *testing.T) {
+	t.Parallel()
+	_, hook, _ := newMoveTestServer(t, nil)
+	client := dialGRPC(t, hook)
+
+	_, err := callGRPCMove(t, client, &bridgepb.MoveRequest{TargetPosition: []float64{1, 2, 3}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v for a request without object_name, want InvalidArgument", err)
+	}
+	_, err = callGRPCMove(t, client, &bridgepb.MoveRequest{ObjectName: "Cube", TargetPosition: []float64{1, 2}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("got %v for a target position of 2 elements, want InvalidArgument", err)
+	}
+}
+
+func TestGRPCMoveDryRun(t *testing.T) {
+	t.Parallel()
+	_, hook, _ := newMoveTestServer(t, func(h *MoveCommandHook) {
+		h.dryRun = true
+	})
+	client := dialGRPC(t, hook)
+
+	_, err := callGRPCMove(t, client, &bridgepb.MoveRequest{
+		ObjectName:     "Cube",
+		TargetPosition: []float64{1, 2, 3},
+		RequestId:      "grpc-1",
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("got %v, want FailedPrecondition", err)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandHandlerConfig configures an extra move command handler, for a fleet
+// of objects with its own command topic, scene bounds and allowed objects.
+// Each handler runs as its own MoveCommandHook, with its own worker pool,
+// object positions and in-flight moves. Settings not given here are shared
+// with the main handler.
+type CommandHandlerConfig struct {
+	Name          string `yaml:"name" json:"name"`                     // identifies the handler in logs
+	CommandTopic  string `yaml:"command_topic" json:"command_topic"`   // topic the fleet's move commands are received on
+	FeedbackTopic string `yaml:"feedback_topic" json:"feedback_topic"` // topic the fleet's move feedback is published to, may contain {object_name} and {request_id}
+	CancelTopic   string `yaml:"cancel_topic" json:"cancel_topic"`     // topic requests to cancel the fleet's moves are received on, empty for none
+
+	Bounds     *Bounds `yaml:"bounds" json:"bounds"`           // bounding box the fleet's move targets must lie within, unset for no limit
+	BoundsMode string  `yaml:"bounds_mode" json:"bounds_mode"` // clamp or reject targets outside the bounds, the main bounds_mode if empty
+
+	AllowedObjects []string `yaml:"allowed_objects" json:"allowed_objects"` // object names the fleet's commands may target, empty to allow any
+}
+
+// validate returns an error if the handler's name, topics, bounds or allowed
+// objects are invalid.
+func (c CommandHandlerConfig) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("command_handlers entries must have a name")
+	}
+	if c.CommandTopic == "" || strings.ContainsAny(c.CommandTopic, "#+") {
+		return fmt.Errorf("command handler %s command_topic must be a topic without wildcards, got %q", c.Name, c.CommandTopic)
+	}
+	if c.FeedbackTopic == "" {
+		return fmt.Errorf("command handler %s must have a feedback_topic", c.Name)
+	}
+	if err := validateFeedbackTopic(c.FeedbackTopic); err != nil {
+		return fmt.Errorf("command handler %s: %w", c.Name, err)
+	}
+	if strings.ContainsAny(c.CancelTopic, "#+") {
+		return fmt.Errorf("command handler %s cancel_topic must not contain wildcards, got %q", c.Name, c.CancelTopic)
+	}
+	if c.BoundsMode != "" && c.BoundsMode != BoundsClamp && c.BoundsMode != BoundsReject {
+		return fmt.Errorf("command handler %s bounds_mode must be %q or %q, got %q", c.Name, BoundsClamp, BoundsReject, c.BoundsMode)
+	}
+	if c.Bounds != nil {
+		if err := c.Bounds.validate(); err != nil {
+			return fmt.Errorf("command handler %s: %w", c.Name, err)
+		}
+	}
+	for _, name := range c.AllowedObjects {
+		if name == "" {
+			return fmt.Errorf("command handler %s allowed_objects must not contain empty names", c.Name)
+		}
+	}
+	return nil
+}
+
+// config returns base with the handler's settings in place of the main
+// handler's. Batch commands are only served by the main handler.
+func (c CommandHandlerConfig) config(base *Config) *Config {
+	cfg := *base
+	cfg.CommandTopic = c.CommandTopic
+	cfg.FeedbackTopic = c.FeedbackTopic
+	cfg.CancelTopic = c.CancelTopic
+	cfg.BatchCommandTopic = ""
+	cfg.BatchFeedbackTopic = ""
+	cfg.Bounds = c.Bounds
+	if c.BoundsMode != "" {
+		cfg.BoundsMode = c.BoundsMode
+	}
+	cfg.AllowedObjects = c.AllowedObjects
+	return &cfg
+}
+
+// validateCommandHandlers returns an error if any command handler is invalid,
+// or if handlers share a name or a command or cancel topic with each other or
+// with the main handler.
+func (c *Config) validateCommandHandlers() error {
+	names := make(map[string]bool)
+	topics := map[string]string{c.CommandTopic: "command_topic", c.BatchCommandTopic: "batch_command_topic", c.CancelTopic: "cancel_topic"}
+	for _, h := range c.CommandHandlers {
+		if err := h.validate(); err != nil {
+			return err
+		}
+		if names[h.Name] {
+			return fmt.Errorf("command_handlers has more than one handler named %s", h.Name)
+		}
+		names[h.Name] = true
+		for _, topic := range []string{h.CommandTopic, h.CancelTopic} {
+			if topic == "" {
+				continue
+			}
+			if used, ok := topics[topic]; ok {
+				return fmt.Errorf("command handler %s topic %q is already used as %s", h.Name, topic, used)
+			}
+			topics[topic] = "a topic of command handler " + h.Name
+		}
+	}
+	return nil
+}
+
+// drainHooks drains every hook at once, for up to grace, and returns the
+// total number of moves pending and still remaining, as Drain does.
+func drainHooks(hooks []*MoveCommandHook, grace time.Duration) (pending, remaining int) {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, h := range hooks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p, r := h.Drain(grace)
+			mu.Lock()
+			pending, remaining = pending+p, remaining+r
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return pending, remaining
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// HistoryRecord is one line of the move history log: a move command and the
+// feedback it produced.
+type HistoryRecord struct {
+	ReceivedAt  time.Time              `json:"received_at"`
+	CompletedAt time.Time              `json:"completed_at"`
+	Command     MoveCommand            `json:"command"`
+	Feedback    MoveCompletionFeedback `json:"feedback"`
+}
+
+// MoveHistory appends move history records to a JSONL file. When the file
+// grows past maxBytes it is rotated to path.1, replacing any previous
+// rotation, and a new file is started.
+type MoveHistory struct {
+	path     string // Path of the current history file
+	maxBytes int64  // Size the file is rotated at, 0 for no limit
+
+	mu   sync.Mutex
+	file *os.File
+	size int64 // Current size of file
+}
+
+// NewMoveHistory opens the history file at path for appending, creating it if
+// it doesn't exist.
+func NewMoveHistory(path string, maxBytes int64) (*MoveHistory, error) {
+	h := &MoveHistory{path: path, maxBytes: maxBytes}
+	if err := h.open(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// open opens the history file and records its current size.
+func (h *MoveHistory) open() error {
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening move history: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("opening move history: %w", err)
+	}
+	h.file = f
+	h.size = info.Size()
+	return nil
+}
+
+// rotate moves the current history file to path.1 and starts a new one.
+func (h *MoveHistory) rotate() error {
+	if err := h.file.Close(); err != nil {
+		return fmt.Errorf("rotating move history: %w", err)
+	}
+	if err := os.Rename(h.path, h.path+".1"); err != nil {
+		// Keep appending to the oversized file rather than losing records.
+		if openErr := h.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("rotating move history: %w", err)
+	}
+	return h.open()
+}
+
+// Record appends rec to the history file. It is a no-op on a nil history, so
+// callers needn't check whether history is enabled.
+func (h *MoveHistory) Record(rec HistoryRecord) error {
+	if h == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("marshalling move history: %w", err)
+	}
+	line = append(line, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.maxBytes > 0 && h.size > 0 && h.size+int64(len(line)) > h.maxBytes {
+		if err := h.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := h.file.Write(line)
+	h.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("writing move history: %w", err)
+	}
+	return nil
+}
+
+// HistoryFilter selects history records. Empty fields match any record.
+type HistoryFilter struct {
+	ObjectName string
+	Status     string
+}
+
+// matches returns true if rec is selected by the filter.
+func (f HistoryFilter) matches(rec HistoryRecord) bool {
+	return (f.ObjectName == "" || rec.Command.ObjectName == f.ObjectName) &&
+		(f.Status == "" || rec.Feedback.Status == f.Status)
+}
+
+// Query returns up to limit records matching filter, newest first, skipping
+// the first offset matches. It also returns the total number of matching
+// records, for pagination. Records in the rotated file are included.
+//
+// The files are opened and the current one's size noted under the lock, and
+// read without it, so a slow query doesn't hold up Record. Records written
+// after the files are opened aren't seen.
+func (h *MoveHistory) Query(filter HistoryFilter, offset, limit int) ([]HistoryRecord, int, error) {
+	h.mu.Lock()
+	rotated, err := openHistory(h.path + ".1")
+	if err != nil {
+		h.mu.Unlock()
+		return nil, 0, err
+	}
+	current, err := openHistory(h.path)
+	size := h.size
+	h.mu.Unlock()
+	if rotated != nil {
+		defer rotated.Close()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if current != nil {
+		defer current.Close()
+	}
+
+	var matched []HistoryRecord
+	if rotated != nil {
+		if matched, err = readHistory(rotated, filter, matched); err != nil {
+			return nil, 0, err
+		}
+	}
+	if current != nil {
+		// Only up to the size when opened, so a record being written isn't
+		// read in part.
+		if matched, err = readHistory(io.LimitReader(current, size), filter, matched); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	total := len(matched)
+	if offset >= total {
+		return []HistoryRecord{}, total, nil
+	}
+	end := min(offset+limit, total)
+
+	page := make([]HistoryRecord, 0, end-offset)
+	for i := total - 1 - offset; i >= total-end; i-- {
+		page = append(page, matched[i])
+	}
+	return page, total, nil
+}
+
+// openHistory opens the history file at path for reading, returning nil if
+// it doesn't exist.
+func openHistory(path string) (*os.File, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading move history: %w", err)
+	}
+	return f, nil
+}
+
+// readHistory appends the records read from r matching filter to records.
+// Lines which aren't valid records are skipped.
+func readHistory(r io.Reader, filter HistoryFilter, records []HistoryRecord) ([]HistoryRecord, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var rec HistoryRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		if filter.matches(rec) {
+			records = append(records, rec)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading move history: %w", err)
+	}
+	return records, nil
+}
+
+// Close closes the history file.
+func (h *MoveHistory) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.file.Close()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMoveHistoryQuery(t *testing.T) {
+	t.Parallel()
+	history, err := NewMoveHistory(filepath.Join(t.TempDir(), "history.jsonl"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+
+	for i := range 5 {
+		status := "success"
+		if i%2 == 1 {
+			status = "failed"
+		}
+		rec := HistoryRecord{
+			Command:  MoveCommand{ObjectName: "Cube", RequestID: "req-" + strconv.Itoa(i)},
+			Feedback: MoveCompletionFeedback{Status: status},
+		}
+		if err := history.Record(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, total, err := history.Query(HistoryFilter{Status: "success"}, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 || len(page) != 1 || page[0].Command.RequestID != "req-2" {
+		t.Errorf("got %d matches and page %+v, want 3 matches and req-2, the second newest success", total, page)
+	}
+}
+
+func TestMoveHistoryQueryWhileRecording(t *testing.T) {
+	t.Parallel()
+	// Small enough to rotate every few records.
+	history, err := NewMoveHistory(filepath.Join(t.TempDir(), "history.jsonl"), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 200 {
+			rec := HistoryRecord{Command: MoveCommand{ObjectName: "Cube", RequestID: "req-" + strconv.Itoa(i)}}
+			if err := history.Record(rec); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for range 50 {
+		page, _, err := history.Query(HistoryFilter{}, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rec := range page {
+			if rec.Command.ObjectName != "Cube" {
+				t.Fatalf("got record %+v, want only whole records", rec)
+			}
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,1761 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// MoveCommand matches the JSON structure sent from the LLM agent
+type MoveCommand struct {
+	ObjectName     string    `json:"object_name"`
+	TargetPosition []float64 `json:"target_position"`
+	Duration       *float64  `json:"duration,omitempty"` // Seconds the move takes, the configured default if unset
+	Speed          *float64  `json:"speed,omitempty"`    // Units per second to move at instead of giving a duration
+	RequestID      string    `json:"request_id"`
+	BatchID        string    `json:"batch_id,omitempty"`
+	FeedbackQos    *byte     `json:"feedback_qos,omitempty"`    // QoS to deliver this command's feedback with, 0-2, the configured QoS if unset
+	FeedbackRetain bool      `json:"feedback_retain,omitempty"` // Publish the completion feedback as a retained message
+	Priority       int       `json:"priority,omitempty"`        // Moves waiting for a worker with a higher priority start first, 0 if unset
+
+	clamped         bool         // Set when TargetPosition was clamped to the scene bounds
+	durationClamped bool         // Set when a negative Duration was clamped to zero
+	fromSpeed       bool         // Set when Duration was computed from Speed
+	enqueuedAt      time.Time    // When the move was queued to be simulated
+	reply           replyContext // How the command's feedback is published
+	span            *traceSpan   // Traces the command until its feedback is published, nil if not traced
+}
+
+// replyContext is how a command was published that its feedback mirrors.
+type replyContext struct {
+	userProperties []packets.UserProperty // MQTT v5 user properties to echo on the feedback
+	cbor           bool                   // The command was CBOR, so its feedback is too
+
+	responseTopic   string // MQTT v5 response topic the feedback is published to instead of the configured one, empty for none
+	correlationData []byte // MQTT v5 correlation data to echo on the feedback
+}
+
+// topic returns the command's response topic if it gave one, or else
+// configured.
+func (r replyContext) topic(configured string) string {
+	if r.responseTopic != "" {
+		return r.responseTopic
+	}
+	return configured
+}
+
+// MoveCompletionFeedback matches the JSON structure for feedback to the LLM agent
+type MoveCompletionFeedback struct {
+	ObjectName    string    `json:"object_name"`
+	FinalPosition []float64 `json:"final_position"`
+	Status        string    `json:"status"`
+	Timestamp     string    `json:"timestamp"`
+	RequestID     string    `json:"request_id"`
+	Duration      *float64  `json:"duration,omitempty"` // Seconds the move took, when computed from the command's speed
+	Reason        string    `json:"reason,omitempty"`
+	Field         string    `json:"field,omitempty"`    // Command field Reason is about, for the agent to correct
+	Progress      float64   `json:"progress,omitempty"` // Fraction of the move completed, for in_progress feedback
+	Clamped       bool      `json:"clamped,omitempty"`  // FinalPosition was clamped to the scene bounds
+	Bounds        *Bounds   `json:"bounds,omitempty"`   // Scene bounds, set when the target fell outside them
+	Errors        []string  `json:"errors,omitempty"`   // Ways the command didn't match the command schema, for schema_invalid feedback
+
+	EnqueuedAt string `json:"enqueued_at,omitempty"` // When the command was queued, for stale feedback
+}
+
+// BatchCompletionFeedback is published once every move in a batch has
+// completed or been rejected. Status is success if every move succeeded,
+// failed if none did, and partial otherwise.
+type BatchCompletionFeedback struct {
+	BatchID   string                   `json:"batch_id"`
+	Status    string                   `json:"status"`
+	Results   []MoveCompletionFeedback `json:"results"`
+	Timestamp string                   `json:"timestamp"`
+}
+
+// CancelCommand asks for an in-flight move to be aborted.
+type CancelCommand struct {
+	RequestID string `json:"request_id"`
+}
+
+// DeadLetter is published to the errors topic for malformed commands which
+// can't be attributed to a request ID.
+type DeadLetter struct {
+	Topic     string `json:"topic"`
+	ClientID  string `json:"client_id"`
+	Error     string `json:"error"`
+	Payload   string `json:"payload"`
+	Timestamp string `json:"timestamp"`
+}
+
+// requestIDPattern matches a request_id string field in a payload which isn't valid JSON.
+var requestIDPattern = regexp.MustCompile(`"request_id"\s*:\s*"((?:[^"\\]|\\.)*)"`)
+
+// extractRequestID attempts to recover the request_id from a payload which
+// failed to unmarshal as a MoveCommand, so the agent can still be told about
+// the error. It returns an empty string if no request ID can be found.
+func extractRequestID(payload []byte) string {
+	var partial struct {
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(payload, &partial); err == nil && partial.RequestID != "" {
+		return partial.RequestID
+	}
+
+	if m := requestIDPattern.FindSubmatch(payload); m != nil {
+		var id string
+		if err := json.Unmarshal([]byte(`"`+string(m[1])+`"`), &id); err == nil {
+			return id
+		}
+	}
+	return ""
+}
+
+// validate returns the reason a move command can't be processed and the field
+// at fault, or empty strings if it is valid.
+func (cmd MoveCommand) validate() (field, reason string) {
+	if len(cmd.TargetPosition) != 3 {
+		return "target_position", fmt.Sprintf("target_position must have exactly 3 elements (x, y, z), got %d", len(cmd.TargetPosition))
+	}
+	for i, v := range cmd.TargetPosition {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "target_position", fmt.Sprintf("target_position[%d] is not a finite number", i)
+		}
+	}
+	if cmd.Duration != nil && (math.IsNaN(*cmd.Duration) || math.IsInf(*cmd.Duration, 0)) {
+		return "duration", "duration is not a finite number"
+	}
+	if cmd.Speed != nil && !(*cmd.Speed > 0 && !math.IsInf(*cmd.Speed, 0)) {
+		return "speed", "speed must be a positive finite number"
+	}
+	if cmd.FeedbackQos != nil && *cmd.FeedbackQos > 2 {
+		return "feedback_qos", fmt.Sprintf("feedback_qos must be 0, 1 or 2, got %d", *cmd.FeedbackQos)
+	}
+	return "", ""
+}
+
+// MoveCommandHook is a custom hook to process move commands and send feedback.
+type MoveCommandHook struct {
+	mqtt.HookBase
+	server             *mqtt.Server  // Reference to the MQTT server to publish messages
+	inline             *mqtt.Client  // The server's inline client, which feedback is published from
+	commandTopic       string        // Topic move commands are received on
+	feedbackTopic      string        // Topic move feedback is published to, possibly with placeholders
+	errorTopic         string        // Dead-letter topic for unattributable malformed commands
+	batchCommandTopic  string        // Topic batches of move commands are received on
+	batchFeedbackTopic string        // Topic batch results are published to
+	aggregateTopic     string        // Topic aggregated move feedback is published to
+	cancelTopic        string        // Topic requests to cancel in-flight moves are received on
+	namespace          string        // Prefix of all the topics above, for isolating scenes sharing a broker, empty for none
+	echoProperties     []string      // Keys of command user properties copied onto the feedback
+	commandEncoding    string        // EncodingJSON or EncodingCBOR, for commands without a content type
+	topicsMu           sync.RWMutex  // Guards the topics, which SetTopics may change while serving
+	feedbackQos        byte          // QoS feedback is delivered to subscribers with
+	maxDuration        time.Duration // Longest duration a move may ask for, 0 for no limit
+	maxQueueWait       time.Duration // Longest a move may wait to start before it is rejected as stale, 0 for no limit
+	defaultDuration    time.Duration // Duration of moves which don't give one
+	bounds             *Bounds       // Scene bounds move targets must lie within, nil for no limit
+	boundsMode         string        // BoundsClamp or BoundsReject
+	positionDecimals   int           // Decimal places move targets are rounded to, -1 for no rounding
+	history            *MoveHistory  // Log of completed moves, nil if disabled
+	dedupWindow        time.Duration // How long request IDs are remembered to detect retransmits, 0 to disable
+	progressSteps      int           // Number of in_progress updates published during each move
+	maxPayload         int           // Largest command payload processed, in bytes, 0 for no limit
+	failureRate        float64       // Fraction of moves which randomly report failed, for testing agents
+	noOpEpsilon        float64       // Distance from an object's position within which a move does nothing, 0 to disable
+	feedbackDelay      time.Duration // Extra time a finished move's feedback is held back, to emulate latency
+	logSample          *logSampler   // Thins out routine per-message logs, nil to log them all
+	flushInterval      time.Duration // How long move feedback is buffered to publish as one array, 0 to publish each message
+	limiter            *rateLimiter  // Limits how fast each client may send move commands, nil for no limit
+	globalLimiter      *rateLimiter  // Limits move commands across all clients, shared by every hook, nil for no limit
+	pool               *workerPool   // Runs simulated moves, nil for a goroutine per move
+	slowThreshold      time.Duration // Handling time above which commands are logged as slow, 0 to disable
+	timestampFormat    string        // Format of feedback timestamps, one of the Timestamp constants
+	dryRun             bool          // Only validate and log commands, without publishing feedback
+	ready              serveGate     // Closed once the server is serving, nil if it already is
+
+	done     chan struct{}  // Closed when the hook is stopped, interrupting pending moves
+	wg       sync.WaitGroup // Tracks pending move completions
+	draining atomic.Bool    // Set by Drain to refuse new moves while pending ones finish
+
+	mu        sync.Mutex
+	active    map[string]ActiveMove     // In-flight moves keyed on request ID
+	positions map[string]objectPosition // Last known position of each object, keyed on object name
+
+	recent *recentRequests // Recently seen request IDs and their feedback, nil if disabled
+	queue  objectQueue     // Orders the moves of each object
+
+	dryRunResults dryRunTally // Outcomes of commands validated in dry-run mode
+
+	objectsMu      sync.RWMutex    // Guards allowedObjects, which SetAllowedObjects may change while serving
+	allowedObjects map[string]bool // Object names move commands may target, nil for any
+
+	schema atomic.Pointer[jsonSchema] // Schema command payloads must match, nil for none
+
+	transform *CoordinateTransform // Converts agent positions to scene positions and back, nil for none
+	tracer    *tracer              // Exports a span for each move command, nil if tracing is disabled
+
+	name     string           // Name of an extra command handler, empty for the main one
+	handlers []CommandHandler // Command types handled, the hook's own first, see Register
+
+	broadcaster *FeedbackBroadcaster // Pushes move feedback to WebSocket clients, nil if disabled
+	aggregator  *feedbackAggregator  // Buffers move feedback when flushInterval is set, nil otherwise
+	watchers    feedbackWatchers     // Callers waiting on the feedback of particular requests, such as gRPC streams
+
+	feedbackCache *feedbackCache // Recent feedback replayed to reconnecting clients, nil if disabled
+}
+
+// objectPosition is where an object was left by its last successful move.
+type objectPosition struct {
+	position  []float64
+	updatedAt time.Time
+}
+
+// ObjectPosition is an object's last known position, for the
+// /objects/{name}/position endpoint.
+type ObjectPosition struct {
+	ObjectName string    `json:"object_name"`
+	Position   []float64 `json:"position"`
+	Timestamp  string    `json:"timestamp"` // When the object reached the position
+}
+
+// Position returns the last known position of the named object in agent
+// coordinates, or false if it hasn't completed a move yet.
+func (h *MoveCommandHook) Position(name string) (ObjectPosition, bool) {
+	last, ok := h.lastPosition(name)
+	if !ok {
+		return ObjectPosition{}, false
+	}
+	return ObjectPosition{
+		ObjectName: name,
+		Position:   h.transform.toAgent(last.position),
+		Timestamp:  formatTimestamp(h.timestampFormat, last.updatedAt),
+	}, true
+}
+
+// ActiveMove is a move command which is awaiting its completion feedback.
+type ActiveMove struct {
+	MoveCommand
+	ReceivedAt     time.Time `json:"received_at"`
+	ElapsedSeconds float64   `json:"elapsed_seconds"`
+
+	cancel chan struct{} // Closed to abort the move
+}
+
+// Init initializes the hook's internal state. It is called by server.AddHook.
+func (h *MoveCommandHook) Init(config any) error {
+	h.done = make(chan struct{})
+	h.inline = inlineClient(h.server)
+	h.handlers = append(h.builtinCommands(), h.handlers...)
+	h.active = make(map[string]ActiveMove)
+	h.positions = make(map[string]objectPosition)
+	if h.dedupWindow > 0 {
+		h.recent = newRecentRequests(h.dedupWindow)
+	}
+	if h.flushInterval > 0 {
+		h.aggregator = newFeedbackAggregator(h.flushInterval, h.publishAggregatedFeedback)
+	}
+	return nil
+}
+
+// ActiveMoves returns the in-flight moves, oldest first, with the time elapsed
+// since each was received. Targets are given in agent coordinates.
+func (h *MoveCommandHook) ActiveMoves() []ActiveMove {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	moves := make([]ActiveMove, 0, len(h.active))
+	for _, m := range h.active {
+		m.ElapsedSeconds = now.Sub(m.ReceivedAt).Seconds()
+		m.TargetPosition = h.transform.toAgent(m.TargetPosition)
+		moves = append(moves, m)
+	}
+	sort.Slice(moves, func(i, j int) bool {
+		return moves[i].ReceivedAt.Before(moves[j].ReceivedAt)
+	})
+	return moves
+}
+
+// Drain waits up to grace for pending moves to complete and publish their
+// feedback, so a shutdown doesn't cut them short. New move commands are
+// refused from then on. It returns how many moves were in flight when it was
+// called, and how many still are, which Stop will interrupt.
+func (h *MoveCommandHook) Drain(grace time.Duration) (pending, remaining int) {
+	h.draining.Store(true)
+	pending = h.activeCount()
+	if pending > 0 && grace > 0 {
+		drained := make(chan struct{})
+		go func() {
+			h.wg.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-time.After(grace):
+		}
+	}
+	return pending, h.activeCount()
+}
+
+// activeCount returns the number of in-flight moves.
+func (h *MoveCommandHook) activeCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.active)
+}
+
+// Stop interrupts any pending moves and waits for their feedback to be
+// published. It is called by server.Close.
+func (h *MoveCommandHook) Stop() error {
+	close(h.done)
+	h.wg.Wait()
+	h.pool.close()
+	if h.aggregator != nil {
+		h.aggregator.flushPending()
+	}
+	if h.dryRun {
+		h.Log.Info("dry run summary", h.dryRunResults.logArgs()...)
+	}
+	return nil
+}
+
+// ID returns the ID of the hook.
+func (h *MoveCommandHook) ID() string {
+	if h.name != "" {
+		return "MoveCommandHook/" + h.name
+	}
+	return "MoveCommandHook"
+}
+
+// Provides indicates the methods that the hook provides.
+func (h *MoveCommandHook) Provides(p byte) bool {
+	switch p {
+	case mqtt.OnPublish:
+		return true
+	case mqtt.OnDisconnect, mqtt.OnSubscribed:
+		return h.feedbackCache != nil
+	}
+	return false
+}
+
+// OnPublish is called when a PUBLISH packet is received. A panic handling a
+// command is logged and the packet passed on unchanged, so one bad message
+// can't take down the broker.
+func (h *MoveCommandHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (out packets.Packet, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			h.Log.Error("recovered from panic handling command", "topic", pk.TopicName, "client_id", cl.ID,
+				"payload", string(pk.Payload), "panic", r, "stack", string(debug.Stack()))
+			out, err = pk, nil
+		}
+	}()
+
+	handler := h.commandHandler(pk.TopicName)
+	if handler == nil {
+		return pk, nil
+	}
+	kind := handler.Kind()
+	defer h.observeHandling(cl, pk, kind, time.Now())
+
+	if publishedByBridge(pk) {
+		h.Log.Warn("ignoring command published by the bridge, check for a feedback loop",
+			"topic", pk.TopicName, "client_id", cl.ID)
+		return pk, nil
+	}
+
+	// Oversize payloads are turned away before anything else parses them,
+	// including dry-run validation and the request ID lookups of the
+	// rejections below.
+	if h.maxPayload > 0 && len(pk.Payload) > h.maxPayload {
+		h.handleOversize(cl, pk)
+		return pk, nil
+	}
+	if h.dryRun {
+		if kind != commandKindMove && kind != commandKindBatch {
+			h.Log.Info("dry run: ignoring command", "kind", kind, "topic", pk.TopicName, "client_id", cl.ID)
+		} else {
+			h.handleDryRun(cl, pk, kind == commandKindBatch)
+		}
+		return pk, nil
+	}
+	if h.draining.Load() && kind != commandKindCancel {
+		h.handleShuttingDown(cl, pk, kind == commandKindMove)
+		return pk, nil
+	}
+	if kind == commandKindMove && !h.limiter.allow(cl.ID) {
+		h.handleRateLimited(cl, pk)
+		return pk, nil
+	}
+	if kind == commandKindMove {
+		if !h.globalLimiter.allow("") {
+			h.handleServerBusy(cl, pk)
+			return pk, nil
+		}
+		moveCommandRate.mark()
+	}
+	if decoded, ok := h.decodePayload(cl, pk); ok {
+		// The original payload is still what subscribers get.
+		feedback, err := handler.Handle(cl, decoded)
+		if err != nil {
+			h.Log.Warn("failed to handle command", "kind", kind, "topic", pk.TopicName, "client_id", cl.ID, "error", err)
+			h.publishDeadLetter(cl, pk, err)
+		}
+		if feedback != nil {
+			h.publishReply(feedback)
+		}
+	}
+	return pk, nil
+}
+
+// timestamp returns the current time in the feedback timestamp format.
+func (h *MoveCommandHook) timestamp() string {
+	return formatTimestamp(h.timestampFormat, time.Now())
+}
+
+// observeHandling records how long a command published at start took to parse
+// and handle, logging it if it was slow.
+func (h *MoveCommandHook) observeHandling(cl *mqtt.Client, pk packets.Packet, kind string, start time.Time) {
+	elapsed := time.Since(start)
+	commandHandlingSeconds.WithLabelValues(kind).Observe(elapsed.Seconds())
+	if h.slowThreshold > 0 && elapsed > h.slowThreshold {
+		h.Log.Warn("slow command", "topic", pk.TopicName, "client_id", cl.ID,
+			"size", len(pk.Payload), "elapsed", elapsed, "threshold", h.slowThreshold)
+	}
+}
+
+// handleOversize rejects a command whose payload exceeds the size limit
+// without parsing it, sending payload_too_large feedback if a request ID can
+// be found near the start of the payload. In dry-run mode it is only logged
+// and counted.
+func (h *MoveCommandHook) handleOversize(cl *mqtt.Client, pk packets.Packet) {
+	if h.dryRun {
+		h.Log.Info("dry run: would reject oversize command", "topic", pk.TopicName, "client_id", cl.ID,
+			"size", len(pk.Payload), "max_size", h.maxPayload)
+		h.dryRunResults.add("payload_too_large")
+		return
+	}
+	h.Log.Warn("rejected oversize command", "topic", pk.TopicName, "client_id", cl.ID,
+		"size", len(pk.Payload), "max_size", h.maxPayload)
+	moveCommandsRejected.WithLabelValues("payload_too_large").Inc()
+
+	requestID := extractRequestID(pk.Payload[:h.maxPayload])
+	if requestID == "" {
+		return
+	}
+	h.publishFeedback(MoveCompletionFeedback{
+		Status:    "payload_too_large",
+		Timestamp: h.timestamp(),
+		RequestID: requestID,
+		Reason:    fmt.Sprintf("payload of %d bytes exceeds the %d byte limit", len(pk.Payload), h.maxPayload),
+	}, h.responseContext(cl, pk))
+}
+
+// handleShuttingDown refuses a command received while draining, sending
+// interrupted feedback for a single move if it has a request ID.
+func (h *MoveCommandHook) handleShuttingDown(cl *mqtt.Client, pk packets.Packet, single bool) {
+	h.Log.Warn("refused command while shutting down", "topic", pk.TopicName, "client_id", cl.ID)
+	requestID := extractRequestID(pk.Payload)
+	if !single || requestID == "" {
+		return
+	}
+	h.publishFeedback(MoveCompletionFeedback{
+		Status:    "interrupted",
+		Timestamp: h.timestamp(),
+		RequestID: requestID,
+		Reason:    "server is shutting down",
+	}, h.responseContext(cl, pk))
+}
+
+// handleRateLimited drops a move command from a client sending them faster
+// than the rate limit, sending rate_limited feedback if it has a request ID.
+func (h *MoveCommandHook) handleRateLimited(cl *mqtt.Client, pk packets.Packet) {
+	requestID := extractRequestID(pk.Payload)
+	feedback := h.rejectRateLimited(cl, pk.TopicName, MoveCommand{RequestID: requestID})
+	if requestID == "" {
+		return
+	}
+	h.publishFeedback(feedback, h.responseContext(cl, pk))
+}
+
+// rejectRateLimited logs and counts a move received on topic from a client
+// over the rate limit, and returns its rate_limited feedback.
+func (h *MoveCommandHook) rejectRateLimited(cl *mqtt.Client, topic string, cmd MoveCommand) MoveCompletionFeedback {
+	h.Log.Warn("rate limited move command", "topic", topic, "client_id", cl.ID,
+		"request_id", cmd.RequestID, "rate", h.limiter.rate, "burst", h.limiter.burst)
+	moveCommandsRejected.WithLabelValues("rate_limited").Inc()
+	return MoveCompletionFeedback{
+		ObjectName: cmd.ObjectName,
+		Status:     "rate_limited",
+		Timestamp:  h.timestamp(),
+		RequestID:  cmd.RequestID,
+		Reason:     fmt.Sprintf("client is sending more than %g move commands per second", h.limiter.rate),
+	}
+}
+
+// handleServerBusy answers a move command turned away because the bridge as a
+// whole is receiving more move commands than the global rate allows.
+func (h *MoveCommandHook) handleServerBusy(cl *mqtt.Client, pk packets.Packet) {
+	requestID := extractRequestID(pk.Payload)
+	feedback := h.rejectServerBusy(cl, pk.TopicName, MoveCommand{RequestID: requestID})
+	if requestID == "" {
+		return
+	}
+	h.publishFeedback(feedback, h.responseContext(cl, pk))
+}
+
+// rejectServerBusy logs and counts a move received on topic which is over the
+// global rate, and returns its server_busy feedback.
+func (h *MoveCommandHook) rejectServerBusy(cl *mqtt.Client, topic string, cmd MoveCommand) MoveCompletionFeedback {
+	h.Log.Warn("rejected move command over the global rate", "topic", topic, "client_id", cl.ID,
+		"request_id", cmd.RequestID, "rate", h.globalLimiter.rate, "burst", h.globalLimiter.burst)
+	moveCommandsRejected.WithLabelValues("server_busy").Inc()
+	return MoveCompletionFeedback{
+		ObjectName: cmd.ObjectName,
+		Status:     "server_busy",
+		Timestamp:  h.timestamp(),
+		RequestID:  cmd.RequestID,
+		Reason:     fmt.Sprintf("server is receiving more than %g move commands per second across all clients", h.globalLimiter.rate),
+	}
+}
+
+// handleMove processes a single move command.
+func (h *MoveCommandHook) handleMove(cl *mqtt.Client, pk packets.Packet) {
+	receivedAt := time.Now()
+	h.logSampled("received move command", "topic", pk.TopicName, "client_id", cl.ID, "payload", string(pk.Payload))
+	moveCommandsReceived.Inc()
+	span := h.tracer.start(cl, pk)
+
+	if errs := h.schemaErrors(pk.Payload); errs != nil {
+		var cmd MoveCommand
+		_ = json.Unmarshal(pk.Payload, &cmd) // Whatever fields decode, to address the feedback
+		if cmd.RequestID == "" {
+			cmd.RequestID = extractRequestID(pk.Payload)
+		}
+		cmd.reply = h.replyContext(cl, pk)
+		cmd.span = span
+		feedback := h.rejectSchemaInvalid(cl, cmd, errs)
+		h.recordHistory(cmd, receivedAt, feedback)
+		h.publishCommandFeedback(cmd, feedback)
+		return
+	}
+
+	var cmd MoveCommand
+	if err := json.Unmarshal(pk.Payload, &cmd); err != nil {
+		h.Log.Warn("malformed move command", "topic", pk.TopicName, "client_id", cl.ID, "error", err)
+		moveCommandsRejected.WithLabelValues("malformed").Inc()
+		h.handleMalformed(cl, pk, err)
+		span.finish("malformed")
+		return
+	}
+	cmd.reply = h.replyContext(cl, pk)
+	cmd.span = span
+	span.setAttr("move.object_name", cmd.ObjectName)
+	span.setAttr("move.request_id", cmd.RequestID)
+
+	if feedback, dup := h.recent.check(cmd.RequestID); dup {
+		moveCommandsDuplicate.Inc()
+		if feedback == nil {
+			h.Log.Info("ignoring duplicate move command, original still in progress",
+				"client_id", cl.ID, "request_id", cmd.RequestID)
+			span.finish("duplicate")
+			return
+		}
+		h.Log.Info("resending feedback for duplicate move command", "client_id", cl.ID, "request_id", cmd.RequestID)
+		h.publishCommandFeedback(cmd, *feedback)
+		return
+	}
+
+	if feedback, ok := h.checkMove(cl, &cmd); !ok {
+		h.finishMove(cmd, receivedAt, feedback)
+		return
+	}
+	if !h.pool.reserve() {
+		h.rejectBusy(cl, cmd)
+		h.recent.forget(cmd.RequestID)
+		feedback := h.busyFeedback(cmd)
+		h.recordHistory(cmd, receivedAt, feedback)
+		h.publishCommandFeedback(cmd, feedback)
+		return
+	}
+
+	// In a real scenario, you'd forward this command to Unity or a game server.
+	// For this example, we simulate the move taking cmd.Duration seconds and
+	// send feedback once it completes.
+	launched := h.launchMove(cl, &cmd, receivedAt, &h.wg, func(duration time.Duration, cancel chan struct{}, ready <-chan struct{}) {
+		h.finishMove(cmd, receivedAt, h.runMove(cmd, duration, cancel, ready))
+	})
+	if !launched {
+		// Not finishMove, which would cache this as the feedback of the
+		// move already in flight.
+		feedback := h.rejectInFlight(cl, cmd)
+		h.recordHistory(cmd, receivedAt, feedback)
+		h.publishCommandFeedback(cmd, feedback)
+	}
+}
+
+// handleBatch processes a batch of move commands sharing one batch ID. Each
+// command is validated and simulated independently, and a single batch result
+// listing the outcome of every command is published once they have all
+// finished, so one bad command doesn't abort the rest of the batch.
+func (h *MoveCommandHook) handleBatch(cl *mqtt.Client, pk packets.Packet) {
+	receivedAt := time.Now()
+	h.logSampled("received move batch", "topic", pk.TopicName, "client_id", cl.ID, "payload", string(pk.Payload))
+
+	var cmds []MoveCommand
+	if err := json.Unmarshal(pk.Payload, &cmds); err != nil {
+		h.Log.Warn("malformed move batch", "topic", pk.TopicName, "client_id", cl.ID, "error", err)
+		moveCommandsRejected.WithLabelValues("malformed").Inc()
+		h.publishDeadLetter(cl, pk, err)
+		return
+	}
+	if len(cmds) == 0 {
+		h.Log.Warn("empty move batch", "topic", pk.TopicName, "client_id", cl.ID)
+		moveCommandsRejected.WithLabelValues("malformed").Inc()
+		h.publishDeadLetter(cl, pk, errors.New("batch has no move commands"))
+		return
+	}
+	moveCommandsReceived.Add(float64(len(cmds)))
+
+	// Each command is checked against the schema on its own, so one which
+	// doesn't match is rejected like any other invalid command in the batch.
+	var raw []json.RawMessage
+	if h.schema.Load() != nil {
+		_ = json.Unmarshal(pk.Payload, &raw) // Can't fail once cmds decoded
+	}
+
+	batchID := cmds[0].BatchID
+	seen := make(map[string]bool, len(cmds))
+
+	results := make([]MoveCompletionFeedback, len(cmds))
+	var pending sync.WaitGroup
+	for i, cmd := range cmds {
+		// Each move of a batch counts towards the client's rate and the
+		// global rate, as it would if published on its own.
+		if !h.limiter.allow(cl.ID) {
+			results[i] = h.rejectRateLimited(cl, pk.TopicName, cmd)
+			h.recordHistory(cmd, receivedAt, results[i])
+			continue
+		}
+		if !h.globalLimiter.allow("") {
+			results[i] = h.rejectServerBusy(cl, pk.TopicName, cmd)
+			h.recordHistory(cmd, receivedAt, results[i])
+			continue
+		}
+		moveCommandRate.mark()
+
+		if raw != nil {
+			if errs := h.schemaErrors(raw[i]); errs != nil {
+				results[i] = h.rejectSchemaInvalid(cl, cmd, errs)
+				h.recordHistory(cmd, receivedAt, results[i])
+				continue
+			}
+		}
+		if cmd.BatchID != batchID {
+			moveCommandsRejected.WithLabelValues("rejected").Inc()
+			results[i] = h.rejectedFeedback(cmd, "batch_id", fmt.Sprintf("batch_id %q does not match the batch's %q", cmd.BatchID, batchID))
+			h.recordHistory(cmd, receivedAt, results[i])
+			continue
+		}
+		if cmd.RequestID == "" {
+			moveCommandsRejected.WithLabelValues("rejected").Inc()
+			results[i] = h.rejectedFeedback(cmd, "request_id", "request_id must not be empty")
+			h.recordHistory(cmd, receivedAt, results[i])
+			continue
+		}
+		// Only the first of several commands with one request ID is moved,
+		// as feedback for the others couldn't be told apart from its.
+		if seen[cmd.RequestID] {
+			moveCommandsRejected.WithLabelValues("rejected").Inc()
+			results[i] = h.rejectedFeedback(cmd, "request_id", fmt.Sprintf("request_id %q is used earlier in the batch", cmd.RequestID))
+			h.recordHistory(cmd, receivedAt, results[i])
+			continue
+		}
+		seen[cmd.RequestID] = true
+		if feedback, ok := h.checkMove(cl, &cmd); !ok {
+			results[i] = feedback
+			h.recordHistory(cmd, receivedAt, results[i])
+			continue
+		}
+		if !h.pool.reserve() {
+			h.rejectBusy(cl, cmd)
+			results[i] = h.busyFeedback(cmd)
+			h.recordHistory(cmd, receivedAt, results[i])
+			continue
+		}
+
+		launched := h.launchMove(cl, &cmd, receivedAt, &pending, func(duration time.Duration, cancel chan struct{}, ready <-chan struct{}) {
+			results[i] = h.runMove(cmd, duration, cancel, ready)
+			h.recordHistory(cmd, receivedAt, results[i])
+		})
+		if !launched {
+			results[i] = h.rejectInFlight(cl, cmd)
+			h.recordHistory(cmd, receivedAt, results[i])
+		}
+	}
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		pending.Wait()
+		h.publishBatchFeedback(batchID, results, h.replyContext(cl, pk))
+	}()
+}
+
+// rejectBusy logs and counts a move turned away because the move queue is full.
+func (h *MoveCommandHook) rejectBusy(cl *mqtt.Client, cmd MoveCommand) {
+	h.Log.Warn("rejected move command", "client_id", cl.ID, "object_name", cmd.ObjectName,
+		"request_id", cmd.RequestID, "status", "busy", "reason", "move queue is full")
+	moveCommandsRejected.WithLabelValues("busy").Inc()
+}
+
+// busyFeedback returns the feedback for a move turned away because the move
+// queue is full.
+func (h *MoveCommandHook) busyFeedback(cmd MoveCommand) MoveCompletionFeedback {
+	return MoveCompletionFeedback{
+		ObjectName: cmd.ObjectName,
+		Status:     "busy",
+		Timestamp:  h.timestamp(),
+		RequestID:  cmd.RequestID,
+		Reason:     "too many moves are queued, try again later",
+	}
+}
+
+// handleCancel aborts the in-flight move named by a cancel command. The move
+// reports itself as cancelled; if no such move is in flight, not_found
+// feedback is published instead.
+func (h *MoveCommandHook) handleCancel(cl *mqtt.Client, pk packets.Packet) {
+	h.Log.Info("received cancel command", "topic", pk.TopicName, "client_id", cl.ID, "payload", string(pk.Payload))
+
+	var cmd CancelCommand
+	if err := json.Unmarshal(pk.Payload, &cmd); err != nil {
+		h.Log.Warn("malformed cancel command", "topic", pk.TopicName, "client_id", cl.ID, "error", err)
+		h.handleMalformed(cl, pk, err)
+		return
+	}
+
+	move, ok := h.cancelActive(cmd.RequestID)
+
+	if !ok {
+		h.Log.Info("no in-flight move to cancel", "client_id", cl.ID, "request_id", cmd.RequestID)
+		h.publishFeedback(MoveCompletionFeedback{
+			Status:    "not_found",
+			Timestamp: h.timestamp(),
+			RequestID: cmd.RequestID,
+			Reason:    "no in-flight move with this request_id",
+		}, h.responseContext(cl, pk))
+		return
+	}
+	h.Log.Info("cancelled move", "client_id", cl.ID, "object_name", move.ObjectName, "request_id", cmd.RequestID)
+}
+
+// checkMove validates cmd against the allowed objects and scene bounds, and
+// resolves its duration, returning the feedback to publish instead and false
+// if it can't be processed or would leave the object where it is. The object
+// name is trimmed and the target converted to scene coordinates in place, and
+// targets outside the bounds are clamped in place when the hook is in clamp
+// mode.
+func (h *MoveCommandHook) checkMove(cl *mqtt.Client, cmd *MoveCommand) (MoveCompletionFeedback, bool) {
+	if cmd.ObjectName = strings.TrimSpace(cmd.ObjectName); cmd.ObjectName == "" {
+		h.Log.Warn("rejected move command", "client_id", cl.ID, "request_id", cmd.RequestID, "status", "invalid_object_name")
+		moveCommandsRejected.WithLabelValues("invalid_object_name").Inc()
+		return MoveCompletionFeedback{
+			Status:    "invalid_object_name",
+			Timestamp: h.timestamp(),
+			RequestID: cmd.RequestID,
+			Reason:    "object_name must not be empty or whitespace",
+			Field:     "object_name",
+		}, false
+	}
+	// In-flight moves, their cancellation and their feedback are all told
+	// apart by request ID.
+	if cmd.RequestID == "" {
+		h.Log.Warn("rejected move command", "client_id", cl.ID, "object_name", cmd.ObjectName, "status", "invalid_request_id")
+		moveCommandsRejected.WithLabelValues("invalid_request_id").Inc()
+		return MoveCompletionFeedback{
+			ObjectName: cmd.ObjectName,
+			Status:     "invalid_request_id",
+			Timestamp:  h.timestamp(),
+			Reason:     "request_id must not be empty",
+			Field:      "request_id",
+		}, false
+	}
+	if field, reason := cmd.validate(); reason != "" {
+		return h.rejectMove(cl, *cmd, field, reason), false
+	}
+	cmd.TargetPosition = h.transform.toScene(roundPosition(cmd.TargetPosition, h.positionDecimals))
+
+	if !h.objectAllowed(cmd.ObjectName) {
+		h.Log.Warn("rejected move command", "client_id", cl.ID, "object_name", cmd.ObjectName,
+			"request_id", cmd.RequestID, "status", "unknown_object")
+		moveCommandsRejected.WithLabelValues("unknown_object").Inc()
+		return MoveCompletionFeedback{
+			ObjectName: cmd.ObjectName,
+			Status:     "unknown_object",
+			Timestamp:  h.timestamp(),
+			RequestID:  cmd.RequestID,
+			Reason:     fmt.Sprintf("object %q is not one of the allowed objects", cmd.ObjectName),
+			Field:      "object_name",
+		}, false
+	}
+
+	if h.bounds != nil && !h.bounds.contains(cmd.TargetPosition) {
+		if h.boundsMode == BoundsReject {
+			h.Log.Warn("rejected move command", "client_id", cl.ID, "object_name", cmd.ObjectName,
+				"request_id", cmd.RequestID, "status", "out_of_bounds", "target_position", cmd.TargetPosition)
+			moveCommandsRejected.WithLabelValues("out_of_bounds").Inc()
+			return MoveCompletionFeedback{
+				ObjectName: cmd.ObjectName,
+				Status:     "out_of_bounds",
+				Timestamp:  h.timestamp(),
+				RequestID:  cmd.RequestID,
+				Reason:     fmt.Sprintf("target_position %v is outside the scene bounds", cmd.TargetPosition),
+				Field:      "target_position",
+				Bounds:     h.bounds,
+			}, false
+		}
+
+		clamped := h.bounds.clamp(cmd.TargetPosition)
+		h.Log.Info("clamped move target to scene bounds", "client_id", cl.ID, "object_name", cmd.ObjectName,
+			"request_id", cmd.RequestID, "target_position", cmd.TargetPosition, "clamped_position", clamped)
+		cmd.TargetPosition = clamped
+		cmd.clamped = true
+	}
+
+	// Resolved last, so a duration computed from the speed covers the
+	// distance to the clamped target.
+	if field, reason := h.resolveDuration(cmd); reason != "" {
+		return h.rejectMove(cl, *cmd, field, reason), false
+	}
+
+	if position, ok := h.alreadyAt(*cmd); ok {
+		h.Log.Info("object is already at the move target", "client_id", cl.ID, "object_name", cmd.ObjectName,
+			"request_id", cmd.RequestID, "target_position", cmd.TargetPosition, "position", position)
+		moveCommandsNoOp.Inc()
+		return h.noOpFeedback(*cmd, position), false
+	}
+	return MoveCompletionFeedback{}, true
+}
+
+// alreadyAt returns the position of cmd's object and true if it is known to
+// be within noOpEpsilon of the target, with no earlier moves of it still to
+// finish, so the move would do nothing.
+func (h *MoveCommandHook) alreadyAt(cmd MoveCommand) ([]float64, bool) {
+	if h.noOpEpsilon <= 0 || h.queue.busy(cmd.ObjectName) {
+		return nil, false
+	}
+	last, ok := h.lastPosition(cmd.ObjectName)
+	if !ok || distance(last.position, cmd.TargetPosition) > h.noOpEpsilon {
+		return nil, false
+	}
+	return last.position, true
+}
+
+// noOpFeedback returns the feedback for a move which would leave the object
+// at position, answered at once.
+func (h *MoveCommandHook) noOpFeedback(cmd MoveCommand, position []float64) MoveCompletionFeedback {
+	var zero float64
+	return MoveCompletionFeedback{
+		ObjectName:    cmd.ObjectName,
+		FinalPosition: h.transform.toAgent(position),
+		Status:        "no_op",
+		Timestamp:     h.timestamp(),
+		RequestID:     cmd.RequestID,
+		Duration:      &zero,
+		Reason:        "object is already at the target",
+	}
+}
+
+// rejectMove logs and counts a command rejected for reason, and returns its
+// feedback.
+func (h *MoveCommandHook) rejectMove(cl *mqtt.Client, cmd MoveCommand, field, reason string) MoveCompletionFeedback {
+	h.Log.Warn("rejected move command", "client_id", cl.ID, "object_name", cmd.ObjectName,
+		"request_id", cmd.RequestID, "status", "rejected", "field", field, "reason", reason)
+	moveCommandsRejected.WithLabelValues("rejected").Inc()
+	return h.rejectedFeedback(cmd, field, reason)
+}
+
+// rejectSchemaInvalid logs and counts a command which doesn't match the
+// command schema, and returns its feedback listing the mismatches.
+func (h *MoveCommandHook) rejectSchemaInvalid(cl *mqtt.Client, cmd MoveCommand, errs []string) MoveCompletionFeedback {
+	h.Log.Warn("rejected move command", "client_id", cl.ID, "object_name", cmd.ObjectName,
+		"request_id", cmd.RequestID, "status", "schema_invalid", "errors", errs)
+	moveCommandsRejected.WithLabelValues("schema_invalid").Inc()
+	return MoveCompletionFeedback{
+		ObjectName: cmd.ObjectName,
+		Status:     "schema_invalid",
+		Timestamp:  h.timestamp(),
+		RequestID:  cmd.RequestID,
+		Reason:     "move command does not match the command schema",
+		Errors:     errs,
+	}
+}
+
+// rejectedFeedback returns the feedback for a command rejected for reason,
+// because of the given field.
+func (h *MoveCommandHook) rejectedFeedback(cmd MoveCommand, field, reason string) MoveCompletionFeedback {
+	return MoveCompletionFeedback{
+		ObjectName: cmd.ObjectName,
+		Status:     "rejected",
+		Timestamp:  h.timestamp(),
+		RequestID:  cmd.RequestID,
+		Reason:     reason,
+		Field:      field,
+	}
+}
+
+// launchMove records cmd, which holds a place reserved in the worker pool, as
+// in-flight, stamping when it was queued, and queues it behind earlier moves
+// of the same object. Once its turn comes run is handed to the pool with how
+// long the simulated move takes, a channel which is closed if the move is
+// cancelled, and the turn's ready channel; the turn is finished and wg done
+// once run returns. It returns false without launching cmd if another move
+// with its request ID is in flight. Either way, or if a panic stops the move
+// being submitted, everything it claimed is given back: its place in the
+// pool, its turn and its in-flight entry, so later moves aren't stuck
+// behind it.
+func (h *MoveCommandHook) launchMove(cl *mqtt.Client, cmd *MoveCommand, receivedAt time.Time, wg *sync.WaitGroup,
+	run func(duration time.Duration, cancel chan struct{}, ready <-chan struct{})) bool {
+	cmd.enqueuedAt = time.Now()
+	duration := h.moveDuration(*cmd)
+	h.logSampled("simulating move", "client_id", cl.ID, "object_name", cmd.ObjectName,
+		"target_position", cmd.TargetPosition, "duration", duration, "request_id", cmd.RequestID)
+
+	cancel := make(chan struct{})
+	var turn *moveTurn
+	submitted := false
+	defer func() {
+		if submitted {
+			return
+		}
+		h.removeActive(cmd.RequestID, cancel)
+		if turn != nil {
+			turn.finish()
+		}
+		h.pool.release()
+	}()
+
+	if !h.addActive(cmd.RequestID, ActiveMove{MoveCommand: *cmd, ReceivedAt: receivedAt, cancel: cancel}) {
+		return false
+	}
+	turn = h.queue.join(cmd.ObjectName)
+	wg.Add(1)
+	h.submitMove(cmd.Priority, turn, cancel, func() {
+		defer wg.Done()
+		defer turn.finish()
+		run(duration, cancel, turn.ready)
+	})
+	submitted = true
+	return true
+}
+
+// addActive records move as in-flight under requestID, returning false if
+// another move with that request ID already is.
+func (h *MoveCommandHook) addActive(requestID string, move ActiveMove) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.active[requestID]; ok {
+		return false
+	}
+	h.active[requestID] = move
+	return true
+}
+
+// rejectInFlight logs and counts a move turned away because another move with
+// its request ID is in flight, and returns its feedback.
+func (h *MoveCommandHook) rejectInFlight(cl *mqtt.Client, cmd MoveCommand) MoveCompletionFeedback {
+	return h.rejectMove(cl, cmd, "request_id", fmt.Sprintf("request_id %q is already used by an in-flight move", cmd.RequestID))
+}
+
+// removeActive forgets the in-flight move with requestID, unless it has
+// already been removed: a cancelled move is removed when it is cancelled,
+// and its request ID may since have been reused by another move, which is
+// told apart by its cancel channel.
+func (h *MoveCommandHook) removeActive(requestID string, cancel chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if m, ok := h.active[requestID]; ok && m.cancel == cancel {
+		delete(h.active, requestID)
+	}
+}
+
+// cancelActive cancels and forgets the in-flight move with requestID,
+// returning it, or false if there is none.
+func (h *MoveCommandHook) cancelActive(requestID string) (ActiveMove, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	move, ok := h.active[requestID]
+	if ok {
+		close(move.cancel)
+		delete(h.active, requestID)
+	}
+	return move, ok
+}
+
+// lastPosition returns the last known position of the named object in scene
+// coordinates, or false if it hasn't completed a move yet.
+func (h *MoveCommandHook) lastPosition(name string) (objectPosition, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	last, ok := h.positions[name]
+	return last, ok
+}
+
+// setPosition records that the named object has reached position.
+func (h *MoveCommandHook) setPosition(name string, position []float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.positions[name] = objectPosition{position: position, updatedAt: time.Now()}
+}
+
+// submitMove hands run to the worker pool once earlier moves of its object
+// have finished, or it is cancelled or the hook stopped. A move which must
+// wait for its turn does so on its own goroutine rather than a worker, so it
+// can't hold up moves of other objects, and a higher priority move can't be
+// given a worker ahead of an earlier move of its object it would wait for.
+func (h *MoveCommandHook) submitMove(priority int, turn *moveTurn, cancel <-chan struct{}, run func()) {
+	select {
+	case <-turn.ready:
+		h.pool.submit(priority, run)
+		return
+	default:
+	}
+	go func() {
+		select {
+		case <-turn.ready:
+		case <-cancel:
+		case <-h.done:
+		}
+		h.pool.submit(priority, run)
+	}()
+}
+
+// resolveDuration gives cmd the duration needed to cover the distance from the
+// object's last known position at its speed, or the default duration if it
+// has neither, and clamps a negative duration to zero. It returns the field
+// at fault and the reason cmd must be rejected if its duration can't be
+// worked out or is longer than the maximum, or empty strings.
+func (h *MoveCommandHook) resolveDuration(cmd *MoveCommand) (field, reason string) {
+	if cmd.Speed != nil {
+		if cmd.Duration != nil {
+			return "speed", "give either duration or speed, not both"
+		}
+		last, ok := h.lastPosition(cmd.ObjectName)
+		if !ok {
+			return "speed", fmt.Sprintf("position of %q is unknown until it has moved once, give a duration instead", cmd.ObjectName)
+		}
+		seconds := distance(last.position, cmd.TargetPosition) / *cmd.Speed
+		cmd.Duration = &seconds
+		cmd.fromSpeed = true
+	}
+	if cmd.Duration == nil {
+		seconds := h.defaultDuration.Seconds()
+		cmd.Duration = &seconds
+	}
+	if *cmd.Duration < 0 {
+		zero := 0.0
+		cmd.Duration = &zero
+		cmd.durationClamped = true
+	}
+	if h.maxDuration > 0 && h.moveDuration(*cmd) > h.maxDuration {
+		if cmd.fromSpeed {
+			return "speed", fmt.Sprintf("move at speed %g takes %.3gs, longer than the maximum of %v", *cmd.Speed, *cmd.Duration, h.maxDuration)
+		}
+		return "duration", fmt.Sprintf("duration %gs is longer than the maximum of %v", *cmd.Duration, h.maxDuration)
+	}
+	return "", ""
+}
+
+// computedDuration returns the duration in seconds computed from cmd's speed,
+// or nil if it wasn't given a speed.
+func (cmd MoveCommand) computedDuration() *float64 {
+	if !cmd.fromSpeed {
+		return nil
+	}
+	return cmd.Duration
+}
+
+// moveDuration returns how long the simulated move for cmd takes.
+func (h *MoveCommandHook) moveDuration(cmd MoveCommand) time.Duration {
+	if cmd.Duration == nil {
+		return h.defaultDuration
+	}
+	return max(0, time.Duration(*cmd.Duration*float64(time.Second)))
+}
+
+// runMove waits until ready is closed, then for a simulated move to finish,
+// and returns its completion feedback, publishing in_progress feedback at
+// evenly spaced steps along the way. If cancel is closed first the move is
+// reported as cancelled, and if the hook is stopped first, as interrupted.
+func (h *MoveCommandHook) runMove(cmd MoveCommand, duration time.Duration, cancel chan struct{}, ready <-chan struct{}) MoveCompletionFeedback {
+	defer h.removeActive(cmd.RequestID, cancel)
+
+	// Wait for earlier moves of the object to finish, so they complete in
+	// the order they were received.
+	select {
+	case <-ready:
+	case <-cancel:
+		return h.cancelledFeedback(cmd)
+	case <-h.done:
+		return h.interruptedFeedback(cmd)
+	}
+	if h.maxQueueWait > 0 && time.Since(cmd.enqueuedAt) > h.maxQueueWait {
+		return h.staleFeedback(cmd)
+	}
+
+	last, _ := h.lastPosition(cmd.ObjectName)
+	from := last.position
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	var progress <-chan time.Time
+	if h.progressSteps > 0 && duration > 0 {
+		ticker := time.NewTicker(duration / time.Duration(h.progressSteps+1))
+		defer ticker.Stop()
+		progress = ticker.C
+	}
+
+	delayed := false // Set once the move is done and its feedback is being held back
+	for step := 1; ; step++ {
+		select {
+		case <-progress:
+			fraction := float64(step) / float64(h.progressSteps+1)
+			h.publishFeedbackWith(MoveCompletionFeedback{
+				ObjectName:    cmd.ObjectName,
+				FinalPosition: h.transform.toAgent(interpolate(from, cmd.TargetPosition, fraction)),
+				Status:        "in_progress",
+				Progress:      fraction,
+				Timestamp:     h.timestamp(),
+				RequestID:     cmd.RequestID,
+			}, h.feedbackQosFor(cmd), false, cmd.reply)
+			if step == h.progressSteps {
+				progress = nil
+			}
+		case <-timer.C:
+			if !delayed && h.feedbackDelay > 0 {
+				// Emulate the latency of the feedback reaching the agent.
+				// The move can still be cancelled until then.
+				delayed, progress = true, nil
+				timer.Reset(h.feedbackDelay)
+				continue
+			}
+			if h.failureRate > 0 && rand.Float64() < h.failureRate {
+				return h.moveFailed(cmd)
+			}
+			return h.moveSucceeded(cmd)
+		case <-cancel:
+			return h.cancelledFeedback(cmd)
+		case <-h.done:
+			return h.interruptedFeedback(cmd)
+		}
+	}
+}
+
+// cancelledFeedback returns the feedback for a move cancelled before it
+// completed.
+func (h *MoveCommandHook) cancelledFeedback(cmd MoveCommand) MoveCompletionFeedback {
+	moveCommandsCancelled.Inc()
+	return MoveCompletionFeedback{
+		ObjectName: cmd.ObjectName,
+		Status:     "cancelled",
+		Timestamp:  h.timestamp(),
+		RequestID:  cmd.RequestID,
+		Reason:     "move cancelled before it completed",
+	}
+}
+
+// staleFeedback returns the feedback for a move which waited longer than the
+// maximum queue wait to start, so it is dropped instead of simulated.
+func (h *MoveCommandHook) staleFeedback(cmd MoveCommand) MoveCompletionFeedback {
+	waited := time.Since(cmd.enqueuedAt)
+	h.Log.Warn("rejected move command", "object_name", cmd.ObjectName, "request_id", cmd.RequestID,
+		"status", "stale", "waited", waited)
+	moveCommandsRejected.WithLabelValues("stale").Inc()
+	return MoveCompletionFeedback{
+		ObjectName: cmd.ObjectName,
+		Status:     "stale",
+		Timestamp:  h.timestamp(),
+		RequestID:  cmd.RequestID,
+		Reason:     fmt.Sprintf("move waited %v to start, longer than the maximum of %v", waited.Round(time.Millisecond), h.maxQueueWait),
+		EnqueuedAt: formatTimestamp(h.timestampFormat, cmd.enqueuedAt),
+	}
+}
+
+// interruptedFeedback returns the feedback for a move interrupted by the
+// server shutting down.
+func (h *MoveCommandHook) interruptedFeedback(cmd MoveCommand) MoveCompletionFeedback {
+	return MoveCompletionFeedback{
+		ObjectName: cmd.ObjectName,
+		Status:     "interrupted",
+		Timestamp:  h.timestamp(),
+		RequestID:  cmd.RequestID,
+		Reason:     "server shutting down before the move completed",
+	}
+}
+
+// moveSucceeded records the object as having reached its target and returns
+// the success feedback for cmd.
+func (h *MoveCommandHook) moveSucceeded(cmd MoveCommand) MoveCompletionFeedback {
+	h.setPosition(cmd.ObjectName, cmd.TargetPosition)
+
+	moveCommandsCompleted.Inc()
+	feedback := MoveCompletionFeedback{
+		ObjectName:    cmd.ObjectName,
+		FinalPosition: h.transform.toAgent(cmd.TargetPosition), // Assuming it reaches the target
+		Status:        "success",
+		Timestamp:     h.timestamp(),
+		RequestID:     cmd.RequestID,
+		Duration:      cmd.computedDuration(),
+	}
+	if cmd.clamped {
+		feedback.Clamped = true
+		feedback.Bounds = h.bounds
+	}
+	if cmd.durationClamped {
+		feedback.Reason = "negative duration was clamped to 0"
+	}
+	return feedback
+}
+
+// moveFailed returns the feedback for a move which the simulated failure rate
+// made fail. The object is left where it was.
+func (h *MoveCommandHook) moveFailed(cmd MoveCommand) MoveCompletionFeedback {
+	moveCommandsFailed.Inc()
+	return MoveCompletionFeedback{
+		ObjectName:    cmd.ObjectName,
+		FinalPosition: h.transform.toAgent(cmd.TargetPosition),
+		Status:        "failed",
+		Timestamp:     h.timestamp(),
+		RequestID:     cmd.RequestID,
+		Duration:      cmd.computedDuration(),
+		Reason:        "simulated failure, see move_failure_rate",
+	}
+}
+
+// distance returns the Euclidean distance between two positions.
+func distance(a, b []float64) float64 {
+	var sum float64
+	for i := range min(len(a), len(b)) {
+		sum += (b[i] - a[i]) * (b[i] - a[i])
+	}
+	return math.Sqrt(sum)
+}
+
+// interpolate returns the point the given fraction of the way from from to
+// to. It returns nil if the start position is unknown.
+func interpolate(from, to []float64, fraction float64) []float64 {
+	if len(from) != len(to) {
+		return nil
+	}
+	pos := make([]float64, len(to))
+	for i := range to {
+		pos[i] = from[i] + (to[i]-from[i])*fraction
+	}
+	return pos
+}
+
+// finishMove records the feedback for a single move command and publishes it.
+func (h *MoveCommandHook) finishMove(cmd MoveCommand, receivedAt time.Time, feedback MoveCompletionFeedback) {
+	h.recent.complete(cmd.RequestID, feedback)
+	h.recordHistory(cmd, receivedAt, feedback)
+	h.publishCommandFeedback(cmd, feedback)
+}
+
+// recordHistory appends cmd and its feedback to the move history, if enabled.
+func (h *MoveCommandHook) recordHistory(cmd MoveCommand, receivedAt time.Time, feedback MoveCompletionFeedback) {
+	err := h.history.Record(HistoryRecord{
+		ReceivedAt:  receivedAt,
+		CompletedAt: time.Now(),
+		Command:     cmd,
+		Feedback:    feedback,
+	})
+	if err != nil {
+		h.Log.Error("failed to record move history", "request_id", cmd.RequestID, "error", err)
+	}
+}
+
+// jsonErrorField returns the field a JSON decoding error is about, or an empty
+// string if it isn't about a particular field.
+func jsonErrorField(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return typeErr.Field
+	}
+	return ""
+}
+
+// handleMalformed reports a move command which couldn't be unmarshalled. If a
+// request ID can be recovered the agent is sent error feedback, otherwise the
+// raw payload is published to the dead-letter topic.
+func (h *MoveCommandHook) handleMalformed(cl *mqtt.Client, pk packets.Packet, err error) {
+	if requestID := extractRequestID(pk.Payload); requestID != "" {
+		h.publishFeedback(MoveCompletionFeedback{
+			Status:    "error",
+			Timestamp: h.timestamp(),
+			RequestID: requestID,
+			Reason:    fmt.Sprintf("malformed move command: %v", err),
+			Field:     jsonErrorField(err),
+		}, h.responseContext(cl, pk))
+		return
+	}
+
+	h.publishDeadLetter(cl, pk, err)
+}
+
+// topic returns the current value of one of the hook's topics.
+func (h *MoveCommandHook) topic(t *string) string {
+	h.topicsMu.RLock()
+	defer h.topicsMu.RUnlock()
+	return h.namespaced(*t)
+}
+
+// namespaced returns topic under the hook's namespace. An empty topic is
+// disabled, so stays empty. h.topicsMu must be held.
+func (h *MoveCommandHook) namespaced(topic string) string {
+	if h.namespace == "" || topic == "" {
+		return topic
+	}
+	return h.namespace + "/" + topic
+}
+
+// Placeholders in the feedback topic, replaced by the fields of the feedback
+// being published so clients can subscribe to a single object's feedback.
+const (
+	placeholderObjectName = "{object_name}"
+	placeholderRequestID  = "{request_id}"
+)
+
+// feedbackTopicFor returns the topic to publish feedback to, with any
+// placeholders in the feedback topic replaced by its fields.
+func (h *MoveCommandHook) feedbackTopicFor(feedback MoveCompletionFeedback) string {
+	topic := h.topic(&h.feedbackTopic)
+	if !strings.Contains(topic, "{") {
+		return topic
+	}
+	return strings.NewReplacer(
+		placeholderObjectName, topicLevel(feedback.ObjectName),
+		placeholderRequestID, topicLevel(feedback.RequestID),
+	).Replace(topic)
+}
+
+// topicLevel makes s safe to use as a single topic level, so it can't add
+// wildcards or extra levels to a topic. Separators, wildcards and null
+// characters are replaced with underscores, as is an empty string.
+func topicLevel(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '+', '#', 0:
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// SetTopics changes the topics the hook receives commands on and publishes
+// feedback to, taking effect from the next message.
+func (h *MoveCommandHook) SetTopics(cfg *Config) {
+	h.topicsMu.Lock()
+	defer h.topicsMu.Unlock()
+	h.commandTopic = cfg.CommandTopic
+	h.feedbackTopic = cfg.FeedbackTopic
+	h.errorTopic = cfg.ErrorTopic
+	h.batchCommandTopic = cfg.BatchCommandTopic
+	h.batchFeedbackTopic = cfg.BatchFeedbackTopic
+	h.aggregateTopic = cfg.AggregateFeedbackTopic
+	h.cancelTopic = cfg.CancelTopic
+	h.namespace = cfg.Namespace
+}
+
+// SetAllowedObjects changes the object names move commands may target, taking
+// effect from the next command. An empty list allows any object.
+func (h *MoveCommandHook) SetAllowedObjects(names []string) {
+	var allowed map[string]bool
+	if len(names) > 0 {
+		allowed = make(map[string]bool, len(names))
+		for _, name := range names {
+			allowed[name] = true
+		}
+	}
+	h.objectsMu.Lock()
+	defer h.objectsMu.Unlock()
+	h.allowedObjects = allowed
+}
+
+// SetSchema changes the JSON Schema command payloads are checked against,
+// taking effect from the next command. A nil schema disables the check.
+func (h *MoveCommandHook) SetSchema(schema *jsonSchema) {
+	h.schema.Store(schema)
+}
+
+// schemaErrors returns the ways a command payload doesn't match the command
+// schema, or nil if it does or there is no schema.
+func (h *MoveCommandHook) schemaErrors(payload []byte) []string {
+	schema := h.schema.Load()
+	if schema == nil {
+		return nil
+	}
+	return schema.check(payload)
+}
+
+// objectAllowed reports whether move commands may target the named object.
+func (h *MoveCommandHook) objectAllowed(name string) bool {
+	h.objectsMu.RLock()
+	defer h.objectsMu.RUnlock()
+	return h.allowedObjects == nil || h.allowedObjects[name]
+}
+
+// Retry policy for publishing feedback, so a briefly overloaded broker doesn't
+// leave the agent without an answer.
+const (
+	publishAttempts = 3
+	publishBackoff  = 100 * time.Millisecond // Doubled after each failed attempt
+)
+
+// The MQTT v5 user property every message published by the hook is tagged
+// with, so it can recognise its own messages if they are republished to a
+// command topic.
+const (
+	sourceProperty = "source"
+	sourceBridge   = "mqtt_bridge"
+)
+
+// replyContext returns how the feedback to a command published by cl as pk is
+// to be published: to its response topic, encoded as the command was, and
+// with the command's correlation data and the user properties which are
+// echoed, for passing tracing context through the bridge.
+func (h *MoveCommandHook) replyContext(cl *mqtt.Client, pk packets.Packet) replyContext {
+	reply := h.responseContext(cl, pk)
+	for _, p := range pk.Properties.User {
+		if slices.Contains(h.echoProperties, p.Key) {
+			reply.userProperties = append(reply.userProperties, p)
+		}
+	}
+	reply.cbor = h.isCBOR(cl, pk)
+	return reply
+}
+
+// responseContext returns where the feedback to a command published by cl as
+// pk is to be published, following the MQTT v5 request/response convention:
+// to its response topic, if it gave one, with its correlation data. A response
+// topic with wildcards or starting with $ is ignored.
+func (h *MoveCommandHook) responseContext(cl *mqtt.Client, pk packets.Packet) replyContext {
+	reply := replyContext{correlationData: slices.Clone(pk.Properties.CorrelationData)}
+	if topic := pk.Properties.ResponseTopic; topic != "" {
+		if strings.ContainsAny(topic, "#+") || strings.HasPrefix(topic, "$") {
+			h.Log.Warn("ignoring invalid response topic", "topic", pk.TopicName, "client_id", cl.ID, "response_topic", topic)
+		} else {
+			reply.responseTopic = topic
+		}
+	}
+	return reply
+}
+
+// isCBOR reports whether pk's payload is CBOR: if its MQTT v5 content type
+// says so, or otherwise if the command encoding is CBOR. The bridge's own
+// HTTP API publishes JSON unless it says otherwise.
+func (h *MoveCommandHook) isCBOR(cl *mqtt.Client, pk packets.Packet) bool {
+	switch pk.Properties.ContentType {
+	case contentTypeCBOR:
+		return true
+	case contentTypeJSON:
+		return false
+	}
+	return h.commandEncoding == EncodingCBOR && !cl.Net.Inline
+}
+
+// decodePayload returns pk with a CBOR payload transcoded to the JSON the
+// command handlers parse. If the payload isn't valid CBOR it is published to
+// the dead-letter topic and false is returned.
+func (h *MoveCommandHook) decodePayload(cl *mqtt.Client, pk packets.Packet) (packets.Packet, bool) {
+	if !h.isCBOR(cl, pk) {
+		return pk, true
+	}
+	payload, err := cborToJSON(pk.Payload)
+	if err != nil {
+		h.Log.Warn("malformed CBOR command", "topic", pk.TopicName, "client_id", cl.ID, "error", err)
+		moveCommandsRejected.WithLabelValues("malformed").Inc()
+		h.publishDeadLetter(cl, pk, err)
+		return pk, false
+	}
+	pk.Payload = payload
+	return pk, true
+}
+
+// publishedByBridge reports whether pk carries the hook's source tag.
+func publishedByBridge(pk packets.Packet) bool {
+	for _, p := range pk.Properties.User {
+		if p.Key == sourceProperty && p.Val == sourceBridge {
+			return true
+		}
+	}
+	return false
+}
+
+// publish publishes payload to topic as reply says, then calls done with the
+// result. If the first attempt fails, the rest are made with exponential
+// backoff on a goroutine of their own, so callers handling a PUBLISH, such as
+// rejections in OnPublish, don't hold up the client's connection; done then
+// gets the last error if every attempt fails, or errNotServing if the hook
+// stops first.
+func (h *MoveCommandHook) publish(topic string, payload []byte, qos byte, retain bool, reply replyContext, done func(error)) {
+	err := h.inject(topic, payload, qos, retain, reply)
+	if err == nil || errors.Is(err, errNotServing) {
+		done(err)
+		return
+	}
+	go func() {
+		backoff := publishBackoff
+		for attempt := 1; attempt < publishAttempts; attempt++ {
+			h.Log.Warn("failed to publish, retrying", "topic", topic, "attempt", attempt, "backoff", backoff, "error", err)
+			select {
+			case <-time.After(backoff):
+			case <-h.done:
+				done(errNotServing)
+				return
+			}
+			if err = h.inject(topic, payload, qos, retain, reply); err == nil {
+				done(nil)
+				return
+			}
+			backoff *= 2
+		}
+		done(fmt.Errorf("publishing to %s failed after %d attempts: %w", topic, publishAttempts, err))
+	}()
+}
+
+// inject publishes payload to topic from the server's inline client, with the
+// hook's source tag and the properties reply calls for. It is server.Publish
+// with properties.
+func (h *MoveCommandHook) inject(topic string, payload []byte, qos byte, retain bool, reply replyContext) error {
+	if !h.ready.wait(h.done) {
+		return errNotServing
+	}
+	cl := h.inline
+	if cl == nil {
+		return mqtt.ErrInlineClientNotEnabled
+	}
+	return h.server.InjectPacket(cl, replyPacket(topic, payload, qos, retain, reply))
+}
+
+// replyPacket returns a PUBLISH packet of payload to topic, with the hook's
+// source tag and the properties reply calls for.
+func replyPacket(topic string, payload []byte, qos byte, retain bool, reply replyContext) packets.Packet {
+	pk := packets.Packet{
+		FixedHeader: packets.FixedHeader{
+			Type:   packets.Publish,
+			Qos:    qos,
+			Retain: retain,
+		},
+		TopicName: topic,
+		Payload:   payload,
+		PacketID:  uint16(qos), // As in server.Publish, only needed to pass validity checks
+		Properties: packets.Properties{
+			User: append([]packets.UserProperty{{Key: sourceProperty, Val: sourceBridge}}, reply.userProperties...),
+		},
+	}
+	if reply.cbor {
+		pk.Properties.ContentType = contentTypeCBOR
+	}
+	pk.Properties.CorrelationData = reply.correlationData
+	return pk
+}
+
+// publishDeadLetter publishes a malformed command's raw payload to the
+// dead-letter topic.
+func (h *MoveCommandHook) publishDeadLetter(cl *mqtt.Client, pk packets.Packet, err error) {
+	payload, err := json.Marshal(DeadLetter{
+		Topic:     pk.TopicName,
+		ClientID:  cl.ID,
+		Error:     err.Error(),
+		Payload:   string(pk.Payload),
+		Timestamp: h.timestamp(),
+	})
+	if err != nil {
+		h.Log.Error("failed to marshal dead letter", "error", err)
+		return
+	}
+
+	topic := h.topic(&h.errorTopic)
+	h.publish(topic, payload, h.feedbackQos, false, replyContext{}, func(err error) {
+		if err != nil {
+			feedbackDropped.Inc()
+			h.Log.Error("dropped dead letter", "topic", topic, "client_id", cl.ID, "error", err)
+		} else {
+			h.Log.Info("published dead letter", "topic", topic, "client_id", cl.ID)
+		}
+	})
+}
+
+// feedbackQosFor returns the QoS feedback for cmd is delivered with: the QoS
+// the command asked for, or the configured QoS if it didn't ask for a valid one.
+func (h *MoveCommandHook) feedbackQosFor(cmd MoveCommand) byte {
+	if cmd.FeedbackQos != nil && *cmd.FeedbackQos <= 2 {
+		return *cmd.FeedbackQos
+	}
+	return h.feedbackQos
+}
+
+// publishCommandFeedback publishes the feedback for cmd, delivered as the
+// command asked and mirroring how it was published.
+func (h *MoveCommandHook) publishCommandFeedback(cmd MoveCommand, feedback MoveCompletionFeedback) {
+	defer cmd.span.finish(feedback.Status)
+	if h.aggregator != nil {
+		h.notifyWatchers(feedback)
+		if payload, err := json.Marshal(feedback); err == nil {
+			h.broadcaster.Broadcast(payload)
+		}
+		h.aggregator.add(feedback)
+		return
+	}
+	h.publishFeedbackWith(feedback, h.feedbackQosFor(cmd), cmd.FeedbackRetain, cmd.reply)
+}
+
+// publishAggregatedFeedback publishes buffered move feedback as one JSON
+// array to the aggregate feedback topic. Per-command QoS, retain and reply
+// options can't apply to a shared message, so it is sent with the default
+// feedback QoS.
+func (h *MoveCommandHook) publishAggregatedFeedback(feedback []MoveCompletionFeedback) {
+	payload, err := json.Marshal(feedback)
+	if err != nil {
+		h.Log.Error("failed to marshal aggregated feedback", "messages", len(feedback), "error", err)
+		return
+	}
+
+	topic := h.topic(&h.aggregateTopic)
+	h.publish(topic, payload, h.feedbackQos, false, replyContext{}, func(err error) {
+		if err != nil {
+			feedbackDropped.Add(float64(len(feedback)))
+			h.Log.Error("dropped aggregated feedback", "topic", topic, "messages", len(feedback), "error", err)
+		} else {
+			h.logSampled("published aggregated feedback", "topic", topic, "messages", len(feedback))
+		}
+	})
+}
+
+// encodeReply encodes a JSON feedback payload as reply says.
+func (h *MoveCommandHook) encodeReply(payload []byte, reply replyContext) ([]byte, error) {
+	if !reply.cbor {
+		return payload, nil
+	}
+	return jsonToCBOR(payload)
+}
+
+// publishFeedback publishes a move completion feedback message at the
+// configured QoS, to the topic reply says.
+func (h *MoveCommandHook) publishFeedback(feedback MoveCompletionFeedback, reply replyContext) {
+	h.publishFeedbackWith(feedback, h.feedbackQos, false, reply)
+}
+
+// publishFeedbackWith publishes a move completion feedback message with the
+// given QoS and retain flag, as reply says. WebSocket clients always get JSON.
+func (h *MoveCommandHook) publishFeedbackWith(feedback MoveCompletionFeedback, qos byte, retain bool, reply replyContext) {
+	feedbackPayload, err := json.Marshal(feedback)
+	if err != nil {
+		h.Log.Error("failed to marshal feedback", "request_id", feedback.RequestID, "error", err)
+		return
+	}
+	h.notifyWatchers(feedback)
+	h.broadcaster.Broadcast(feedbackPayload)
+	if feedbackPayload, err = h.encodeReply(feedbackPayload, reply); err != nil {
+		h.Log.Error("failed to encode feedback", "request_id", feedback.RequestID, "error", err)
+		return
+	}
+
+	topic := reply.topic(h.feedbackTopicFor(feedback))
+	h.publish(topic, feedbackPayload, qos, retain, reply, func(err error) {
+		if err != nil {
+			feedbackDropped.Inc()
+			h.Log.Error("dropped feedback", "topic", topic, "request_id", feedback.RequestID,
+				"status", feedback.Status, "error", err)
+		} else {
+			h.feedbackCache.add(feedback.RequestID, topic, feedbackPayload, reply)
+			h.logSampled("published feedback", "topic", topic, "request_id", feedback.RequestID, "status", feedback.Status)
+		}
+	})
+}
+
+// publishReply publishes the feedback of a command handled by a registered
+// CommandHandler, mirroring how the command was published.
+func (h *MoveCommandHook) publishReply(feedback *CommandFeedback) {
+	reply, requestID, status := feedback.Reply, feedback.RequestID, feedback.Status
+	topic := reply.topic(feedback.Topic)
+	payload, err := json.Marshal(feedback.Payload)
+	if err == nil {
+		payload, err = h.encodeReply(payload, reply)
+	}
+	if err != nil {
+		h.Log.Error("failed to encode feedback", "request_id", requestID, "error", err)
+		return
+	}
+
+	h.publish(topic, payload, h.feedbackQos, false, reply, func(err error) {
+		if err != nil {
+			feedbackDropped.Inc()
+			h.Log.Error("dropped feedback", "topic", topic, "request_id", requestID, "status", status, "error", err)
+		} else {
+			h.feedbackCache.add(requestID, topic, payload, reply)
+			h.logSampled("published feedback", "topic", topic, "request_id", requestID, "status", status)
+		}
+	})
+}
+
+// publishBatchFeedback publishes the combined result of a batch of moves,
+// mirroring how the batch was published.
+func (h *MoveCommandHook) publishBatchFeedback(batchID string, results []MoveCompletionFeedback, reply replyContext) {
+	succeeded := 0
+	for _, r := range results {
+		if r.Status == "success" {
+			succeeded++
+		}
+	}
+
+	status := "partial"
+	switch succeeded {
+	case len(results):
+		status = "success"
+	case 0:
+		status = "failed"
+	}
+
+	payload, err := json.Marshal(BatchCompletionFeedback{
+		BatchID:   batchID,
+		Status:    status,
+		Results:   results,
+		Timestamp: h.timestamp(),
+	})
+	if err != nil {
+		h.Log.Error("failed to marshal batch feedback", "batch_id", batchID, "error", err)
+		return
+	}
+	if payload, err = h.encodeReply(payload, reply); err != nil {
+		h.Log.Error("failed to encode batch feedback", "batch_id", batchID, "error", err)
+		return
+	}
+
+	topic := reply.topic(h.topic(&h.batchFeedbackTopic))
+	h.publish(topic, payload, h.feedbackQos, false, reply, func(err error) {
+		if err != nil {
+			feedbackDropped.Inc()
+			h.Log.Error("dropped batch feedback", "topic", topic, "batch_id", batchID,
+				"status", status, "error", err)
+		} else {
+			h.logSampled("published batch feedback", "topic", topic, "batch_id", batchID, "status", status)
+		}
+	})
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+func TestFeedbackQos(t *testing.T) {
+	t.Parallel()
+	for _, qos := range []byte{0, 1, 2} {
+		t.Run(fmt.Sprintf("qos %d", qos), func(t *testing.T) {
+			t.Parallel()
+			server, _, _ := newMoveTestServer(t, func(h *MoveCommandHook) {
+				h.feedbackQos = qos
+			})
+			received := subscribeInline(t, server, "unity/feedback/move_complete")
+
+			payload := []byte(`{"object_name":"Cube","target_position":[1,2,3],"duration":0,"request_id":"qos"}`)
+			if err := server.Publish("unity/commands/move", payload, false, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case pk := <-received:
+				if pk.FixedHeader.Qos != qos {
+					t.Errorf("feedback published with qos %d, want %d", pk.FixedHeader.Qos, qos)
+				}
+			case <-time.After(time.Second):
+				t.Errorf("no feedback received for qos %d", qos)
+			}
+		})
+	}
+}
+
+func TestMoveCommandFeedback(t *testing.T) {
+	t.Parallel()
+	_, _, client := newMoveTestServer(t, nil)
+	client.subscribe("unity/feedback/move_complete")
+
+	client.publish("unity/commands/move",
+		[]byte(`{"object_name":"Cube","target_position":[0,5,0],"duration":0.1,"request_id":"move-1"}`), packets.Properties{})
+
+	feedback := decodeFeedback(t, client.next())
+	if feedback.ObjectName != "Cube" || feedback.Status != "success" || feedback.RequestID != "move-1" {
+		t.Errorf("got feedback %+v, want success for Cube with request ID move-1", feedback)
+	}
+	if want := []float64{0, 5, 0}; !slices.Equal(feedback.FinalPosition, want) {
+		t.Errorf("got final position %v, want %v", feedback.FinalPosition, want)
+	}
+	if _, err := time.Parse(time.RFC3339, feedback.Timestamp); err != nil {
+		t.Errorf("invalid timestamp %q: %v", feedback.Timestamp, err)
+	}
+}
+
+func TestMalformedMoveCommand(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name    string
+		payload string
+		topic   string // Topic the error is expected on
+		status  string // Expected feedback status, empty for a dead letter
+	}{
+		{
+			name:    "with request ID",
+			payload: `{"object_name":"Cube","target_position":"up","request_id":"bad-1"}`,
+			topic:   "unity/feedback/move_complete",
+			status:  "error",
+		},
+		{
+			name:    "without request ID",
+			payload: `not json`,
+			topic:   "unity/feedback/errors",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			_, _, client := newMoveTestServer(t, nil)
+			client.subscribe("unity/feedback/+")
+
+			client.publish("unity/commands/move", []byte(tt.payload), packets.Properties{})
+
+			pk := client.next()
+			if pk.TopicName != tt.topic {
+				t.Fatalf("error published to %s, want %s", pk.TopicName, tt.topic)
+			}
+			if tt.status == "" {
+				var letter DeadLetter
+				if err := json.Unmarshal(pk.Payload, &letter); err != nil {
+					t.Fatalf("invalid dead letter %s: %v", pk.Payload, err)
+				}
+				if letter.Payload != tt.payload || letter.Error == "" {
+					t.Errorf("got dead letter %+v, want payload %q with an error", letter, tt.payload)
+				}
+				return
+			}
+			feedback := decodeFeedback(t, pk)
+			if feedback.Status != tt.status || feedback.RequestID != "bad-1" || feedback.Reason == "" {
+				t.Errorf("got feedback %+v, want status %s for request ID bad-1 with a reason", feedback, tt.status)
+			}
+		})
+	}
+}
+
+func TestMoveCommandWrongTopic(t *testing.T) {
+	t.Parallel()
+	_, _, client := newMoveTestServer(t, nil)
+	client.subscribe("unity/feedback/+")
+
+	client.publish("unity/commands/rotate",
+		[]byte(`{"object_name":"Cube","target_position":[0,5,0],"duration":0,"request_id":"move-1"}`), packets.Properties{})
+
+	select {
+	case pk := <-client.messages:
+		t.Errorf("unexpected message on %s for a command on another topic: %s", pk.TopicName, pk.Payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// publishMoves publishes each move command in turn and returns the request
+// IDs of the first n feedback messages the client receives, in order.
+func publishMoves(t *testing.T, client *testClient, n int, payloads ...string) []string {
+	t.Helper()
+	for _, payload := range payloads {
+		client.publish("unity/commands/move", []byte(payload), packets.Properties{})
+	}
+	var order []string
+	for range n {
+		order = append(order, decodeFeedback(t, client.next()).RequestID)
+	}
+	return order
+}
+
+func TestMovesOfOneObjectAreOrdered(t *testing.T) {
+	t.Parallel()
+	_, hook, client := newMoveTestServer(t, nil)
+	client.subscribe("unity/feedback/move_complete")
+
+	// The second move of Cube is quicker than the first, so would complete
+	// first if they ran concurrently. The move of Sphere shouldn't wait for
+	// either of them.
+	order := publishMoves(t, client, 3,
+		`{"object_name":"Cube","target_position":[1,0,0],"duration":0.2,"request_id":"cube-1"}`,
+		`{"object_name":"Cube","target_position":[2,0,0],"duration":0,"request_id":"cube-2"}`,
+		`{"object_name":"Sphere","target_position":[3,0,0],"duration":0,"request_id":"sphere-1"}`,
+	)
+	if want := []string{"sphere-1", "cube-1", "cube-2"}; !slices.Equal(order, want) {
+		t.Errorf("got feedback in order %v, want %v", order, want)
+	}
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	if got, want := hook.positions["Cube"].position, []float64{2, 0, 0}; !slices.Equal(got, want) {
+		t.Errorf("got final Cube position %v, want %v", got, want)
+	}
+}
+
+func TestCommandFeedbackDelivery(t *testing.T) {
+	t.Parallel()
+	server, _, _ := newMoveTestServer(t, nil)
+	received := subscribeInline(t, server, "unity/feedback/move_complete")
+
+	payload := []byte(`{"object_name":"Cube","target_position":[1,2,3],"duration":0,"request_id":"retained",` +
+		`"feedback_qos":2,"feedback_retain":true}`)
+	if err := server.Publish("unity/commands/move", payload, false, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case pk := <-received:
+		if pk.FixedHeader.Qos != 2 {
+			t.Errorf("feedback published with qos %d, want 2", pk.FixedHeader.Qos)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no feedback received")
+	}
+	if retained := server.Topics.Messages("unity/feedback/move_complete"); len(retained) != 1 {
+		t.Errorf("got %d retained feedback messages, want 1", len(retained))
+	}
+}
+
+func TestPublishWaitsUntilServing(t *testing.T) {
+	t.Parallel()
+	ready := make(serveGate)
+	_, _, client := newMoveTestServer(t, func(h *MoveCommandHook) {
+		h.ready = ready
+	})
+	client.subscribe("unity/feedback/move_complete")
+
+	// Publish a command before the bridge is serving, as a client of the
+	// inline client could during startup.
+	client.publish("unity/commands/move",
+		[]byte(`{"object_name":"Cube","target_position":[1,2,3],"duration":0,"request_id":"early"}`), packets.Properties{})
+	select {
+	case <-client.messages:
+		t.Fatal("feedback published before the bridge was serving")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(ready)
+	feedback := decodeFeedback(t, client.next())
+	if feedback.RequestID != "early" || feedback.Status != "success" {
+		t.Errorf("got feedback %+v, want success for request early", feedback)
+	}
+}
+
+func TestPanicHandlingCommand(t *testing.T) {
+	t.Parallel()
+	server, hook, client := newMoveTestServer(t, func(h *MoveCommandHook) {
+		// A single place in the queue, so one left reserved by the panic
+		// would turn the next move away as busy.
+		h.pool = newWorkerPool(1, 1)
+	})
+
+	// Stand in for a bug in a handler: recording the move as active writes
+	// to a nil map, which panics.
+	hook.active = nil
+
+	client.subscribe("unity/#")
+
+	payload := []byte(`{"object_name":"Cube","target_position":[1,2,3],"duration":0,"request_id":"boom"}`)
+	client.publish("unity/commands/move", payload, packets.Properties{})
+	if pk := client.next(); pk.TopicName != "unity/commands/move" || string(pk.Payload) != string(payload) {
+		t.Errorf("got %s on %s, want the command passed on unchanged", pk.Payload, pk.TopicName)
+	}
+
+	// The broker still delivers messages.
+	if err := server.Publish("unity/status", []byte("alive"), false, 0); err != nil {
+		t.Fatal(err)
+	}
+	if pk := client.next(); string(pk.Payload) != "alive" {
+		t.Errorf("got %s on %s, want alive on unity/status", pk.Payload, pk.TopicName)
+	}
+
+	// Nothing the panicking move held is kept, so a later move of the same
+	// object still runs.
+	if !hook.mu.TryLock() {
+		t.Fatal("hook mutex left locked by the panic")
+	}
+	hook.active = make(map[string]ActiveMove)
+	hook.mu.Unlock()
+
+	client.publish("unity/commands/move",
+		[]byte(`{"object_name":"Cube","target_position":[4,5,6],"duration":0,"request_id":"after"}`), packets.Properties{})
+	for {
+		pk := client.next()
+		if pk.TopicName != "unity/feedback/move_complete" {
+			continue
+		}
+		if feedback := decodeFeedback(t, pk); feedback.RequestID != "after" || feedback.Status != "success" {
+			t.Errorf("got feedback %+v, want success for request after", feedback)
+		}
+		break
+	}
+}
+
+func TestResponseTopic(t *testing.T) {
+	t.Parallel()
+	_, _, client := newMoveTestServer(t, nil)
+	client.subscribe("agent/replies")
+
+	payload := []byte(`{"object_name":"Cube","target_position":[1,2,3],"duration":0,"request_id":"reply-1"}`)
+	client.publish("unity/commands/move", payload, packets.Properties{
+		ResponseTopic:   "agent/replies",
+		CorrelationData: []byte("corr-1"),
+	})
+
+	pk := client.next()
+	if pk.TopicName != "agent/replies" {
+		t.Fatalf("feedback published to %s, want the response topic agent/replies", pk.TopicName)
+	}
+	if string(pk.Properties.CorrelationData) != "corr-1" {
+		t.Errorf("got correlation data %q, want corr-1", pk.Properties.CorrelationData)
+	}
+	feedback := decodeFeedback(t, pk)
+	if feedback.Status != "success" || feedback.RequestID != "reply-1" {
+		t.Errorf("got feedback %+v, want success for request ID reply-1", feedback)
+	}
+}
+
+func TestPriorityWaitsForObjectTurn(t *testing.T) {
+	t.Parallel()
+	_, _, client := newMoveTestServer(t, func(h *MoveCommandHook) {
+		h.pool = newWorkerPool(1, 10)
+	})
+	client.subscribe("unity/feedback/move_complete")
+
+	// While the only worker is busy, the second move of Cube has a higher
+	// priority than the first, but must still wait for it rather than take
+	// the worker and block on it.
+	order := publishMoves(t, client, 3,
+		`{"object_name":"Other","target_position":[1,0,0],"duration":0.2,"request_id":"other-1"}`,
+		`{"object_name":"Cube","target_position":[1,0,0],"duration":0,"request_id":"cube-1"}`,
+		`{"object_name":"Cube","target_position":[2,0,0],"duration":0,"request_id":"cube-2","priority":5}`,
+	)
+	if want := []string{"other-1", "cube-1", "cube-2"}; !slices.Equal(order, want) {
+		t.Errorf("got feedback in order %v, want %v", order, want)
+	}
+}
+
+func TestQueuedMovesDontHoldWorkers(t *testing.T) {
+	t.Parallel()
+	_, _, client := newMoveTestServer(t, func(h *MoveCommandHook) {
+		h.pool = newWorkerPool(2, 10)
+	})
+	client.subscribe("unity/feedback/move_complete")
+
+	// The second move of Cube waits for the first, which holds one of the
+	// two workers. The other worker must stay free for Sphere, whose
+	// feedback comes well before the first move of Cube finishes.
+	start := time.Now()
+	order := publishMoves(t, client, 1,
+		`{"object_name":"Cube","target_position":[1,0,0],"duration":0.5,"request_id":"cube-1"}`,
+		`{"object_name":"Cube","target_position":[2,0,0],"duration":0,"request_id":"cube-2"}`,
+		`{"object_name":"Sphere","target_position":[3,0,0],"duration":0,"request_id":"sphere-1"}`,
+	)
+	if order[0] != "sphere-1" || time.Since(start) > 250*time.Millisecond {
+		t.Errorf("got feedback for %s after %v, want sphere-1 without waiting for Cube", order[0], time.Since(start))
+	}
+}
+
+func TestPublishRetriesDontBlock(t *testing.T) {
+	t.Parallel()
+	_, hook, _ := newMoveTestServer(t, nil)
+	// Without the inline client every attempt fails.
+	hook.inline = nil
+
+	result := make(chan error, 1)
+	start := time.Now()
+	hook.publish("unity/feedback/move_complete", []byte("{}"), 0, false, replyContext{}, func(err error) {
+		result <- err
+	})
+	if elapsed := time.Since(start); elapsed >= publishBackoff {
+		t.Errorf("publish took %v, want the retries left to a goroutine", elapsed)
+	}
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, mqtt.ErrInlineClientNotEnabled) {
+			t.Errorf("got error %v, want the last attempt's", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no result after every attempt failed")
+	}
+}
+
+func TestMoveBatchValidation(t *testing.T) {
+	t.Parallel()
+	_, _, client := newMoveTestServer(t, func(h *MoveCommandHook) {
+		h.batchCommandTopic = "unity/commands/move_batch"
+		h.batchFeedbackTopic = "unity/feedback/move_batch_complete"
+	})
+	client.subscribe("unity/feedback/+")
+
+	client.publish("unity/commands/move_batch", []byte(`[]`), packets.Properties{})
+	if pk := client.next(); pk.TopicName != "unity/feedback/errors" {
+		t.Errorf("got %s on %s for an empty batch, want a dead letter", pk.Payload, pk.TopicName)
+	}
+
+	client.publish("unity/commands/move_batch", []byte(`[`+
+		`{"object_name":"Cube","target_position":[1,0,0],"duration":0,"request_id":"dup","batch_id":"b-1"},`+
+		`{"object_name":"Sphere","target_position":[2,0,0],"duration":0,"request_id":"dup","batch_id":"b-1"},`+
+		`{"object_name":"Sphere","target_position":[3,0,0],"duration":0,"batch_id":"b-1"},`+
+		`{"object_name":"Cone","target_position":[4,0,0],"duration":0,"request_id":"","batch_id":"b-1"}]`), packets.Properties{})
+	var batch BatchCompletionFeedback
+	for batch.BatchID == "" {
+		pk := client.next()
+		if pk.TopicName != "unity/feedback/move_batch_complete" {
+			continue
+		}
+		if err := json.Unmarshal(pk.Payload, &batch); err != nil {
+			t.Fatalf("invalid batch feedback %s: %v", pk.Payload, err)
+		}
+	}
+	if batch.Status != "partial" || len(batch.Results) != 4 {
+		t.Fatalf("got batch feedback %+v, want a partial result for all four commands", batch)
+	}
+	for i, r := range batch.Results[1:] {
+		if r.Status != "rejected" || r.Field != "request_id" {
+			t.Errorf("got %+v for command %d, want it rejected for its request ID", r, i+2)
+		}
+	}
+}
+
+func TestMoveRequestIDs(t *testing.T) {
+	t.Parallel()
+	_, hook, client := newMoveTestServer(t, nil)
+	client.subscribe("unity/feedback/move_complete")
+
+	client.publish("unity/commands/move",
+		[]byte(`{"object_name":"Cube","target_position":[1,0,0],"duration":0}`), packets.Properties{})
+	if feedback := decodeFeedback(t, client.next()); feedback.Status != "invalid_request_id" || feedback.Field != "request_id" {
+		t.Errorf("got feedback %+v for a move without a request ID, want it rejected", feedback)
+	}
+
+	// The move of Sphere reuses the request ID of the move of Cube while it
+	// is still in flight, so is rejected rather than taking over its entry.
+	client.publish("unity/commands/move",
+		[]byte(`{"object_name":"Cube","target_position":[1,0,0],"duration":0.2,"request_id":"same"}`), packets.Properties{})
+	client.publish("unity/commands/move",
+		[]byte(`{"object_name":"Sphere","target_position":[2,0,0],"duration":0,"request_id":"same"}`), packets.Properties{})
+	if feedback := decodeFeedback(t, client.next()); feedback.ObjectName != "Sphere" || feedback.Status != "rejected" || feedback.Field != "request_id" {
+		t.Errorf("got feedback %+v, want the move of Sphere rejected", feedback)
+	}
+	if moves := hook.ActiveMoves(); len(moves) != 1 || moves[0].ObjectName != "Cube" {
+		t.Errorf("got in-flight moves %+v, want only the move of Cube", moves)
+	}
+	if feedback := decodeFeedback(t, client.next()); feedback.ObjectName != "Cube" || feedback.Status != "success" {
+		t.Errorf("got feedback %+v, want success for the move of Cube", feedback)
+	}
+}
+
+func TestMoveBatchGlobalRate(t *testing.T) {
+	t.Parallel()
+	_, _, client := newMoveTestServer(t, func(h *MoveCommandHook) {
+		h.batchCommandTopic = "unity/commands/move_batch"
+		h.batchFeedbackTopic = "unity/feedback/move_batch_complete"
+		h.globalLimiter = newRateLimiter(0.001, 2)
+	})
+	client.subscribe("unity/feedback/move_batch_complete")
+
+	// The first batch takes the whole budget, so none of the second's moves
+	// are simulated.
+	for _, want := range [][]string{{"success", "success", "server_busy"}, {"server_busy", "server_busy"}} {
+		var moves []string
+		for i := range want {
+			moves = append(moves, fmt.Sprintf(`{"object_name":"Cube%d","target_position":[1,0,0],"duration":0,"request_id":"r-%d-%d","batch_id":"b-%d"}`,
+				i, len(want), i, len(want)))
+		}
+		client.publish("unity/commands/move_batch", []byte("["+strings.Join(moves, ",")+"]"), packets.Properties{})
+
+		var batch BatchCompletionFeedback
+		if err := json.Unmarshal(client.next().Payload, &batch); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, r := range batch.Results {
+			got = append(got, r.Status)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("got batch %s results %v, want %v", batch.BatchID, got, want)
+		}
+	}
+}
+
+func TestMoveBatchClientRate(t *testing.T) {
+	t.Parallel()
+	_, _, client := newMoveTestServer(t, func(h *MoveCommandHook) {
+		h.batchCommandTopic = "unity/commands/move_batch"
+		h.batchFeedbackTopic = "unity/feedback/move_batch_complete"
+		h.limiter = newRateLimiter(0.001, 1)
+	})
+	client.subscribe("unity/feedback/+")
+
+	// A client over its limit can't move objects by wrapping each move in a
+	// batch of its own.
+	client.publish("unity/commands/move",
+		[]byte(`{"object_name":"Cube","target_position":[1,0,0],"duration":0,"request_id":"single"}`), packets.Properties{})
+	if feedback := decodeFeedback(t, client.next()); feedback.Status != "success" {
+		t.Fatalf("got feedback %+v, want success for the first move", feedback)
+	}
+	client.publish("unity/commands/move_batch",
+		[]byte(`[{"object_name":"Cube","target_position":[2,0,0],"duration":0,"request_id":"wrapped","batch_id":"b-1"}]`), packets.Properties{})
+	var batch BatchCompletionFeedback
+	if err := json.Unmarshal(client.next().Payload, &batch); err != nil {
+		t.Fatal(err)
+	}
+	if len(batch.Results) != 1 || batch.Results[0].Status != "rate_limited" {
+		t.Errorf("got batch results %+v, want the move rate limited", batch.Results)
+	}
+}
+
+func TestDryRunOversize(t *testing.T) {
+	t.Parallel()
+	_, hook, client := newMoveTestServer(t, func(h *MoveCommandHook) {
+		h.dryRun = true
+		h.maxPayload = 64
+	})
+	client.subscribe("unity/feedback/+")
+
+	client.publish("unity/commands/move",
+		[]byte(`{"request_id":"big-1","object_name":"Cube","target_position":[0,5,0],"duration":0.1}`), packets.Properties{})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		hook.dryRunResults.mu.Lock()
+		n := hook.dryRunResults.counts["payload_too_large"]
+		hook.dryRunResults.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d oversize commands counted, want 1", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case pk := <-client.messages:
+		t.Errorf("unexpected feedback on %s in dry-run mode: %s", pk.TopicName, pk.Payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// echoCommand is a CommandHandler answering commands on echo/commands with
+// feedback holding their payload.
+type echoCommand struct {
+	hook *MoveCommandHook
+}
+
+func (e echoCommand) Match(topic string) bool {
+	return topic == "echo/commands"
+}
+
+func (e echoCommand) Kind() string {
+	return "echo"
+}
+
+func (e echoCommand) Handle(cl *mqtt.Client, pk packets.Packet) (*CommandFeedback, error) {
+	if len(pk.Payload) == 0 {
+		return nil, errors.New("empty echo command")
+	}
+	return &CommandFeedback{
+		Topic:     "echo/feedback",
+		Payload:   map[string]string{"echo": string(pk.Payload), "status": "success"},
+		RequestID: "echo-1",
+		Status:    "success",
+		Reply:     e.hook.replyContext(cl, pk),
+	}, nil
+}
+
+func TestRegisteredHandlerFeedback(t *testing.T) {
+	t.Parallel()
+	_, _, client := newMoveTestServer(t, func(h *MoveCommandHook) {
+		h.Register(echoCommand{hook: h})
+	})
+	client.subscribe("echo/feedback")
+
+	client.publish("echo/commands", []byte("hello"), packets.Properties{})
+	pk := client.next()
+	var feedback map[string]string
+	if err := json.Unmarshal(pk.Payload, &feedback); err != nil {
+		t.Fatal(err)
+	}
+	if feedback["echo"] != "hello" {
+		t.Errorf("got feedback %s, want the echoed payload hello", pk.Payload)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import mqtt "github.com/mochi-mqtt/server/v2"
+
+// setInlineClientID renames the server's inline client, which mochi always
+// creates as "inline", so the messages the bridge publishes itself are
+// attributable in logs. It must be called before the hooks are added.
+func setInlineClientID(server *mqtt.Server, id string) {
+	cl := inlineClient(server)
+	if cl == nil || cl.ID == id {
+		return
+	}
+	server.Clients.Delete(cl.ID)
+	cl.ID = id
+	server.Clients.Add(cl)
+}
+
+// inlineClient returns the server's inline client, or nil if it has none.
+func inlineClient(server *mqtt.Server) *mqtt.Client {
+	for _, cl := range server.Clients.GetAll() {
+		if cl.Net.Inline {
+			return cl
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import "sync"
+
+// logSampler decides which routine per-message log lines are written, so
+// logs stay readable at high command rates. Each message is sampled on its
+// own, so a burst of feedback doesn't crowd out the commands that caused it.
+type logSampler struct {
+	every int // Write 1 in every lines of each message, 0 for none
+
+	mu     sync.Mutex
+	counts map[string]int // Lines seen, keyed on message
+}
+
+// newLogSampler returns a sampler writing 1 in every lines of each message,
+// or nil to write them all when every is 1.
+func newLogSampler(every int) *logSampler {
+	if every == 1 {
+		return nil
+	}
+	return &logSampler{every: every, counts: make(map[string]int)}
+}
+
+// sample reports whether the next line of msg should be written.
+func (s *logSampler) sample(msg string) bool {
+	if s == nil {
+		return true
+	}
+	if s.every == 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.counts[msg]
+	s.counts[msg] = n + 1
+	return n%s.every == 0
+}
+
+// logSampled writes a routine info-level log line, such as a command being
+// received or feedback published, if the sampler picks it. Rejections and
+// errors are logged directly, so they are never sampled away.
+func (h *MoveCommandHook) logSampled(msg string, args ...any) {
+	if !h.logSample.sample(msg) {
+		return
+	}
+	if h.logSample != nil {
+		args = append(args, "log_sample", h.logSample.every)
+	}
+	h.Log.Info(msg, args...)
+}
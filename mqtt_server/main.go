@@ -1,219 +1,615 @@
 package main
 
 import (
-	"encoding/json"
-	//"fmt"
-	"log"
-	//"math/rand"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	mqtt "github.com/mochi-mqtt/server/v2"
 	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/hooks/storage/bolt"
 	"github.com/mochi-mqtt/server/v2/listeners"
-	"github.com/mochi-mqtt/server/v2/packets"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
 )
 
-// YearlyYield represents the structure for our yearly yield data.
-type YearlyYield struct {
-	Year  int     `json:"year"`
-	Yield float64 `json:"yield"`
+var (
+	configPath  = flag.String("config", "", "path to a YAML or JSON config file")
+	mqttAddr    = flag.String("mqtt-addr", DefaultConfig().MQTTAddr, "address of the plaintext MQTT listener")
+	httpAddr    = flag.String("http-addr", DefaultConfig().HTTPAddr, "address of the HTTP API server")
+	maxClients  = flag.Int("max-clients", DefaultConfig().MaxClients, "number of connected MQTT clients above which new clients are refused, 0 for no limit")
+	corsOrigins = flag.String("cors-origins", strings.Join(DefaultConfig().CORSOrigins, ","), "comma-separated origins browsers may call the HTTP API from, * for any")
+	wsAddr      = flag.String("ws-addr", DefaultConfig().WSAddr, "address of the MQTT over WebSocket listener")
+	wsPath      = flag.String("ws-path", DefaultConfig().WSPath, "HTTP path the WebSocket listener is mounted at")
+	simulate    = flag.Bool("simulate", false, "publish simulated sensor readings")
+	dryRun      = flag.Bool("dry-run", false, "validate and log move commands without publishing feedback")
+	logFormat   = flag.String("log-format", "text", "log output format, text or json")
+	historyFile = flag.String("history-file", "", "JSONL file to append move command history to")
+	storeFile   = flag.String("store-file", "", "file to persist retained messages and sessions to, instead of keeping them in memory")
+	yieldsFile  = flag.String("yields-file", "", "JSON file /yearly_yields is served from")
+	authFile    = flag.String("auth-file", "", "YAML or JSON auth ledger of client credentials and topic ACLs")
+	replayFile  = flag.String("replay", "", "move history file whose commands are re-published once serving")
+	replaySpeed = flag.Float64("replay-speed", 1, "how many times faster than recorded to replay commands, 0 for no delays")
+	webroot     = flag.String("webroot", "", "directory of static files, such as a dashboard, served at / by the HTTP server")
+	lenient     = flag.Bool("lenient", false, "skip listeners with duplicate IDs instead of refusing to start")
+	mqttOnly    = flag.Bool("mqtt-only-on-http-error", false, "keep serving MQTT if the HTTP or gRPC server fails, instead of shutting down")
+)
+
+// apiServeError is an error serving the HTTP API or gRPC, which the broker
+// can keep running without.
+type apiServeError struct {
+	server string // "HTTP" or "gRPC"
+	err    error
 }
 
-// MoveCommand matches the JSON structure sent from the LLM agent
-type MoveCommand struct {
-	ObjectName     string    `json:"object_name"`
-	TargetPosition []float64 `json:"target_position"`
-	Duration       float64   `json:"duration"`
-	RequestID      string    `json:"request_id"`
+func (e *apiServeError) Error() string {
+	return e.server + " server: " + e.err.Error()
 }
 
-// MoveCompletionFeedback matches the JSON structure for feedback to the LLM agent
-type MoveCompletionFeedback struct {
-	ObjectName    string    `json:"object_name"`
-	FinalPosition []float64 `json:"final_position"`
-	Status        string    `json:"status"`
-	Timestamp     string    `json:"timestamp"`
-	RequestID     string    `json:"request_id"`
+func (e *apiServeError) Unwrap() error {
+	return e.err
 }
 
-// MoveCommandHook is a custom hook to process move commands and send feedback.
-type MoveCommandHook struct {
-	mqtt.HookBase
-	server *mqtt.Server // Reference to the MQTT server to publish messages
+// httpShutdownTimeout is how long in-flight HTTP requests are given to finish on shutdown.
+const httpShutdownTimeout = 10 * time.Second
+
+// newLogger returns a logger writing text or JSON records to stdout.
+func newLogger(format string) (*slog.Logger, error) {
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, nil)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, nil)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
 }
 
-// ID returns the ID of the hook.
-func (h *MoveCommandHook) ID() string {
-	return "MoveCommandHook"
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
-// Provides indicates the methods that the hook provides.
-func (h *MoveCommandHook) Provides(p byte) bool {
-	return p == mqtt.OnPublish
+// uniqueListeners returns ls without listeners whose ID is already used by an
+// earlier one, which mochi refuses to add. A duplicate is fatal unless
+// lenient is set, when it is skipped with a warning, so a templated config
+// with a clashing ID still starts.
+func uniqueListeners(ls []listeners.Listener, lenient bool) []listeners.Listener {
+	var unique []listeners.Listener
+	seen := make(map[string]listeners.Listener)
+	for _, l := range ls {
+		if first, ok := seen[l.ID()]; ok {
+			if !lenient {
+				fatal("duplicate listener ID, give each listener its own or pass -lenient to skip the duplicate",
+					"id", l.ID(), "address", first.Address(), "duplicate_address", l.Address())
+			}
+			slog.Warn("skipping listener with duplicate ID", "id", l.ID(), "address", l.Address(),
+				"kept_address", first.Address())
+			continue
+		}
+		seen[l.ID()] = l
+		unique = append(unique, l)
+	}
+	return unique
 }
 
-// OnPublish is called when a PUBLISH packet is received.
-func (h *MoveCommandHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
-	if pk.TopicName == "unity/commands/move" {
-		log.Printf("Received move command on topic %s from client %s: %s", pk.TopicName, cl.ID, string(pk.Payload))
+// Bridge statuses published to the status topic.
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+// publishStatus publishes a retained bridge status to topic, if one is
+// configured.
+func publishStatus(server *mqtt.Server, topic, status string) {
+	if topic == "" {
+		return
+	}
+	if err := server.Publish(topic, []byte(status), true, 1); err != nil {
+		slog.Error("failed to publish bridge status", "topic", topic, "status", status, "error", err)
+		return
+	}
+	slog.Info("published bridge status", "topic", topic, "status", status)
+}
 
-		var cmd MoveCommand
-		if err := json.Unmarshal(pk.Payload, &cmd); err != nil {
-			log.Printf("Error unmarshalling move command: %v", err)
-			return pk, nil // Continue processing, but don't send feedback for malformed command
+// clearRetained removes the retained messages on topics matching each of
+// filters, by publishing an empty retained message to each, so clients
+// don't see stale readings once the broker is gone.
+func clearRetained(server *mqtt.Server, filters []string) {
+	for _, filter := range filters {
+		for _, pk := range server.Topics.Messages(filter) {
+			if err := server.Publish(pk.TopicName, nil, true, 0); err != nil {
+				slog.Error("failed to clear retained message", "topic", pk.TopicName, "error", err)
+				continue
+			}
+			slog.Info("cleared retained message", "topic", pk.TopicName, "filter", filter)
 		}
+	}
+}
 
-		// In a real scenario, you'd forward this command to Unity or a game server.
-		// For this example, we immediately simulate completion and send feedback.
-		log.Printf("Simulating move completion for object '%s' to %v (Request ID: %s)",
-			cmd.ObjectName, cmd.TargetPosition, cmd.RequestID)
+// retireRetained clears the retained messages matching filters and then
+// publishes the offline bridge status to statusTopic, in that order so a
+// filter matching the status topic doesn't clear the offline status too.
+func retireRetained(server *mqtt.Server, statusTopic string, filters []string) {
+	clearRetained(server, filters)
+	publishStatus(server, statusTopic, statusOffline)
+}
 
-		// Prepare feedback message
-		feedback := MoveCompletionFeedback{
-			ObjectName:    cmd.ObjectName,
-			FinalPosition: cmd.TargetPosition, // Assuming it reaches the target
-			Status:        "success",
-			Timestamp:     time.Now().Format(time.RFC3339),
-			RequestID:     cmd.RequestID,
+// splitList splits a comma-separated flag value, dropping empty elements.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
 		}
+	}
+	return list
+}
 
-		feedbackPayload, err := json.Marshal(feedback)
-		if err != nil {
-			log.Printf("Error marshalling feedback payload: %v", err)
-			return pk, nil
+// applyFlags overrides cfg with any flags explicitly set on the command line,
+// so they take precedence over the config file.
+func applyFlags(cfg *Config) {
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "mqtt-addr":
+			cfg.MQTTAddr = *mqttAddr
+		case "http-addr":
+			cfg.HTTPAddr = *httpAddr
+		case "max-clients":
+			cfg.MaxClients = *maxClients
+		case "cors-origins":
+			cfg.CORSOrigins = splitList(*corsOrigins)
+		case "ws-addr":
+			cfg.WSAddr = *wsAddr
+		case "ws-path":
+			cfg.WSPath = *wsPath
+		case "history-file":
+			cfg.HistoryFile = *historyFile
+		case "store-file":
+			cfg.StoreFile = *storeFile
+		case "yields-file":
+			cfg.YieldsFile = *yieldsFile
+		case "auth-file":
+			cfg.AuthFile = *authFile
 		}
+	})
+}
+
+func main() {
+	flag.Parse()
+
+	logger, err := newLogger(*logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fatal("failed to load config", "error", err)
+	}
+	if *configPath != "" {
+		slog.Info("loaded config", "path", *configPath)
+	}
 
-		// Publish the completion feedback
-		if err := h.server.Publish("unity/feedback/move_complete", feedbackPayload, false, 0); err != nil {
-			log.Printf("Error publishing move completion feedback: %v", err)
-		} else {
-			log.Printf("Published move completion feedback for Request ID %s", cmd.RequestID)
+	// Read the session to replay up front, so a bad file stops startup.
+	var replay []HistoryRecord
+	if *replayFile != "" {
+		if !(*replaySpeed >= 0) {
+			fatal("invalid replay speed, expected 0 or more", "replay_speed", *replaySpeed)
+		}
+		if replay, err = readReplay(*replayFile); err != nil {
+			fatal("failed to read replay file", "error", err)
 		}
+		slog.Info("loaded replay file", "path", *replayFile, "commands", len(replay))
 	}
-	return pk, nil
-}
 
-func main() {
-	// Create a channel to receive OS signals.
+	// Create channels to receive shutdown and reload signals.
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
 
 	// Create a new MQTT server with inline client enabled.
 	server := mqtt.New(&mqtt.Options{
 		InlineClient: true,
+		Logger:       logger,
 	})
+	setInlineClientID(server, cfg.InlineClientID)
+
+	// Enforce the auth ledger if one is configured, otherwise allow all
+	// connections. Either way, subscriptions to root wildcards may be
+	// rejected.
+	wildcards := wildcardPolicy{rejectRootWildcards: cfg.RejectRootWildcards}
+	var ledger *auth.Ledger
+	if cfg.AuthFile != "" {
+		ledger, err = loadAuthLedger(cfg.AuthFile)
+		if err != nil {
+			fatal("failed to load auth file", "error", err)
+		}
+		aclHook := &ACLHook{wildcardPolicy: wildcards}
+		if err := server.AddHook(aclHook, &auth.Options{Ledger: ledger}); err != nil {
+			fatal("failed to add hook", "hook", "auth-ledger", "error", err)
+		}
+		slog.Info("loaded auth file", "path", cfg.AuthFile)
+	} else {
+		_ = server.AddHook(&AllowHook{wildcardPolicy: wildcards}, nil)
+	}
+	_ = server.AddHook(new(SubscriptionHook), nil)
 
-	// Allow all connections.
-	_ = server.AddHook(new(auth.AllowHook), nil)
+	// Count messages per topic for the /topics endpoint.
+	topicHook := new(TopicHook)
+	if err := server.AddHook(topicHook, nil); err != nil {
+		fatal("failed to add hook", "hook", topicHook.ID(), "error", err)
+	}
 
-	// Add the custom MoveCommandHook
-	moveHook := &MoveCommandHook{server: server}
-	err := server.AddHook(moveHook, nil)
-	if err != nil {
-		log.Fatal(err)
+	// Persist retained messages and sessions across restarts, if enabled.
+	// Stored data is restored when the server starts serving.
+	if cfg.StoreFile != "" {
+		persistHook := new(bolt.Hook)
+		if err := server.AddHook(persistHook, &bolt.Options{Path: cfg.StoreFile}); err != nil {
+			fatal("failed to add hook", "hook", persistHook.ID(), "error", err)
+		}
+		slog.Info("persisting retained messages and sessions", "path", cfg.StoreFile)
 	}
 
-	// Create a TCP listener on a standard port.
-	mqtt := listeners.NewTCP(listeners.Config{
-		ID:      "mqtt",
-		Type:    "mqtt",
-		Address: ":1883",
-	})
-	err = server.AddListener(mqtt)
+	// Open the move history log, if enabled.
+	var history *MoveHistory
+	if cfg.HistoryFile != "" {
+		history, err = NewMoveHistory(cfg.HistoryFile, cfg.HistoryMaxBytes)
+		if err != nil {
+			fatal("failed to open move history", "error", err)
+		}
+		slog.Info("recording move history", "path", cfg.HistoryFile)
+	}
 
+	// Log clients joining and leaving, count them for /healthz, and
+	// disconnect clients which stop sending keepalives.
+	connHook := &ConnectionHook{
+		server:              server,
+		maxClients:          cfg.MaxClients,
+		keepaliveMultiplier: cfg.KeepaliveMultiplier,
+		maxPacketBytes:      cfg.MaxPacketBytes,
+		maxRetainedBytes:    cfg.MaxRetainedBytes,
+		rejectionTopic:      cfg.RetainedRejectionTopic,
+	}
+	if err := server.AddHook(connHook, nil); err != nil {
+		fatal("failed to add hook", "hook", connHook.ID(), "error", err)
+	}
+
+	// Add the custom MoveCommandHook, which also pushes feedback to
+	// WebSocket clients of /ws/feedback.
+	broadcaster := NewFeedbackBroadcaster()
+	serving := make(serveGate)
+	moveHook := newMoveCommandHook(server, cfg, history, serving, broadcaster)
+	moveHooks := []*MoveCommandHook{moveHook}
+	for _, spec := range cfg.CommandHandlers {
+		handler := newMoveCommandHook(server, spec.config(cfg), history, serving, broadcaster)
+		handler.name = spec.Name
+		moveHooks = append(moveHooks, handler)
+	}
+	if cfg.CommandSchemaFile != "" {
+		schema, err := loadSchema(cfg.CommandSchemaFile)
+		if err != nil {
+			fatal("failed to load command schema", "error", err)
+		}
+		for _, h := range moveHooks {
+			h.SetSchema(schema)
+		}
+		slog.Info("loaded command schema", "path", cfg.CommandSchemaFile)
+	}
+	if cfg.RotateCommandTopic != "" {
+		moveHook.Register(NewRotateCommandHandler(moveHook, cfg.RotateCommandTopic, cfg.RotateFeedbackTopic))
+	}
+	if cfg.SpawnCommandTopic != "" {
+		spawn, despawn := NewSpawnCommandHandlers(moveHook, cfg.SpawnCommandTopic, cfg.SpawnFeedbackTopic,
+			cfg.DespawnCommandTopic, cfg.DespawnFeedbackTopic)
+		moveHook.Register(spawn)
+		moveHook.Register(despawn)
+	}
+	tracer, err := newTracer(cfg.TracingEndpoint)
 	if err != nil {
-		log.Fatal(err)
+		fatal("failed to start tracing", "error", err)
+	}
+	if tracer != nil {
+		slog.Info("exporting move command traces", "endpoint", cfg.TracingEndpoint)
+	}
+	globalLimiter := newRateLimiter(cfg.GlobalRate, cfg.GlobalBurst)
+	for _, h := range moveHooks {
+		h.tracer = tracer
+		h.globalLimiter = globalLimiter
+		if err := server.AddHook(h, nil); err != nil {
+			fatal("failed to add hook", "hook", h.ID(), "error", err)
+		}
+	}
+	if len(cfg.CommandHandlers) > 0 {
+		slog.Info("serving extra command handlers", "handlers", len(cfg.CommandHandlers))
+	}
+	if *dryRun {
+		slog.Warn("dry run, move commands are validated but get no feedback")
 	}
 
-	// Start the server
+	// Serve MQTTS when a certificate is configured, plaintext MQTT otherwise.
+	tlsConfig, err := loadTLSConfig()
+	if err != nil {
+		fatal("failed to load TLS config", "error", err)
+	}
+	listenAddr := cfg.MQTTAddr
+	if tlsConfig != nil {
+		listenAddr = cfg.MQTTTLSAddr
+		slog.Info("TLS enabled, serving MQTTS", "address", listenAddr)
+	} else {
+		slog.Info("TLS not configured, serving plaintext MQTT", "address", listenAddr)
+	}
+
+	// Create a TCP listener on a standard port, and a WebSocket listener for
+	// browser dashboards and Unity WebGL builds which can't speak raw MQTT.
+	tcp := listeners.NewTCP(listeners.Config{
+		ID:        cfg.MQTTListenerID,
+		Type:      "mqtt",
+		Address:   listenAddr,
+		TLSConfig: tlsConfig,
+	})
+	ws := NewWebsocketListener(cfg.WSListenerID, cfg.WSAddr, cfg.WSPath)
+
+	// Keep running if only one of the listeners fails to bind.
+	var added int
+	for _, l := range uniqueListeners([]listeners.Listener{tcp, ws}, *lenient) {
+		if err := server.AddListener(l); err != nil {
+			slog.Error("failed to add listener", "listener", l.ID(), "address", l.Address(), "error", err)
+			continue
+		}
+		added++
+	}
+	if added == 0 {
+		fatal("no listeners could be started")
+	}
+
+	// Start the server. Serve errors, from the broker or the HTTP and gRPC
+	// servers, are reported to the main loop, so the servers and broker are
+	// still shut down in an orderly way. There is room for an error from each.
+	state := new(brokerState)
+	serveErrs := make(chan error, 3)
 	go func() {
-		err := server.Serve()
-		if err != nil {
-			log.Fatal(err)
+		if err := server.Serve(); err != nil {
+			serveErrs <- err
+			return
 		}
+		close(serving)
+		state.setServing(true)
+		publishStatus(server, cfg.StatusTopic, statusOnline)
 	}()
 
-	// Start a goroutine to publish random data.
-	// go func() {
-	// 	ticker := time.NewTicker(5 * time.Second)
-	// 	defer ticker.Stop()
-	// 	for {
-	// 		<-ticker.C
-	// 		// Publish to sludge_pool topics
-	// 		ammonia := rand.Float64() * 100
-	// 		nitrate := rand.Float64() * 100
-	// 		phosphate := rand.Float64() * 100
-	// 		chlorine := rand.Float64() * 100
-	// 		iron := rand.Float64() * 100
-	// 		if err := server.Publish("sludge_pool/ammonia", []byte(fmt.Sprintf("%.2f", ammonia)), false, 0); err != nil {
-	// 			log.Printf("error publishing to sludge_pool/ammonia: %v", err)
-	// 		} else {
-	// 			log.Printf("Published to sludge_pool/ammonia: %.2f", ammonia)
-	// 		}
-
-	// 		if err := server.Publish("sludge_pool/nitrate", []byte(fmt.Sprintf("%.2f", nitrate)), false, 0); err != nil {
-	// 			log.Printf("error publishing to sludge_pool/nitrate: %v", err)
-	// 		} else {
-	// 			log.Printf("Published to sludge_pool/nitrate: %.2f", nitrate)
-	// 		}
-
-	// 		if err := server.Publish("sludge_pool/phosphate", []byte(fmt.Sprintf("%.2f", phosphate)), false, 0); err != nil {
-	// 			log.Printf("error publishing to sludge_pool/phosphate: %v", err)
-	// 		} else {
-	// 			log.Printf("Published to sludge_pool/phosphate: %.2f", phosphate)
-	// 		}
-
-	// 		// Publish to chemical_tank
-
-	// 		if err := server.Publish("chemical_tank/ammonia", []byte(fmt.Sprintf("%.2f", ammonia)), false, 0); err != nil {
-	// 			log.Printf("error publishing to chemical_tank/ammonia: %v", err)
-	// 		} else {
-	// 			log.Printf("Published to chemical_tank/ammonia: %.2f", ammonia)
-	// 		}
-
-	// 		if err := server.Publish("chemical_tank/iron", []byte(fmt.Sprintf("%.2f", iron)), false, 0); err != nil {
-	// 			log.Printf("error publishing to chemical_tank/iron: %v", err)
-	// 		} else {
-	// 			log.Printf("Published to chemical_tank/iron: %.2f", iron)
-	// 		}
-
-	// 		if err := server.Publish("chemical_tank/chlorine", []byte(fmt.Sprintf("%.2f", chlorine)), false, 0); err != nil {
-	// 			log.Printf("error publishing to chemical_tank/chlorine: %v", err)
-	// 		} else {
-	// 			log.Printf("Published to chemical_tank/chlorine: %.2f", chlorine)
-	// 		}
-	// 	}
-	// }()
+	// Publish simulated sensor readings for demos without real hardware.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	simDone := make(chan struct{})
+	var sim *SensorSimulator
+	if *simulate {
+		sim = NewSensorSimulator(server, serving, cfg.Sensors, cfg.SensorInterval)
+		go func() {
+			defer close(simDone)
+			sim.Run(ctx)
+		}()
+		slog.Info("simulating sensors", "sensors", len(cfg.Sensors), "interval", cfg.SensorInterval)
+	} else {
+		close(simDone)
+	}
+
+	// Re-issue a recorded agent session, to reproduce it for debugging.
+	if *replayFile != "" {
+		go replayCommands(ctx, moveHook, replay, *replaySpeed)
+	}
+
+	reloader := &Reloader{cfg: cfg, hook: moveHook, handlers: moveHooks[1:], ledger: ledger, sim: sim}
 
 	// Set up the HTTP endpoint.
-	http.HandleFunc("/yearly_yields", func(w http.ResponseWriter, r *http.Request) {
-		yields := []YearlyYield{
-			{Year: 2020, Yield: 25.5},
-			{Year: 2021, Yield: 26.8},
-			{Year: 2022, Yield: 28.1},
-			{Year: 2023, Yield: 27.9},
+	mux := http.NewServeMux()
+	mux.HandleFunc("/yearly_yields", handleYearlyYields(cfg.YieldsFile))
+
+	mux.HandleFunc("GET /moves/active", handleActiveMoves(moveHook))
+	mux.HandleFunc("GET /moves/history", handleMoveHistory(history))
+	mux.HandleFunc("GET /objects/{name}/position", handleObjectPosition(moveHook))
+	mux.HandleFunc("GET /healthz", handleHealthz(connHook, state))
+	mux.HandleFunc("GET /clients", handleClients(server, connHook))
+	mux.HandleFunc("GET /topics", handleTopics(server, topicHook))
+	mux.HandleFunc("GET /config", handleConfig(reloader))
+	mux.HandleFunc("GET /ws/feedback", handleFeedbackWebSocket(broadcaster, cfg.CORSOrigins))
+	mux.Handle("GET /metrics", promhttp.HandlerFor(newMetricsRegistry(server), promhttp.HandlerOpts{}))
+
+	// Serve the dashboard from the same binary if a webroot is given. The API
+	// routes are more specific, so they take precedence over its files;
+	// without one, unknown paths are 404 as before.
+	if *webroot != "" {
+		if info, err := os.Stat(*webroot); err != nil || !info.IsDir() {
+			fatal("webroot is not a directory", "path", *webroot, "error", err)
 		}
+		mux.Handle("/", http.FileServer(http.Dir(*webroot)))
+		slog.Info("serving static files", "webroot", *webroot)
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(yields)
-	})
+	// Publishing and moves go through the inline client, past the auth
+	// ledger, so they need the admin token once one is set. Without one they
+	// are open to anyone who can reach the HTTP API, which is worth a warning.
+	token := os.Getenv("MQTT_ADMIN_TOKEN")
+	if token == "" {
+		slog.Warn("MQTT_ADMIN_TOKEN is not set, so POST /publish and POST /moves are open to anyone who can reach the HTTP API")
+	}
+	mux.HandleFunc("POST /publish", handlePublish(token, server))
+	mux.HandleFunc("POST /moves", handleMoves(token, server, moveHook))
+
+	// The admin shutdown and metrics reset endpoints refuse every request
+	// until a token is set, so they can't be used on a broker nobody meant
+	// to expose them on.
+	shutdownRequests := make(chan struct{}, 1)
+	if token == "" {
+		slog.Warn("MQTT_ADMIN_TOKEN is not set, so POST /admin/shutdown and POST /metrics/reset are disabled")
+	}
+	mux.HandleFunc("POST /admin/shutdown", handleAdminShutdown(token, shutdownRequests))
+	mux.HandleFunc("POST /metrics/reset", handleMetricsReset(token))
 
 	// Start the HTTP server.
+	requests := new(requestTracker)
+	httpServer := &http.Server{
+		Addr:    cfg.HTTPAddr,
+		Handler: requests.wrap(corsHandler(cfg.CORSOrigins, mux)),
+	}
 	go func() {
-		log.Println("HTTP server started on :8080")
-		if err := http.ListenAndServe(":8080", nil); err != nil {
-			log.Fatalf("could not start HTTP server: %v", err)
+		slog.Info("HTTP server started", "address", cfg.HTTPAddr)
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErrs <- &apiServeError{server: "HTTP", err: err}
 		}
 	}()
 
-	// Wait for a signal to gracefully shut down the server.
-	log.Println("MQTT Server started on :1883")
-	<-sigs
-	log.Println("Shutting down server...")
+	// Start the gRPC server, for agents preferring typed clients to MQTT. It
+	// shares the MQTTS certificate, and client CAs if set, or is plaintext
+	// without TLS.
+	var grpcServer *grpc.Server
+	if cfg.GRPCAddr != "" {
+		grpcServer = newGRPCServer(server, moveHook, tlsConfig.Clone())
+		go func() {
+			lis, err := net.Listen("tcp", cfg.GRPCAddr)
+			if err != nil {
+				serveErrs <- &apiServeError{server: "gRPC", err: err}
+				return
+			}
+			slog.Info("gRPC server started", "address", cfg.GRPCAddr, "tls", tlsConfig != nil)
+			if err := grpcServer.Serve(lis); err != nil {
+				serveErrs <- &apiServeError{server: "gRPC", err: err}
+			}
+		}()
+	}
+
+	// Reload the config on SIGHUP until a signal to gracefully shut down
+	// the server, or an error serving.
+	slog.Info("MQTT server started", "address", listenAddr, "ws_address", cfg.WSAddr, "ws_path", cfg.WSPath)
+	exitCode := 0
+	for running := true; running; {
+		select {
+		case <-hups:
+			slog.Info("reloading config")
+			if err := reloader.Reload(); err != nil {
+				slog.Error("failed to reload config, keeping the current config", "error", err)
+			}
+		case <-sigs:
+			running = false
+		case <-shutdownRequests:
+			running = false
+		case err := <-serveErrs:
+			var apiErr *apiServeError
+			if errors.As(err, &apiErr) && *mqttOnly {
+				slog.Error("failed to serve, continuing with MQTT only", "error", err)
+				continue
+			}
+			slog.Error("failed to serve, shutting down", "error", err)
+			exitCode = 1
+			running = false
+		}
+	}
+	slog.Info("shutting down server")
+	cancel()
+	<-simDone
+
+	// Let in-flight moves finish and publish their feedback while clients are
+	// still connected to receive it.
+	pendingMoves, abandonedMoves := drainHooks(moveHooks, cfg.ShutdownGracePeriod)
+	slog.Info("moves drained", "drained", pendingMoves-abandonedMoves, "abandoned", abandonedMoves)
+
+	// Give in-flight HTTP requests a chance to finish before closing the
+	// broker. WebSocket connections are hijacked, so aren't closed by Shutdown.
+	broadcaster.Close()
+	pending := requests.inFlight.Load()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	if err := httpServer.Shutdown(shutdownCtx); err != nil {
+		slog.Error("HTTP server shutdown incomplete", "error", err)
+	}
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-shutdownCtx.Done():
+			slog.Error("gRPC server shutdown incomplete, closing open streams")
+			grpcServer.Stop()
+		}
+	}
+	shutdownCancel()
+	remaining := requests.inFlight.Load()
+	slog.Info("HTTP server stopped", "drained", pending-remaining, "dropped", remaining)
+
+	state.setServing(false)
+	retireRetained(server, cfg.StatusTopic, cfg.ClearRetainedOnShutdown)
 	_ = server.Close()
-	log.Println("Server gracefully stopped.")
+	tracer.close()
+	if history != nil {
+		if err := history.Close(); err != nil {
+			slog.Error("failed to close move history", "error", err)
+		}
+	}
+	if exitCode != 0 {
+		slog.Error("server stopped after an error")
+		os.Exit(exitCode)
+	}
+	slog.Info("server gracefully stopped")
+}
+
+// newMoveCommandHook returns a hook handling the move commands configured by
+// cfg, which publishes its feedback once ready is closed.
+func newMoveCommandHook(server *mqtt.Server, cfg *Config, history *MoveHistory, ready serveGate, broadcaster *FeedbackBroadcaster) *MoveCommandHook {
+	h := &MoveCommandHook{
+		server:             server,
+		commandTopic:       cfg.CommandTopic,
+		feedbackTopic:      cfg.FeedbackTopic,
+		errorTopic:         cfg.ErrorTopic,
+		batchCommandTopic:  cfg.BatchCommandTopic,
+		batchFeedbackTopic: cfg.BatchFeedbackTopic,
+		aggregateTopic:     cfg.AggregateFeedbackTopic,
+		flushInterval:      cfg.FeedbackFlushInterval,
+		cancelTopic:        cfg.CancelTopic,
+		namespace:          cfg.Namespace,
+		echoProperties:     cfg.EchoUserProperties,
+		commandEncoding:    cfg.CommandEncoding,
+		feedbackQos:        cfg.FeedbackQos,
+		maxDuration:        cfg.MaxMoveDuration,
+		maxQueueWait:       cfg.MaxQueueWait,
+		defaultDuration:    cfg.DefaultMoveDuration,
+		bounds:             cfg.Bounds,
+		boundsMode:         cfg.BoundsMode,
+		transform:          cfg.CoordinateTransform,
+		history:            history,
+		dedupWindow:        cfg.DedupWindow,
+		progressSteps:      cfg.ProgressSteps,
+		feedbackDelay:      time.Duration(cfg.FeedbackDelayMs) * time.Millisecond,
+		maxPayload:         cfg.MaxPayloadBytes,
+		failureRate:        cfg.MoveFailureRate,
+		noOpEpsilon:        cfg.NoOpEpsilon,
+		limiter:            newRateLimiter(cfg.CommandRate, cfg.CommandBurst),
+		pool:               newWorkerPool(cfg.MoveWorkers, cfg.MoveQueueSize),
+		slowThreshold:      cfg.SlowCommandThreshold,
+		logSample:          newLogSampler(cfg.PublishLogSample),
+		timestampFormat:    cfg.TimestampFormat,
+		dryRun:             *dryRun,
+		ready:              ready,
+		positionDecimals:   -1,
+		broadcaster:        broadcaster,
+		feedbackCache:      newFeedbackCache(cfg.FeedbackCacheSize, cfg.FeedbackCacheTTL),
+	}
+	if cfg.PositionDecimals != nil {
+		h.positionDecimals = *cfg.PositionDecimals
+	}
+	h.SetAllowedObjects(cfg.AllowedObjects)
+	return h
 }
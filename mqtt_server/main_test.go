@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRetireRetained(t *testing.T) {
+	t.Parallel()
+	server, _ := newTestServer(t)
+	for topic, payload := range map[string]string{
+		"system/status/mqtt_bridge": statusOnline,
+		"sensors/temperature":       "21.5",
+	} {
+		if err := server.Publish(topic, []byte(payload), true, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	retireRetained(server, "system/status/mqtt_bridge", []string{"#"})
+
+	if msgs := server.Topics.Messages("sensors/#"); len(msgs) != 0 {
+		t.Errorf("got %d retained sensor messages, want them cleared", len(msgs))
+	}
+	msgs := server.Topics.Messages("system/status/mqtt_bridge")
+	if len(msgs) != 1 || string(msgs[0].Payload) != statusOffline {
+		t.Errorf("got retained status %v, want %s", msgs, statusOffline)
+	}
+}
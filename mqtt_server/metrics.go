@@ -0,0 +1,174 @@
+package main
+
+import (
+	"sync/atomic"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// Move command metrics, updated by the MoveCommandHook.
+var (
+	moveCommandsReceived = newResettableCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_move_commands_received_total",
+		Help: "Total move commands received on the command topic.",
+	})
+	moveCommandsCompleted = newResettableCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_move_commands_completed_total",
+		Help: "Total move commands which completed successfully.",
+	})
+	moveCommandsFailed = newResettableCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_move_commands_failed_total",
+		Help: "Total move commands made to fail by the simulated failure rate.",
+	})
+	moveCommandsCancelled = newResettableCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_move_commands_cancelled_total",
+		Help: "Total move commands cancelled before they completed.",
+	})
+	moveCommandsNoOp = newResettableCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_move_commands_noop_total",
+		Help: "Total move commands answered at once because the object was already at the target.",
+	})
+	moveCommandsDuplicate = newResettableCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_move_commands_duplicate_total",
+		Help: "Total move commands ignored as retransmits of a recent request ID.",
+	})
+	feedbackDropped = newResettableCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_feedback_dropped_total",
+		Help: "Total feedback messages dropped after every publish attempt failed.",
+	})
+	feedbackReplayed = newResettableCounter(prometheus.CounterOpts{
+		Name: "mqtt_bridge_feedback_replayed_total",
+		Help: "Total cached feedback messages replayed to clients which reconnected.",
+	})
+	moveCommandsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mqtt_bridge_move_commands_rejected_total",
+		Help: "Total move commands which were rejected, by reason.",
+	}, []string{"reason"})
+	commandHandlingSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mqtt_bridge_command_handling_seconds",
+		Help:    "Time taken to parse and handle commands in OnPublish, by command type.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8), // 100µs to 1.6s
+	}, []string{"command"})
+	moveQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mqtt_bridge_move_queue_depth",
+		Help: "Number of moves waiting for a free worker.",
+	})
+)
+
+// moveCommandRate measures the move commands accepted across all clients, for
+// the mqtt_bridge_move_command_rate gauge.
+var moveCommandRate = new(rateMeter)
+
+// Connection metrics, updated by the ConnectionHook.
+var willsSent = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "mqtt_bridge_wills_sent_total",
+	Help: "Total will messages published for clients which disconnected ungracefully.",
+})
+
+var retainedRejected = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "mqtt_bridge_retained_rejected_total",
+	Help: "Total retained publishes rejected for a payload over max_retained_bytes.",
+})
+
+// newMetricsRegistry returns a registry exposing the move command metrics,
+// broker statistics from server.Info, and the standard Go runtime metrics.
+func newMetricsRegistry(server *mqtt.Server) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		moveCommandsReceived,
+		moveCommandsCompleted,
+		moveCommandsFailed,
+		moveCommandsCancelled,
+		moveCommandsNoOp,
+		moveCommandsDuplicate,
+		moveCommandsRejected,
+		commandHandlingSeconds,
+		moveQueueDepth,
+		feedbackDropped,
+		feedbackReplayed,
+		willsSent,
+		retainedRejected,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mqtt_bridge_move_command_rate",
+			Help: "Move commands per second accepted across all clients, over the last second.",
+		}, moveCommandRate.rate),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mqtt_bridge_clients_connected",
+			Help: "Number of MQTT clients currently connected.",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&server.Info.ClientsConnected))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "mqtt_bridge_messages_received_total",
+			Help: "Total PUBLISH messages received by the broker.",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&server.Info.MessagesReceived))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "mqtt_bridge_messages_sent_total",
+			Help: "Total PUBLISH messages sent by the broker.",
+		}, func() float64 {
+			return float64(atomic.LoadInt64(&server.Info.MessagesSent))
+		}),
+	)
+
+	initRejectionReasons()
+	return reg
+}
+
+// initRejectionReasons initialises the rejection reasons so alerts on their
+// rate start from zero.
+func initRejectionReasons() {
+	for _, reason := range []string{"malformed", "rejected", "invalid_object_name", "out_of_bounds", "unknown_object", "schema_invalid", "payload_too_large", "rate_limited", "busy", "stale", "server_busy"} {
+		moveCommandsRejected.WithLabelValues(reason)
+	}
+}
+
+// resettableCounter is a counter which resetMetrics can zero. Plain
+// prometheus counters can't be reset, so it is a CounterVec without labels.
+type resettableCounter struct {
+	*prometheus.CounterVec
+}
+
+// newResettableCounter returns a resettable counter starting from zero.
+func newResettableCounter(opts prometheus.CounterOpts) resettableCounter {
+	c := resettableCounter{prometheus.NewCounterVec(opts, nil)}
+	c.WithLabelValues()
+	return c
+}
+
+// Inc increments the counter by 1.
+func (c resettableCounter) Inc() {
+	c.WithLabelValues().Inc()
+}
+
+// Add adds v, which must not be negative, to the counter.
+func (c resettableCounter) Add(v float64) {
+	c.WithLabelValues().Add(v)
+}
+
+// resetMetrics zeroes the move command counters and the command handling
+// histogram, so repeated load test runs each start from zero. Gauges report
+// current state, and broker statistics belong to mochi, so they're kept.
+func resetMetrics() {
+	for _, c := range []resettableCounter{
+		moveCommandsReceived,
+		moveCommandsCompleted,
+		moveCommandsFailed,
+		moveCommandsCancelled,
+		moveCommandsNoOp,
+		moveCommandsDuplicate,
+		feedbackDropped,
+		feedbackReplayed,
+	} {
+		c.Reset()
+		c.WithLabelValues()
+	}
+	moveCommandsRejected.Reset()
+	initRejectionReasons()
+	commandHandlingSeconds.Reset()
+}
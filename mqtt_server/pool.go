@@ -0,0 +1,140 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+)
+
+// workerPool runs moves on a fixed number of goroutines, so a burst of
+// commands queues up instead of starting a goroutine per move. A nil pool
+// runs every move on its own goroutine.
+//
+// Waiting moves are handed to workers highest priority first, and in the
+// order they were submitted among equal priorities. Priority only decides
+// which move gets a free worker next: a running move is never interrupted.
+// Moves are only submitted once earlier moves of their object have finished,
+// so moves of the same object still run in the order they were received.
+type workerPool struct {
+	mu     sync.Mutex
+	ready  *sync.Cond // Signalled when a job is queued or the pool is closed
+	jobs   jobQueue
+	seq    uint64 // Submission order of the next job
+	closed bool
+
+	slots chan struct{} // Holds a token for each reserved place in the queue
+	wg    sync.WaitGroup
+}
+
+// queuedJob is a move waiting for a worker.
+type queuedJob struct {
+	run      func()
+	priority int
+	seq      uint64
+}
+
+// jobQueue is a heap of waiting jobs, highest priority and then earliest
+// submitted first.
+type jobQueue []queuedJob
+
+func (q jobQueue) Len() int { return len(q) }
+func (q jobQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q jobQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *jobQueue) Push(x any)   { *q = append(*q, x.(queuedJob)) }
+func (q *jobQueue) Pop() any {
+	old := *q
+	job := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return job
+}
+
+// newWorkerPool starts a pool of workers goroutines with room for queueSize
+// moves waiting for a worker. It returns nil if workers isn't positive.
+func newWorkerPool(workers, queueSize int) *workerPool {
+	if workers <= 0 {
+		return nil
+	}
+	p := &workerPool{
+		slots: make(chan struct{}, queueSize),
+	}
+	p.ready = sync.NewCond(&p.mu)
+	p.wg.Add(workers)
+	for range workers {
+		go p.work()
+	}
+	return p
+}
+
+// work runs jobs until the pool is closed and its queue is empty.
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for {
+		p.mu.Lock()
+		for len(p.jobs) == 0 && !p.closed {
+			p.ready.Wait()
+		}
+		if len(p.jobs) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		job := heap.Pop(&p.jobs).(queuedJob)
+		p.mu.Unlock()
+
+		<-p.slots
+		moveQueueDepth.Dec()
+		job.run()
+	}
+}
+
+// reserve claims a place in the queue, returning false if it is full. Each
+// successful reserve must be followed by one submit or release.
+func (p *workerPool) reserve() bool {
+	if p == nil {
+		return true
+	}
+	select {
+	case p.slots <- struct{}{}:
+		moveQueueDepth.Inc()
+		return true
+	default:
+		return false
+	}
+}
+
+// release gives back a place claimed by reserve which won't be submitted.
+func (p *workerPool) release() {
+	if p == nil {
+		return
+	}
+	<-p.slots
+	moveQueueDepth.Dec()
+}
+
+// submit queues job with the given priority in a place claimed by reserve.
+func (p *workerPool) submit(priority int, job func()) {
+	if p == nil {
+		go job()
+		return
+	}
+	p.mu.Lock()
+	heap.Push(&p.jobs, queuedJob{run: job, priority: priority, seq: p.seq})
+	p.seq++
+	p.mu.Unlock()
+	p.ready.Signal()
+}
+
+// close waits for the queued jobs to run and stops the workers.
+func (p *workerPool) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.ready.Broadcast()
+	p.wg.Wait()
+}
@@ -0,0 +1,323 @@
+// gRPC API of the MQTT bridge, served on grpc_addr. Generate clients from
+// this file with protoc; the messages mirror the JSON move command and
+// feedback published over MQTT. The bridge's own Go code in this directory
+// is generated by go generate, see grpc.go.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.8
+// 	protoc        (unknown)
+// source: proto/bridge.proto
+
+package bridgepb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type MoveRequest struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	ObjectName     string                 `protobuf:"bytes,1,opt,name=object_name,json=objectName,proto3" json:"object_name,omitempty"`
+	TargetPosition []float64              `protobuf:"fixed64,2,rep,packed,name=target_position,json=targetPosition,proto3" json:"target_position,omitempty"` // x, y, z
+	Duration       *float64               `protobuf:"fixed64,3,opt,name=duration,proto3,oneof" json:"duration,omitempty"`                                    // seconds
+	RequestId      string                 `protobuf:"bytes,4,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`                         // assigned by the bridge if empty
+	Speed          *float64               `protobuf:"fixed64,5,opt,name=speed,proto3,oneof" json:"speed,omitempty"`                                          // units per second, instead of duration
+	Priority       int32                  `protobuf:"varint,6,opt,name=priority,proto3" json:"priority,omitempty"`                                           // higher starts first when moves queue up
+	unknownFields  protoimpl.UnknownFields
+	sizeCache      protoimpl.SizeCache
+}
+
+func (x *MoveRequest) Reset() {
+	*x = MoveRequest{}
+	mi := &file_proto_bridge_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MoveRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MoveRequest) ProtoMessage() {}
+
+func (x *MoveRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bridge_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MoveRequest.ProtoReflect.Descriptor instead.
+func (*MoveRequest) Descriptor() ([]byte, []int) {
+	return file_proto_bridge_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *MoveRequest) GetObjectName() string {
+	if x != nil {
+		return x.ObjectName
+	}
+	return ""
+}
+
+func (x *MoveRequest) GetTargetPosition() []float64 {
+	if x != nil {
+		return x.TargetPosition
+	}
+	return nil
+}
+
+func (x *MoveRequest) GetDuration() float64 {
+	if x != nil && x.Duration != nil {
+		return *x.Duration
+	}
+	return 0
+}
+
+func (x *MoveRequest) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *MoveRequest) GetSpeed() float64 {
+	if x != nil && x.Speed != nil {
+		return *x.Speed
+	}
+	return 0
+}
+
+func (x *MoveRequest) GetPriority() int32 {
+	if x != nil {
+		return x.Priority
+	}
+	return 0
+}
+
+type MoveFeedback struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	ObjectName    string                 `protobuf:"bytes,1,opt,name=object_name,json=objectName,proto3" json:"object_name,omitempty"`
+	FinalPosition []float64              `protobuf:"fixed64,2,rep,packed,name=final_position,json=finalPosition,proto3" json:"final_position,omitempty"`
+	Status        string                 `protobuf:"bytes,3,opt,name=status,proto3" json:"status,omitempty"`
+	Timestamp     string                 `protobuf:"bytes,4,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	RequestId     string                 `protobuf:"bytes,5,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	Reason        string                 `protobuf:"bytes,6,opt,name=reason,proto3" json:"reason,omitempty"`
+	Field         string                 `protobuf:"bytes,7,opt,name=field,proto3" json:"field,omitempty"`
+	Progress      float64                `protobuf:"fixed64,8,opt,name=progress,proto3" json:"progress,omitempty"`
+	Clamped       bool                   `protobuf:"varint,9,opt,name=clamped,proto3" json:"clamped,omitempty"`
+	Duration      *float64               `protobuf:"fixed64,10,opt,name=duration,proto3,oneof" json:"duration,omitempty"`
+	Errors        []string               `protobuf:"bytes,11,rep,name=errors,proto3" json:"errors,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *MoveFeedback) Reset() {
+	*x = MoveFeedback{}
+	mi := &file_proto_bridge_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *MoveFeedback) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*MoveFeedback) ProtoMessage() {}
+
+func (x *MoveFeedback) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_bridge_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use MoveFeedback.ProtoReflect.Descriptor instead.
+func (*MoveFeedback) Descriptor() ([]byte, []int) {
+	return file_proto_bridge_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *MoveFeedback) GetObjectName() string {
+	if x != nil {
+		return x.ObjectName
+	}
+	return ""
+}
+
+func (x *MoveFeedback) GetFinalPosition() []float64 {
+	if x != nil {
+		return x.FinalPosition
+	}
+	return nil
+}
+
+func (x *MoveFeedback) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *MoveFeedback) GetTimestamp() string {
+	if x != nil {
+		return x.Timestamp
+	}
+	return ""
+}
+
+func (x *MoveFeedback) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *MoveFeedback) GetReason() string {
+	if x != nil {
+		return x.Reason
+	}
+	return ""
+}
+
+func (x *MoveFeedback) GetField() string {
+	if x != nil {
+		return x.Field
+	}
+	return ""
+}
+
+func (x *MoveFeedback) GetProgress() float64 {
+	if x != nil {
+		return x.Progress
+	}
+	return 0
+}
+
+func (x *MoveFeedback) GetClamped() bool {
+	if x != nil {
+		return x.Clamped
+	}
+	return false
+}
+
+func (x *MoveFeedback) GetDuration() float64 {
+	if x != nil && x.Duration != nil {
+		return *x.Duration
+	}
+	return 0
+}
+
+func (x *MoveFeedback) GetErrors() []string {
+	if x != nil {
+		return x.Errors
+	}
+	return nil
+}
+
+var File_proto_bridge_proto protoreflect.FileDescriptor
+
+const file_proto_bridge_proto_rawDesc = "" +
+	"\n" +
+	"\x12proto/bridge.proto\x12\x0fpfumo.bridge.v1\"\xe5\x01\n" +
+	"\vMoveRequest\x12\x1f\n" +
+	"\vobject_name\x18\x01 \x01(\tR\n" +
+	"objectName\x12'\n" +
+	"\x0ftarget_position\x18\x02 \x03(\x01R\x0etargetPosition\x12\x1f\n" +
+	"\bduration\x18\x03 \x01(\x01H\x00R\bduration\x88\x01\x01\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x04 \x01(\tR\trequestId\x12\x19\n" +
+	"\x05speed\x18\x05 \x01(\x01H\x01R\x05speed\x88\x01\x01\x12\x1a\n" +
+	"\bpriority\x18\x06 \x01(\x05R\bpriorityB\v\n" +
+	"\t_durationB\b\n" +
+	"\x06_speed\"\xd5\x02\n" +
+	"\fMoveFeedback\x12\x1f\n" +
+	"\vobject_name\x18\x01 \x01(\tR\n" +
+	"objectName\x12%\n" +
+	"\x0efinal_position\x18\x02 \x03(\x01R\rfinalPosition\x12\x16\n" +
+	"\x06status\x18\x03 \x01(\tR\x06status\x12\x1c\n" +
+	"\ttimestamp\x18\x04 \x01(\tR\ttimestamp\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x05 \x01(\tR\trequestId\x12\x16\n" +
+	"\x06reason\x18\x06 \x01(\tR\x06reason\x12\x14\n" +
+	"\x05field\x18\a \x01(\tR\x05field\x12\x1a\n" +
+	"\bprogress\x18\b \x01(\x01R\bprogress\x12\x18\n" +
+	"\aclamped\x18\t \x01(\bR\aclamped\x12\x1f\n" +
+	"\bduration\x18\n" +
+	" \x01(\x01H\x00R\bduration\x88\x01\x01\x12\x16\n" +
+	"\x06errors\x18\v \x03(\tR\x06errorsB\v\n" +
+	"\t_duration2O\n" +
+	"\x06Bridge\x12E\n" +
+	"\x04Move\x12\x1c.pfumo.bridge.v1.MoveRequest\x1a\x1d.pfumo.bridge.v1.MoveFeedback0\x01B\x1cZ\x1amqtt_server/proto;bridgepbb\x06proto3"
+
+var (
+	file_proto_bridge_proto_rawDescOnce sync.Once
+	file_proto_bridge_proto_rawDescData []byte
+)
+
+func file_proto_bridge_proto_rawDescGZIP() []byte {
+	file_proto_bridge_proto_rawDescOnce.Do(func() {
+		file_proto_bridge_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_proto_bridge_proto_rawDesc), len(file_proto_bridge_proto_rawDesc)))
+	})
+	return file_proto_bridge_proto_rawDescData
+}
+
+var file_proto_bridge_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
+var file_proto_bridge_proto_goTypes = []any{
+	(*MoveRequest)(nil),  // 0: pfumo.bridge.v1.MoveRequest
+	(*MoveFeedback)(nil), // 1: pfumo.bridge.v1.MoveFeedback
+}
+var file_proto_bridge_proto_depIdxs = []int32{
+	0, // 0: pfumo.bridge.v1.Bridge.Move:input_type -> pfumo.bridge.v1.MoveRequest
+	1, // 1: pfumo.bridge.v1.Bridge.Move:output_type -> pfumo.bridge.v1.MoveFeedback
+	1, // [1:2] is the sub-list for method output_type
+	0, // [0:1] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_proto_bridge_proto_init() }
+func file_proto_bridge_proto_init() {
+	if File_proto_bridge_proto != nil {
+		return
+	}
+	file_proto_bridge_proto_msgTypes[0].OneofWrappers = []any{}
+	file_proto_bridge_proto_msgTypes[1].OneofWrappers = []any{}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_bridge_proto_rawDesc), len(file_proto_bridge_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   2,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_proto_bridge_proto_goTypes,
+		DependencyIndexes: file_proto_bridge_proto_depIdxs,
+		MessageInfos:      file_proto_bridge_proto_msgTypes,
+	}.Build()
+	File_proto_bridge_proto = out.File
+	file_proto_bridge_proto_goTypes = nil
+	file_proto_bridge_proto_depIdxs = nil
+}
@@ -0,0 +1,135 @@
+// gRPC API of the MQTT bridge, served on grpc_addr. Generate clients from
+// this file with protoc; the messages mirror the JSON move command and
+// feedback published over MQTT. The bridge's own Go code in this directory
+// is generated by go generate, see grpc.go.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: proto/bridge.proto
+
+package bridgepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Bridge_Move_FullMethodName = "/pfumo.bridge.v1.Bridge/Move"
+)
+
+// BridgeClient is the client API for Bridge service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type BridgeClient interface {
+	// Move publishes a move command to the command topic and streams its
+	// feedback: any in_progress updates, then the final feedback, after which
+	// the stream ends.
+	Move(ctx context.Context, in *MoveRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[MoveFeedback], error)
+}
+
+type bridgeClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBridgeClient(cc grpc.ClientConnInterface) BridgeClient {
+	return &bridgeClient{cc}
+}
+
+func (c *bridgeClient) Move(ctx context.Context, in *MoveRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[MoveFeedback], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Bridge_ServiceDesc.Streams[0], Bridge_Move_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[MoveRequest, MoveFeedback]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Bridge_MoveClient = grpc.ServerStreamingClient[MoveFeedback]
+
+// BridgeServer is the server API for Bridge service.
+// All implementations must embed UnimplementedBridgeServer
+// for forward compatibility.
+type BridgeServer interface {
+	// Move publishes a move command to the command topic and streams its
+	// feedback: any in_progress updates, then the final feedback, after which
+	// the stream ends.
+	Move(*MoveRequest, grpc.ServerStreamingServer[MoveFeedback]) error
+	mustEmbedUnimplementedBridgeServer()
+}
+
+// UnimplementedBridgeServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedBridgeServer struct{}
+
+func (UnimplementedBridgeServer) Move(*MoveRequest, grpc.ServerStreamingServer[MoveFeedback]) error {
+	return status.Errorf(codes.Unimplemented, "method Move not implemented")
+}
+func (UnimplementedBridgeServer) mustEmbedUnimplementedBridgeServer() {}
+func (UnimplementedBridgeServer) testEmbeddedByValue()                {}
+
+// UnsafeBridgeServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BridgeServer will
+// result in compilation errors.
+type UnsafeBridgeServer interface {
+	mustEmbedUnimplementedBridgeServer()
+}
+
+func RegisterBridgeServer(s grpc.ServiceRegistrar, srv BridgeServer) {
+	// If the following call pancis, it indicates UnimplementedBridgeServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Bridge_ServiceDesc, srv)
+}
+
+func _Bridge_Move_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(MoveRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BridgeServer).Move(m, &grpc.GenericServerStream[MoveRequest, MoveFeedback]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Bridge_MoveServer = grpc.ServerStreamingServer[MoveFeedback]
+
+// Bridge_ServiceDesc is the grpc.ServiceDesc for Bridge service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Bridge_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pfumo.bridge.v1.Bridge",
+	HandlerType: (*BridgeServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Move",
+			Handler:       _Bridge_Move_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "proto/bridge.proto",
+}
@@ -0,0 +1,62 @@
+package main
+
+import "sync"
+
+// objectQueue orders the moves of each object, so a move only starts once the
+// previous move of the same object has finished, while moves of different
+// objects run concurrently.
+type objectQueue struct {
+	mu    sync.Mutex
+	tails map[string]chan struct{} // Closed when the last queued move of each object finishes, keyed on object name
+}
+
+// moveTurn is a move's place in its object's queue.
+type moveTurn struct {
+	queue  *objectQueue
+	object string
+	ready  <-chan struct{} // Closed when the move may start
+	done   chan struct{}   // Closed by finish to let the next move start
+}
+
+// closedChan is a ready channel for moves with nothing queued ahead of them.
+var closedChan = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// join queues a move of object behind any earlier moves of it. Moves must join
+// in the order they were received.
+func (q *objectQueue) join(object string) *moveTurn {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.tails == nil {
+		q.tails = make(map[string]chan struct{})
+	}
+	t := &moveTurn{queue: q, object: object, ready: closedChan, done: make(chan struct{})}
+	if prev, ok := q.tails[object]; ok {
+		t.ready = prev
+	}
+	q.tails[object] = t.done
+	return t
+}
+
+// busy reports whether any move of object is queued or running.
+func (q *objectQueue) busy(object string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.tails[object]
+	return ok
+}
+
+// finish ends the move's turn, letting the next move of the object start.
+func (t *moveTurn) finish() {
+	t.queue.mu.Lock()
+	defer t.queue.mu.Unlock()
+
+	close(t.done)
+	if t.queue.tails[t.object] == t.done {
+		delete(t.queue.tails, t.object)
+	}
+}
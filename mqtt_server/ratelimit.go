@@ -0,0 +1,122 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a set of token buckets keyed on client ID. Each bucket holds
+// up to burst tokens and refills at rate tokens per second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// tokenBucket is the state of one client's bucket.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // When tokens was last refilled
+}
+
+// rateLimiterSweep is how often buckets which have refilled are discarded, so
+// clients which have gone away don't accumulate.
+const rateLimiterSweep = time.Minute
+
+// newRateLimiter returns a limiter allowing rate events per second per key,
+// with bursts of up to burst. It returns nil, allowing everything, if rate
+// isn't positive.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from key's bucket, returning false if it is empty. It
+// always returns true on a nil limiter.
+func (l *rateLimiter) allow(key string) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= rateLimiterSweep {
+		for k, b := range l.buckets {
+			if b.refill(now, l.rate, l.burst) >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	if b.refill(now, l.rate, l.burst) < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateMeter measures how many events happen per second, over the last whole
+// second.
+type rateMeter struct {
+	mu     sync.Mutex
+	second int64   // Unix second count is for
+	count  float64 // Events so far in second
+	prev   float64 // Events in the second before
+}
+
+// mark records an event.
+func (m *rateMeter) mark() {
+	now := time.Now().Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now != m.second {
+		m.prev = 0
+		if now == m.second+1 {
+			m.prev = m.count
+		}
+		m.second, m.count = now, 0
+	}
+	m.count++
+}
+
+// rate returns the number of events in the last whole second.
+func (m *rateMeter) rate() float64 {
+	now := time.Now().Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch now {
+	case m.second:
+		return m.prev
+	case m.second + 1:
+		return m.count
+	}
+	return 0
+}
+
+// refill adds the tokens earned since the last refill, up to burst, and
+// returns the new number of tokens.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) float64 {
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	return b.tokens
+}
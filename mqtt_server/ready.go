@@ -0,0 +1,27 @@
+package main
+
+import "errors"
+
+// serveGate is closed once the MQTT server is serving. The inline client can
+// publish as soon as the server is created, but messages published while the
+// hooks and listeners are still starting can be lost, so the sensor simulator
+// and move hook wait on the gate before publishing.
+type serveGate chan struct{}
+
+// errNotServing is returned for a publish abandoned because the hook stopped
+// before the server started serving.
+var errNotServing = errors.New("server stopped before it started serving")
+
+// wait blocks until the server is serving, returning true, or until stop is
+// closed, returning false. A nil gate is always open.
+func (g serveGate) wait(stop <-chan struct{}) bool {
+	if g == nil {
+		return true
+	}
+	select {
+	case <-g:
+		return true
+	case <-stop:
+		return false
+	}
+}
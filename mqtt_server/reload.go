@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+)
+
+// loadConfig loads the config file given with -config, if any, applies the
+// MQTT_AUTH_FILE environment variable and then the command line flags over it
+// and validates the result.
+func loadConfig() (*Config, error) {
+	cfg := DefaultConfig()
+	if *configPath != "" {
+		var err error
+		if cfg, err = LoadConfig(*configPath); err != nil {
+			return nil, err
+		}
+	}
+	if path := os.Getenv("MQTT_AUTH_FILE"); path != "" {
+		cfg.AuthFile = path
+	}
+	applyFlags(cfg)
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+// configChange is a config value which differs between two configs.
+type configChange struct {
+	Key      string // Config file key of the value
+	Old, New any
+}
+
+// configChanges returns the config values which differ between old and new.
+func configChanges(old, new *Config) []configChange {
+	var changes []configChange
+	o, n := reflect.ValueOf(old).Elem(), reflect.ValueOf(new).Elem()
+	for i := 0; i < o.NumField(); i++ {
+		if !reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+			key, _, _ := strings.Cut(o.Type().Field(i).Tag.Get("yaml"), ",")
+			changes = append(changes, configChange{Key: key, Old: o.Field(i).Interface(), New: n.Field(i).Interface()})
+		}
+	}
+	return changes
+}
+
+// Reloader applies a changed config file to the running server on SIGHUP,
+// without dropping MQTT connections. Topics, allowed objects, the command
+// schema, sensors and the auth ledger are reloaded; other changes are logged
+// as needing a restart.
+type Reloader struct {
+	mu       sync.RWMutex       // Guards cfg, which Reload replaces while it may be read
+	cfg      *Config            // Config currently in effect
+	hook     *MoveCommandHook   // Hook whose topics are updated
+	handlers []*MoveCommandHook // Extra command handlers, in the order of cfg.CommandHandlers
+	ledger   *auth.Ledger       // Auth ledger to reload, nil if auth is disabled
+	sim      *SensorSimulator   // Sensor simulator to update, nil if not simulating
+}
+
+// reloadable reports whether a change to the config key can be applied
+// without a restart when moving to the next config.
+func (r *Reloader) reloadable(key string, next *Config) bool {
+	switch key {
+	case "command_topic", "feedback_topic", "error_topic", "batch_command_topic", "batch_feedback_topic", "aggregate_feedback_topic",
+		"cancel_topic", "namespace", "allowed_objects", "command_schema_file",
+		"sensors", "sensor_interval":
+		return true
+	case "auth_file":
+		// Switching between the auth ledger and allowing all clients
+		// replaces a hook, which can't be done while serving.
+		return r.ledger != nil && next.AuthFile != ""
+	}
+	return false
+}
+
+// Reload rereads the config and auth files and applies any changes. The
+// running config is left untouched if either file is invalid.
+func (r *Reloader) Reload() error {
+	next, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	// The schema is reread even if its path hasn't changed, as it may have
+	// been edited.
+	var schema *jsonSchema
+	if next.CommandSchemaFile != "" {
+		if schema, err = loadSchema(next.CommandSchemaFile); err != nil {
+			return err
+		}
+	}
+
+	var ledger *auth.Ledger
+	if r.ledger != nil && next.AuthFile != "" {
+		if ledger, err = loadAuthLedger(next.AuthFile); err != nil {
+			return err
+		}
+	}
+
+	// Start from the running config so changes needing a restart aren't
+	// reported as in effect.
+	applied := *r.cfg
+	for _, c := range configChanges(r.cfg, next) {
+		if !r.reloadable(c.Key, next) {
+			slog.Warn("config change requires a restart", "key", c.Key, "old", c.Old, "new", c.New)
+			continue
+		}
+		slog.Info("config changed", "key", c.Key, "old", c.Old, "new", c.New)
+	}
+	applied.CommandTopic = next.CommandTopic
+	applied.FeedbackTopic = next.FeedbackTopic
+	applied.ErrorTopic = next.ErrorTopic
+	applied.BatchCommandTopic = next.BatchCommandTopic
+	applied.BatchFeedbackTopic = next.BatchFeedbackTopic
+	applied.AggregateFeedbackTopic = next.AggregateFeedbackTopic
+	applied.CancelTopic = next.CancelTopic
+	applied.Namespace = next.Namespace
+	applied.AllowedObjects = next.AllowedObjects
+	applied.CommandSchemaFile = next.CommandSchemaFile
+	applied.Sensors = next.Sensors
+	applied.SensorInterval = next.SensorInterval
+
+	// The command handlers list itself needs a restart, so check the new
+	// topics against the handlers running.
+	if err := applied.validateCommandHandlers(); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	r.hook.SetTopics(&applied)
+	r.hook.SetAllowedObjects(applied.AllowedObjects)
+	r.hook.SetSchema(schema)
+	// Extra handlers share the namespace and error and aggregate feedback
+	// topics with the main one.
+	for i, h := range r.handlers {
+		h.SetTopics(applied.CommandHandlers[i].config(&applied))
+		h.SetSchema(schema)
+	}
+	if r.sim != nil {
+		r.sim.SetSensors(applied.Sensors, applied.SensorInterval)
+	}
+	if ledger != nil {
+		applied.AuthFile = next.AuthFile
+		r.ledger.Update(ledger)
+		// Update only replaces the auth and ACL rules.
+		r.ledger.Lock()
+		r.ledger.Users = ledger.Users
+		r.ledger.Unlock()
+		slog.Info("reloaded auth file", "path", applied.AuthFile, "auth_rules", len(ledger.Auth), "acl_rules", len(ledger.ACL))
+	}
+
+	r.mu.Lock()
+	r.cfg = &applied
+	r.mu.Unlock()
+	return nil
+}
+
+// Config returns the config currently in effect, including the changes
+// applied by the last reload.
+func (r *Reloader) Config() *Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cfg
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Not parallel, as it sets the -config flag.
+func TestReloadNamespace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(namespace string) {
+		t.Helper()
+		config := "namespace: \"" + namespace + "\"\n" +
+			"command_handlers:\n" +
+			"  - name: warehouse\n" +
+			"    command_topic: fleets/warehouse/commands/move\n" +
+			"    feedback_topic: fleets/warehouse/feedback/move_complete\n"
+		if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("sceneA")
+	old := *configPath
+	*configPath = path
+	t.Cleanup(func() { *configPath = old })
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainHook := &MoveCommandHook{}
+	mainHook.SetTopics(cfg)
+	handler := &MoveCommandHook{}
+	handler.SetTopics(cfg.CommandHandlers[0].config(cfg))
+	r := &Reloader{cfg: cfg, hook: mainHook, handlers: []*MoveCommandHook{handler}}
+
+	writeConfig("sceneB")
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mainHook.topic(&mainHook.commandTopic), "sceneB/unity/commands/move"; got != want {
+		t.Errorf("got main command topic %q after reload, want %q", got, want)
+	}
+	if got, want := handler.topic(&handler.commandTopic), "sceneB/fleets/warehouse/commands/move"; got != want {
+		t.Errorf("got handler command topic %q after reload, want %q", got, want)
+	}
+	if got, want := handler.topic(&handler.errorTopic), "sceneB/"+cfg.ErrorTopic; got != want {
+		t.Errorf("got handler error topic %q after reload, want %q", got, want)
+	}
+	if got := r.Config().Namespace; got != "sceneB" {
+		t.Errorf("got namespace %q in effect, want sceneB", got)
+	}
+}
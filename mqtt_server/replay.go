@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+)
+
+// readReplay reads the move commands recorded in the history file at path,
+// in the order they were received. Records are written as moves complete, so
+// the file itself is in completion order. Lines without a command, such as
+// bare feedback, are skipped.
+func readReplay(path string) ([]HistoryRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading replay file: %w", err)
+	}
+	defer f.Close()
+	records, err := readHistory(f, HistoryFilter{}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	commands := records[:0]
+	for _, rec := range records {
+		if rec.Command.ObjectName == "" || rec.ReceivedAt.IsZero() {
+			continue
+		}
+		// The recorded duration of a command giving a speed was computed
+		// from it, and commands giving both are rejected.
+		if rec.Command.Speed != nil {
+			rec.Command.Duration = nil
+		}
+		commands = append(commands, rec)
+	}
+	sort.SliceStable(commands, func(i, j int) bool {
+		return commands[i].ReceivedAt.Before(commands[j].ReceivedAt)
+	})
+	return commands, nil
+}
+
+// replayCommands publishes recorded move commands to the hook's command topic
+// through the inline client, once the server is serving, with the same gaps
+// between them as when they were received divided by speed. A speed of 0
+// publishes them back to back. It returns early if ctx is cancelled.
+func replayCommands(ctx context.Context, h *MoveCommandHook, records []HistoryRecord, speed float64) {
+	if !h.ready.wait(ctx.Done()) {
+		return
+	}
+
+	slog.Info("replaying move commands", "commands", len(records), "speed", speed)
+	for i, rec := range records {
+		if i > 0 && speed > 0 {
+			gap := time.Duration(float64(rec.ReceivedAt.Sub(records[i-1].ReceivedAt)) / speed)
+			timer := time.NewTimer(gap)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				slog.Info("replay stopped", "replayed", i, "remaining", len(records)-i)
+				return
+			case <-timer.C:
+			}
+		}
+
+		cmd := rec.Command
+		payload, err := json.Marshal(cmd)
+		if err != nil {
+			slog.Error("failed to encode replayed move command", "request_id", cmd.RequestID, "error", err)
+			continue
+		}
+		topic := h.topic(&h.commandTopic)
+		if err := h.server.Publish(topic, payload, false, 0); err != nil {
+			slog.Error("failed to publish replayed move command", "topic", topic, "request_id", cmd.RequestID, "error", err)
+			continue
+		}
+		slog.Info("replayed move command", "topic", topic, "object_name", cmd.ObjectName, "request_id", cmd.RequestID)
+	}
+	slog.Info("replay finished", "commands", len(records))
+}
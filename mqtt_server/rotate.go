@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// RotateCommand asks for an object to be turned to the given orientation.
+type RotateCommand struct {
+	ObjectName  string    `json:"object_name"`
+	TargetEuler []float64 `json:"target_euler"`       // Euler angles about x, y and z, in degrees
+	Duration    *float64  `json:"duration,omitempty"` // Seconds the rotation takes, the configured default if unset
+	RequestID   string    `json:"request_id"`
+
+	durationClamped bool // Set when a negative Duration was clamped to zero
+}
+
+// RotateCompletionFeedback reports the outcome of a rotate command.
+type RotateCompletionFeedback struct {
+	ObjectName string    `json:"object_name"`
+	FinalEuler []float64 `json:"final_euler"` // Normalised to [0, 360) degrees
+	Status     string    `json:"status"`
+	Timestamp  string    `json:"timestamp"`
+	RequestID  string    `json:"request_id"`
+	Reason     string    `json:"reason,omitempty"` // Why the command was rejected or adjusted
+	Field      string    `json:"field,omitempty"`  // Field of the command at fault, for rejections
+}
+
+// validate returns the reason a rotate command can't be processed and the
+// field at fault, or empty strings if it is valid.
+func (cmd RotateCommand) validate() (field, reason string) {
+	if len(cmd.TargetEuler) != 3 {
+		return "target_euler", fmt.Sprintf("target_euler must have exactly 3 elements (x, y, z), got %d", len(cmd.TargetEuler))
+	}
+	for i, v := range cmd.TargetEuler {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "target_euler", fmt.Sprintf("target_euler[%d] is not a finite number", i)
+		}
+	}
+	if cmd.Duration != nil && (math.IsNaN(*cmd.Duration) || math.IsInf(*cmd.Duration, 0)) {
+		return "duration", "duration is not a finite number"
+	}
+	return "", ""
+}
+
+// normalizeAngle returns degrees as the equivalent angle in [0, 360).
+func normalizeAngle(degrees float64) float64 {
+	a := math.Mod(degrees, 360)
+	if a < 0 {
+		a += 360
+	}
+	if a >= 360 { // A tiny negative angle rounds up to 360
+		a = 0
+	}
+	return a
+}
+
+// RotateCommandHandler simulates rotate commands, with the same duration
+// limits and allowed objects as the hook's moves.
+type RotateCommandHandler struct {
+	hook          *MoveCommandHook
+	commandTopic  string // Topic rotate commands are received on, under the hook's namespace
+	feedbackTopic string // Topic rotate feedback is published to, under the hook's namespace
+}
+
+// NewRotateCommandHandler returns a handler for rotate commands on
+// commandTopic, answered on feedbackTopic, to register on hook.
+func NewRotateCommandHandler(hook *MoveCommandHook, commandTopic, feedbackTopic string) *RotateCommandHandler {
+	return &RotateCommandHandler{hook: hook, commandTopic: commandTopic, feedbackTopic: feedbackTopic}
+}
+
+// Match reports whether topic is the rotate command topic.
+func (r *RotateCommandHandler) Match(topic string) bool {
+	t := r.hook.topic(&r.commandTopic)
+	return t != "" && t == topic
+}
+
+// Kind returns "rotate".
+func (r *RotateCommandHandler) Kind() string {
+	return "rotate"
+}
+
+// Handle validates a rotate command and simulates it, publishing its
+// feedback once the rotation has taken its duration. Rejections are returned
+// as feedback straight away. A command which isn't
+// valid JSON and has no request ID to answer is returned as an error.
+func (r *RotateCommandHandler) Handle(cl *mqtt.Client, pk packets.Packet) (*CommandFeedback, error) {
+	h := r.hook
+	h.logSampled("received rotate command", "topic", pk.TopicName, "client_id", cl.ID, "payload", string(pk.Payload))
+	reply := h.replyContext(cl, pk)
+
+	var cmd RotateCommand
+	if err := json.Unmarshal(pk.Payload, &cmd); err != nil {
+		requestID := extractRequestID(pk.Payload)
+		if requestID == "" {
+			return nil, fmt.Errorf("malformed rotate command: %w", err)
+		}
+		h.Log.Warn("malformed rotate command", "topic", pk.TopicName, "client_id", cl.ID, "error", err)
+		return r.commandFeedback(RotateCompletionFeedback{
+			Status:    "error",
+			Timestamp: h.timestamp(),
+			RequestID: requestID,
+			Reason:    fmt.Sprintf("malformed rotate command: %v", err),
+			Field:     jsonErrorField(err),
+		}, reply), nil
+	}
+
+	if field, reason := r.check(&cmd); reason != "" {
+		h.Log.Warn("rejected rotate command", "client_id", cl.ID, "object_name", cmd.ObjectName,
+			"request_id", cmd.RequestID, "field", field, "reason", reason)
+		return r.commandFeedback(RotateCompletionFeedback{
+			ObjectName: cmd.ObjectName,
+			Status:     "rejected",
+			Timestamp:  h.timestamp(),
+			RequestID:  cmd.RequestID,
+			Reason:     reason,
+			Field:      field,
+		}, reply), nil
+	}
+
+	duration := max(0, time.Duration(*cmd.Duration*float64(time.Second)))
+	h.logSampled("simulating rotation", "client_id", cl.ID, "object_name", cmd.ObjectName,
+		"target_euler", cmd.TargetEuler, "duration", duration, "request_id", cmd.RequestID)
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		h.publishReply(r.commandFeedback(r.run(cmd, duration), reply))
+	}()
+	return nil, nil
+}
+
+// check validates cmd against the allowed objects and resolves its duration,
+// returning the field at fault and why if it can't be carried out. A negative
+// duration is clamped to zero, and the target angles are normalised.
+func (r *RotateCommandHandler) check(cmd *RotateCommand) (field, reason string) {
+	h := r.hook
+	if field, reason := cmd.validate(); reason != "" {
+		return field, reason
+	}
+	if !h.objectAllowed(cmd.ObjectName) {
+		return "object_name", fmt.Sprintf("object %q is not one of the allowed objects", cmd.ObjectName)
+	}
+	if cmd.Duration == nil {
+		seconds := h.defaultDuration.Seconds()
+		cmd.Duration = &seconds
+	}
+	if *cmd.Duration < 0 {
+		zero := 0.0
+		cmd.Duration = &zero
+		cmd.durationClamped = true
+	}
+	if h.maxDuration > 0 && time.Duration(*cmd.Duration*float64(time.Second)) > h.maxDuration {
+		return "duration", fmt.Sprintf("duration %gs is longer than the maximum of %v", *cmd.Duration, h.maxDuration)
+	}
+	for i, v := range cmd.TargetEuler {
+		cmd.TargetEuler[i] = normalizeAngle(v)
+	}
+	return "", ""
+}
+
+// run waits for a simulated rotation to finish and returns its feedback, or
+// interrupted feedback if the hook is stopped first.
+func (r *RotateCommandHandler) run(cmd RotateCommand, duration time.Duration) RotateCompletionFeedback {
+	h := r.hook
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	feedback := RotateCompletionFeedback{
+		ObjectName: cmd.ObjectName,
+		FinalEuler: cmd.TargetEuler, // Assuming it reaches the target
+		Status:     "success",
+		RequestID:  cmd.RequestID,
+	}
+	if cmd.durationClamped {
+		feedback.Reason = "negative duration was clamped to 0"
+	}
+	select {
+	case <-timer.C:
+	case <-h.done:
+		feedback.FinalEuler = nil
+		feedback.Status = "interrupted"
+		feedback.Reason = "server shutting down before the rotation completed"
+	}
+	feedback.Timestamp = h.timestamp()
+	return feedback
+}
+
+// commandFeedback returns feedback for the rotate feedback topic, mirroring
+// how the command was published.
+func (r *RotateCommandHandler) commandFeedback(feedback RotateCompletionFeedback, reply replyContext) *CommandFeedback {
+	return &CommandFeedback{Topic: r.hook.topic(&r.feedbackTopic), Payload: feedback,
+		RequestID: feedback.RequestID, Status: feedback.Status, Reply: reply}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// Only the subset of JSON Schema needed to constrain command payloads is
+// supported: type, enum, const, properties, required, additionalProperties,
+// items, minItems, maxItems, minimum, maximum, exclusiveMinimum,
+// exclusiveMaximum, minLength, maxLength and pattern. Annotations such as
+// title and description are ignored, and any other keyword is an error when
+// the schema is loaded, so a schema never silently allows more than it says.
+
+// maxSchemaErrors is how many validation errors are reported for a payload.
+const maxSchemaErrors = 20
+
+// jsonSchema is a JSON Schema, or the boolean schema true or false.
+type jsonSchema struct {
+	boolean *bool          // Set for a boolean schema, which allows everything or nothing
+	pattern *regexp.Regexp // Compiled Pattern
+
+	Type                 schemaTypes            `json:"type"`
+	Enum                 []any                  `json:"enum"`
+	Const                *any                   `json:"const"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	ExclusiveMinimum     *float64               `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64               `json:"exclusiveMaximum"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+
+	// Annotations, which don't affect validation.
+	Schema      string          `json:"$schema"`
+	SchemaID    string          `json:"$id"`
+	Comment     string          `json:"$comment"`
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	Default     json.RawMessage `json:"default"`
+	Examples    json.RawMessage `json:"examples"`
+}
+
+// schemaTypes is the type keyword, which may be a single type name or a list.
+type schemaTypes []string
+
+// UnmarshalJSON accepts a type name or a list of them.
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*t = schemaTypes{name}
+	} else if err := json.Unmarshal(data, (*[]string)(t)); err != nil {
+		return fmt.Errorf("type must be a type name or a list of them")
+	}
+	for _, name := range *t {
+		switch name {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return fmt.Errorf("unknown type %q", name)
+		}
+	}
+	return nil
+}
+
+// UnmarshalJSON decodes a boolean schema or a schema object, rejecting
+// keywords which aren't supported.
+func (s *jsonSchema) UnmarshalJSON(data []byte) error {
+	var b bool
+	if err := json.Unmarshal(data, &b); err == nil {
+		*s = jsonSchema{boolean: &b}
+		return nil
+	}
+
+	type plain jsonSchema // Without this method, to decode the keywords
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode((*plain)(s)); err != nil {
+		return err
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	return nil
+}
+
+// loadSchema reads the JSON Schema at path.
+func loadSchema(path string) (*jsonSchema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema file: %w", err)
+	}
+	var s jsonSchema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parsing schema file %s: %w", path, err)
+	}
+	return &s, nil
+}
+
+// check validates payload against the schema, returning a description of
+// each way it doesn't match, up to maxSchemaErrors. Payloads which aren't
+// valid JSON pass, so they are reported as malformed as usual.
+func (s *jsonSchema) check(payload []byte) []string {
+	var v any
+	if err := json.Unmarshal(payload, &v); err != nil {
+		return nil
+	}
+	var errs []string
+	s.validate(v, "", &errs)
+	return errs
+}
+
+// validate appends to errs the ways v, found at path, doesn't match the schema.
+func (s *jsonSchema) validate(v any, path string, errs *[]string) {
+	fail := func(format string, args ...any) {
+		if len(*errs) < maxSchemaErrors {
+			where := path
+			if where == "" {
+				where = "payload"
+			}
+			*errs = append(*errs, where+": "+fmt.Sprintf(format, args...))
+		}
+	}
+
+	if s.boolean != nil {
+		if !*s.boolean {
+			fail("is not allowed")
+		}
+		return
+	}
+	if len(s.Type) > 0 && !slices.ContainsFunc(s.Type, func(t string) bool { return hasSchemaType(v, t) }) {
+		fail("must be of type %s, got %s", joinTypes(s.Type), schemaTypeOf(v))
+		return
+	}
+	if s.Enum != nil && !slices.ContainsFunc(s.Enum, func(e any) bool { return reflect.DeepEqual(e, v) }) {
+		fail("must be one of %s", mustMarshal(s.Enum))
+	}
+	if s.Const != nil && !reflect.DeepEqual(*s.Const, v) {
+		fail("must be %s", mustMarshal(*s.Const))
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(v)) {
+			if prop, ok := s.Properties[name]; ok {
+				prop.validate(v[name], joinPath(path, name), errs)
+			} else if s.AdditionalProperties != nil {
+				s.AdditionalProperties.validate(v[name], joinPath(path, name), errs)
+			}
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			fail("must have at least %d items, got %d", *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			fail("must have at most %d items, got %d", *s.MaxItems, len(v))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				s.Items.validate(item, path+"["+strconv.Itoa(i)+"]", errs)
+			}
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			fail("must be at least %g, got %g", *s.Minimum, v)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			fail("must be at most %g, got %g", *s.Maximum, v)
+		}
+		if s.ExclusiveMinimum != nil && v <= *s.ExclusiveMinimum {
+			fail("must be greater than %g, got %g", *s.ExclusiveMinimum, v)
+		}
+		if s.ExclusiveMaximum != nil && v >= *s.ExclusiveMaximum {
+			fail("must be less than %g, got %g", *s.ExclusiveMaximum, v)
+		}
+	case string:
+		n := len([]rune(v))
+		if s.MinLength != nil && n < *s.MinLength {
+			fail("must be at least %d characters long, got %d", *s.MinLength, n)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			fail("must be at most %d characters long, got %d", *s.MaxLength, n)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			fail("must match the pattern %q", s.Pattern)
+		}
+	}
+}
+
+// hasSchemaType reports whether the decoded JSON value v is of the named
+// schema type.
+func hasSchemaType(v any, name string) bool {
+	if name == "integer" {
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	}
+	return schemaTypeOf(v) == name
+}
+
+// schemaTypeOf returns the schema type name of the decoded JSON value v.
+func schemaTypeOf(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case float64:
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+// joinTypes lists type names for an error message.
+func joinTypes(types []string) string {
+	if len(types) == 1 {
+		return types[0]
+	}
+	return fmt.Sprintf("%v", types)
+}
+
+// joinPath returns the path of the named property of the object at path.
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// mustMarshal returns v, which was decoded from JSON, as JSON.
+func mustMarshal(v any) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+)
+
+// Sensor defines a simulated sensor and the realistic range of its readings.
+type Sensor struct {
+	Topic string  `yaml:"topic" json:"topic"` // topic readings are published to
+	Min   float64 `yaml:"min" json:"min"`     // lowest plausible reading
+	Max   float64 `yaml:"max" json:"max"`     // highest plausible reading
+	Unit  string  `yaml:"unit" json:"unit"`   // unit of the readings, e.g. mg/L
+
+	// Readings wander randomly around Baseline, changing by at most Jitter
+	// each time. Baseline defaults to the middle of the range and Jitter to
+	// 2% of the range when unset.
+	Baseline *float64 `yaml:"baseline,omitempty" json:"baseline,omitempty"`
+	Jitter   float64  `yaml:"jitter,omitempty" json:"jitter,omitempty"`
+
+	// Retain publishes readings as retained messages so new subscribers get
+	// the latest value immediately. Defaults to true when unset.
+	Retain *bool `yaml:"retain,omitempty" json:"retain,omitempty"`
+}
+
+// retained returns true if the sensor's readings should be retained.
+func (s Sensor) retained() bool {
+	return s.Retain == nil || *s.Retain
+}
+
+// sensorReversion is the fraction of the distance back to the baseline a
+// reading moves each time, so readings drift but don't stray far for long.
+const sensorReversion = 0.05
+
+// validate returns an error if the sensor's range, baseline or jitter is invalid.
+func (s Sensor) validate() error {
+	if s.Min > s.Max {
+		return fmt.Errorf("sensor %s min (%g) is greater than max (%g)", s.Topic, s.Min, s.Max)
+	}
+	if s.Baseline != nil && (*s.Baseline < s.Min || *s.Baseline > s.Max) {
+		return fmt.Errorf("sensor %s baseline (%g) is outside its range", s.Topic, *s.Baseline)
+	}
+	if s.Jitter < 0 {
+		return fmt.Errorf("sensor %s jitter must not be negative, got %g", s.Topic, s.Jitter)
+	}
+	return nil
+}
+
+// baseline returns the value the sensor's readings wander around.
+func (s Sensor) baseline() float64 {
+	if s.Baseline != nil {
+		return *s.Baseline
+	}
+	return (s.Min + s.Max) / 2
+}
+
+// reading returns the reading following prev: a step of bounded jitter,
+// pulled slightly back towards the baseline and clamped to the sensor's range.
+func (s Sensor) reading(prev float64) float64 {
+	jitter := s.Jitter
+	if jitter == 0 {
+		jitter = (s.Max - s.Min) * 0.02
+	}
+	next := prev + (s.baseline()-prev)*sensorReversion + (rand.Float64()*2-1)*jitter
+	return math.Min(math.Max(next, s.Min), s.Max)
+}
+
+// SensorSimulator publishes sensor readings following a random walk at a
+// fixed interval, for demos without real hardware attached.
+type SensorSimulator struct {
+	server *mqtt.Server // Reference to the MQTT server to publish readings
+	ready  serveGate    // Closed once the server is serving, nil if it already is
+
+	mu       sync.Mutex
+	sensors  []Sensor      // Sensors to publish a reading for on each tick
+	interval time.Duration // Time between readings
+	changed  chan struct{} // Signalled when the interval is changed by SetSensors
+
+	values  map[string]float64        // Last reading of each sensor, keyed on topic
+	backoff map[string]*sensorBackoff // Sensors whose last publish failed, keyed on topic
+}
+
+// Sensors failing to publish this many readings in a row are paused, for two
+// intervals at first and doubling with each further failure up to
+// sensorMaxBackoff, so an unhealthy broker doesn't get a failing publish and
+// an error log for every sensor on every tick.
+const (
+	sensorBackoffThreshold = 3
+	sensorMaxBackoff       = 5 * time.Minute
+)
+
+// sensorBackoff tracks a sensor's consecutive publish failures.
+type sensorBackoff struct {
+	failures int
+	until    time.Time // Readings are skipped until then while paused
+}
+
+// NewSensorSimulator returns a simulator publishing readings for sensors every
+// interval, once ready is closed.
+func NewSensorSimulator(server *mqtt.Server, ready serveGate, sensors []Sensor, interval time.Duration) *SensorSimulator {
+	return &SensorSimulator{
+		server:   server,
+		ready:    ready,
+		sensors:  sensors,
+		interval: interval,
+		changed:  make(chan struct{}, 1),
+		values:   make(map[string]float64),
+		backoff:  make(map[string]*sensorBackoff),
+	}
+}
+
+// SetSensors replaces the simulated sensors and the time between readings,
+// taking effect from the next reading.
+func (s *SensorSimulator) SetSensors(sensors []Sensor, interval time.Duration) {
+	s.mu.Lock()
+	s.sensors = sensors
+	s.interval = interval
+	s.mu.Unlock()
+
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Run publishes readings every interval, starting once the server is serving,
+// until ctx is cancelled.
+func (s *SensorSimulator) Run(ctx context.Context) {
+	if !s.ready.wait(ctx.Done()) {
+		return
+	}
+
+	s.mu.Lock()
+	ticker := time.NewTicker(s.interval)
+	s.mu.Unlock()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.changed:
+			s.mu.Lock()
+			ticker.Reset(s.interval)
+			s.mu.Unlock()
+		case <-ticker.C:
+			s.publish()
+		}
+	}
+}
+
+// publish publishes the next reading for each sensor which isn't paused. A
+// sensor's first reading starts at its baseline.
+func (s *SensorSimulator) publish() {
+	s.mu.Lock()
+	sensors, interval := s.sensors, s.interval
+	s.mu.Unlock()
+
+	now := time.Now()
+	for _, sensor := range sensors {
+		backoff := s.backoff[sensor.Topic]
+		if backoff != nil && now.Before(backoff.until) {
+			continue
+		}
+		prev, ok := s.values[sensor.Topic]
+		if !ok {
+			prev = sensor.baseline()
+		}
+		value := sensor.reading(prev)
+		s.values[sensor.Topic] = value
+		if err := s.server.Publish(sensor.Topic, []byte(fmt.Sprintf("%.2f", value)), sensor.retained(), 0); err != nil {
+			s.publishFailed(sensor.Topic, interval, err)
+			continue
+		}
+		if backoff != nil {
+			slog.Info("resumed publishing sensor readings", "topic", sensor.Topic, "failures", backoff.failures)
+			delete(s.backoff, sensor.Topic)
+		}
+		slog.Info("published sensor reading", "topic", sensor.Topic, "value", value, "unit", sensor.Unit)
+	}
+}
+
+// publishFailed records a failure to publish a reading to topic, pausing the
+// sensor once it has failed sensorBackoffThreshold times in a row.
+func (s *SensorSimulator) publishFailed(topic string, interval time.Duration, err error) {
+	backoff := s.backoff[topic]
+	if backoff == nil {
+		backoff = new(sensorBackoff)
+		s.backoff[topic] = backoff
+	}
+	backoff.failures++
+	if backoff.failures < sensorBackoffThreshold {
+		slog.Error("failed to publish sensor reading", "topic", topic, "failures", backoff.failures, "error", err)
+		return
+	}
+
+	pause := sensorMaxBackoff
+	if doublings := backoff.failures - sensorBackoffThreshold + 1; doublings < 16 && interval<<doublings < pause {
+		pause = interval << doublings
+	}
+	backoff.until = time.Now().Add(pause)
+	slog.Warn("pausing sensor readings after repeated publish failures", "topic", topic,
+		"failures", backoff.failures, "pause", pause, "error", err)
+}
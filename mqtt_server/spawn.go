@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// SpawnCommand asks for a new instance of a prefab to be placed in the scene.
+type SpawnCommand struct {
+	Prefab    string    `json:"prefab"`
+	Position  []float64 `json:"position"` // Where the new object is placed, x, y, z
+	RequestID string    `json:"request_id"`
+}
+
+// DespawnCommand asks for an object created by a spawn command to be removed.
+type DespawnCommand struct {
+	ObjectName string `json:"object_name"`
+	RequestID  string `json:"request_id"`
+}
+
+// SpawnFeedback reports the outcome of a spawn or despawn command.
+type SpawnFeedback struct {
+	ObjectName string    `json:"object_name,omitempty"` // Name assigned to the spawned object, or the one removed
+	Prefab     string    `json:"prefab,omitempty"`
+	Position   []float64 `json:"position,omitempty"`
+	Status     string    `json:"status"`
+	Timestamp  string    `json:"timestamp"`
+	RequestID  string    `json:"request_id"`
+	Reason     string    `json:"reason,omitempty"` // Why the command was rejected or adjusted
+	Field      string    `json:"field,omitempty"`  // Field of the command at fault, for rejections
+}
+
+// validate returns the reason a spawn command can't be processed and the
+// field at fault, or empty strings if it is valid.
+func (cmd SpawnCommand) validate() (field, reason string) {
+	if cmd.Prefab == "" {
+		return "prefab", "prefab is required"
+	}
+	if len(cmd.Position) != 3 {
+		return "position", fmt.Sprintf("position must have exactly 3 elements (x, y, z), got %d", len(cmd.Position))
+	}
+	for i, v := range cmd.Position {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "position", fmt.Sprintf("position[%d] is not a finite number", i)
+		}
+	}
+	return "", ""
+}
+
+// spawnedObjects is the set of objects created by spawn commands, shared by
+// the spawn and despawn handlers.
+type spawnedObjects struct {
+	mu      sync.Mutex
+	objects map[string]string // Prefab of each spawned object, keyed on object name
+	counts  map[string]int    // Number of objects spawned from each prefab, for naming
+}
+
+// add records a new object spawned from prefab and returns its name, the
+// prefab followed by a counter. taken reports names already used by objects
+// in the scene, which are skipped.
+func (s *spawnedObjects) add(prefab string, taken func(name string) bool) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		s.counts[prefab]++
+		name := prefab + "_" + strconv.Itoa(s.counts[prefab])
+		if _, ok := s.objects[name]; !ok && !taken(name) {
+			s.objects[name] = prefab
+			return name
+		}
+	}
+}
+
+// remove forgets a spawned object, returning its prefab and false if there
+// is no such object.
+func (s *spawnedObjects) remove(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefab, ok := s.objects[name]
+	delete(s.objects, name)
+	return prefab, ok
+}
+
+// SpawnCommandHandler places new objects in the scene, within the hook's
+// scene bounds. A spawned object's position is recorded as its last known
+// position, so it can be moved by speed straight away.
+type SpawnCommandHandler struct {
+	hook          *MoveCommandHook
+	spawned       *spawnedObjects
+	commandTopic  string // Topic spawn commands are received on, under the hook's namespace
+	feedbackTopic string // Topic spawn feedback is published to, under the hook's namespace
+}
+
+// DespawnCommandHandler removes objects created by the SpawnCommandHandler it
+// was made with. Despawning any other object reports status not_found.
+type DespawnCommandHandler struct {
+	hook          *MoveCommandHook
+	spawned       *spawnedObjects
+	commandTopic  string // Topic despawn commands are received on, under the hook's namespace
+	feedbackTopic string // Topic despawn feedback is published to, under the hook's namespace
+}
+
+// NewSpawnCommandHandlers returns handlers for spawn and despawn commands on
+// their command topics, answered on their feedback topics, to register on
+// hook. The despawn handler only knows the objects the spawn handler created.
+func NewSpawnCommandHandlers(hook *MoveCommandHook, spawnTopic, spawnFeedbackTopic, despawnTopic, despawnFeedbackTopic string) (*SpawnCommandHandler, *DespawnCommandHandler) {
+	spawned := &spawnedObjects{objects: make(map[string]string), counts: make(map[string]int)}
+	return &SpawnCommandHandler{hook: hook, spawned: spawned, commandTopic: spawnTopic, feedbackTopic: spawnFeedbackTopic},
+		&DespawnCommandHandler{hook: hook, spawned: spawned, commandTopic: despawnTopic, feedbackTopic: despawnFeedbackTopic}
+}
+
+// Match reports whether topic is the spawn command topic.
+func (s *SpawnCommandHandler) Match(topic string) bool {
+	t := s.hook.topic(&s.commandTopic)
+	return t != "" && t == topic
+}
+
+// Kind returns "spawn".
+func (s *SpawnCommandHandler) Kind() string {
+	return "spawn"
+}
+
+// Handle validates a spawn command and places the new object, returning
+// feedback with its assigned name. A command which isn't valid JSON and has no
+// request ID to answer is returned as an error.
+func (s *SpawnCommandHandler) Handle(cl *mqtt.Client, pk packets.Packet) (*CommandFeedback, error) {
+	h := s.hook
+	h.logSampled("received spawn command", "topic", pk.TopicName, "client_id", cl.ID, "payload", string(pk.Payload))
+	reply := h.replyContext(cl, pk)
+
+	var cmd SpawnCommand
+	if err := json.Unmarshal(pk.Payload, &cmd); err != nil {
+		requestID := extractRequestID(pk.Payload)
+		if requestID == "" {
+			return nil, fmt.Errorf("malformed spawn command: %w", err)
+		}
+		h.Log.Warn("malformed spawn command", "topic", pk.TopicName, "client_id", cl.ID, "error", err)
+		return s.commandFeedback(SpawnFeedback{
+			Status:    "error",
+			Timestamp: h.timestamp(),
+			RequestID: requestID,
+			Reason:    fmt.Sprintf("malformed spawn command: %v", err),
+			Field:     jsonErrorField(err),
+		}, reply), nil
+	}
+
+	feedback := SpawnFeedback{Prefab: cmd.Prefab, RequestID: cmd.RequestID}
+	if field, reason := cmd.validate(); reason != "" {
+		h.Log.Warn("rejected spawn command", "client_id", cl.ID, "prefab", cmd.Prefab,
+			"request_id", cmd.RequestID, "field", field, "reason", reason)
+		feedback.Status, feedback.Reason, feedback.Field = "rejected", reason, field
+		feedback.Timestamp = h.timestamp()
+		return s.commandFeedback(feedback, reply), nil
+	}
+
+	position := h.transform.toScene(cmd.Position)
+	if h.bounds != nil && !h.bounds.contains(position) {
+		if h.boundsMode == BoundsReject {
+			h.Log.Warn("rejected spawn command", "client_id", cl.ID, "prefab", cmd.Prefab,
+				"request_id", cmd.RequestID, "field", "position", "reason", "out of bounds")
+			feedback.Status = "out_of_bounds"
+			feedback.Reason = fmt.Sprintf("position %v is outside the scene bounds", position)
+			feedback.Field = "position"
+			feedback.Timestamp = h.timestamp()
+			return s.commandFeedback(feedback, reply), nil
+		}
+		position = h.bounds.clamp(position)
+		feedback.Reason = "position was clamped to the scene bounds"
+	}
+
+	feedback.ObjectName = s.place(cmd.Prefab, position)
+
+	h.Log.Info("spawned object", "client_id", cl.ID, "object_name", feedback.ObjectName, "prefab", cmd.Prefab,
+		"position", position, "request_id", cmd.RequestID)
+	feedback.Position = h.transform.toAgent(position)
+	feedback.Status = "success"
+	feedback.Timestamp = h.timestamp()
+	return s.commandFeedback(feedback, reply), nil
+}
+
+// place names a new object of prefab after one no known object has, and
+// records it at position.
+func (s *SpawnCommandHandler) place(prefab string, position []float64) string {
+	h := s.hook
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	name := s.spawned.add(prefab, func(name string) bool {
+		_, ok := h.positions[name]
+		return ok
+	})
+	h.positions[name] = objectPosition{position: position, updatedAt: time.Now()}
+	return name
+}
+
+// commandFeedback returns feedback for the spawn feedback topic, mirroring
+// how the command was published.
+func (s *SpawnCommandHandler) commandFeedback(feedback SpawnFeedback, reply replyContext) *CommandFeedback {
+	return &CommandFeedback{Topic: s.hook.topic(&s.feedbackTopic), Payload: feedback,
+		RequestID: feedback.RequestID, Status: feedback.Status, Reply: reply}
+}
+
+// Match reports whether topic is the despawn command topic.
+func (d *DespawnCommandHandler) Match(topic string) bool {
+	t := d.hook.topic(&d.commandTopic)
+	return t != "" && t == topic
+}
+
+// Kind returns "despawn".
+func (d *DespawnCommandHandler) Kind() string {
+	return "despawn"
+}
+
+// Handle removes a spawned object and forgets its last known position,
+// returning feedback with the removed object's name, or status not_found if
+// it wasn't spawned. A command which isn't valid JSON and has no request ID to answer
+// is returned as an error.
+func (d *DespawnCommandHandler) Handle(cl *mqtt.Client, pk packets.Packet) (*CommandFeedback, error) {
+	h := d.hook
+	h.logSampled("received despawn command", "topic", pk.TopicName, "client_id", cl.ID, "payload", string(pk.Payload))
+	reply := h.replyContext(cl, pk)
+
+	var cmd DespawnCommand
+	if err := json.Unmarshal(pk.Payload, &cmd); err != nil {
+		requestID := extractRequestID(pk.Payload)
+		if requestID == "" {
+			return nil, fmt.Errorf("malformed despawn command: %w", err)
+		}
+		h.Log.Warn("malformed despawn command", "topic", pk.TopicName, "client_id", cl.ID, "error", err)
+		return d.commandFeedback(SpawnFeedback{
+			Status:    "error",
+			Timestamp: h.timestamp(),
+			RequestID: requestID,
+			Reason:    fmt.Sprintf("malformed despawn command: %v", err),
+			Field:     jsonErrorField(err),
+		}, reply), nil
+	}
+
+	feedback := SpawnFeedback{ObjectName: cmd.ObjectName, RequestID: cmd.RequestID}
+	if cmd.ObjectName == "" {
+		feedback.Status, feedback.Reason, feedback.Field = "rejected", "object_name is required", "object_name"
+		feedback.Timestamp = h.timestamp()
+		return d.commandFeedback(feedback, reply), nil
+	}
+
+	prefab, ok := d.forget(cmd.ObjectName)
+
+	if !ok {
+		h.Log.Warn("despawn of unknown object", "client_id", cl.ID, "object_name", cmd.ObjectName, "request_id", cmd.RequestID)
+		feedback.Status = "not_found"
+		feedback.Reason = fmt.Sprintf("object %q was not spawned by the bridge", cmd.ObjectName)
+		feedback.Field = "object_name"
+	} else {
+		h.Log.Info("despawned object", "client_id", cl.ID, "object_name", cmd.ObjectName, "prefab", prefab,
+			"request_id", cmd.RequestID)
+		feedback.Prefab = prefab
+		feedback.Status = "success"
+	}
+	feedback.Timestamp = h.timestamp()
+	return d.commandFeedback(feedback, reply), nil
+}
+
+// forget removes the spawned object name and its last known position,
+// returning the prefab it was made from, or false if it wasn't spawned.
+func (d *DespawnCommandHandler) forget(name string) (string, bool) {
+	h := d.hook
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	prefab, ok := d.spawned.remove(name)
+	if ok {
+		delete(h.positions, name)
+	}
+	return prefab, ok
+}
+
+// commandFeedback returns feedback for the despawn feedback topic, mirroring
+// how the command was published.
+func (d *DespawnCommandHandler) commandFeedback(feedback SpawnFeedback, reply replyContext) *CommandFeedback {
+	return &CommandFeedback{Topic: d.hook.topic(&d.feedbackTopic), Payload: feedback,
+		RequestID: feedback.RequestID, Status: feedback.Status, Reply: reply}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// SubscriptionHook logs every subscription request, so clients subscribing
+// to more than they should can be traced.
+type SubscriptionHook struct {
+	mqtt.HookBase
+}
+
+// ID returns the ID of the hook.
+func (h *SubscriptionHook) ID() string {
+	return "SubscriptionHook"
+}
+
+// Provides indicates the methods that the hook provides.
+func (h *SubscriptionHook) Provides(p byte) bool {
+	return p == mqtt.OnSubscribe
+}
+
+// OnSubscribe is called when a client sends a SUBSCRIBE packet.
+func (h *SubscriptionHook) OnSubscribe(cl *mqtt.Client, pk packets.Packet) packets.Packet {
+	for _, sub := range pk.Filters {
+		h.Log.Info("client subscribing", "client_id", cl.ID, "filter", sub.Filter, "qos", sub.Qos)
+	}
+	return pk
+}
+
+// isRootWildcard returns true if filter matches every topic at its first
+// level, such as # or +/status. The group prefix of shared subscriptions is
+// ignored.
+func isRootWildcard(filter string) bool {
+	if rest, ok := strings.CutPrefix(filter, "$share/"); ok {
+		_, filter, _ = strings.Cut(rest, "/")
+	}
+	first, _, _ := strings.Cut(filter, "/")
+	return first == "#" || first == "+"
+}
+
+// wildcardPolicy optionally rejects subscriptions to root wildcards. mochi
+// allows a subscription if any hook's ACL check passes, so the policy is
+// embedded in the auth hooks rather than being a hook of its own.
+type wildcardPolicy struct {
+	rejectRootWildcards bool
+}
+
+// denied returns true if the policy rejects subscribing to topic, logging the
+// rejection. Clients are sent a SUBACK with the not authorized reason code.
+func (p wildcardPolicy) denied(h *mqtt.HookBase, cl *mqtt.Client, topic string, write bool) bool {
+	if write || !p.rejectRootWildcards || !isRootWildcard(topic) {
+		return false
+	}
+	h.Log.Warn("rejected root wildcard subscription", "client_id", cl.ID, "remote_addr", cl.Net.Remote, "filter", topic)
+	return true
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// pipeListener is a net.Listener handing out in-memory connections made with
+// net.Pipe, so tests can connect clients to the broker without opening
+// sockets.
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// Accept waits for dial to be called and returns the broker's end of the
+// connection.
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// dial returns the client's end of a new connection to the listener.
+func (l *pipeListener) dial() (net.Conn, error) {
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// testClient is an MQTT v5 client connected to a test server. Messages it
+// receives are buffered until read with next.
+type testClient struct {
+	t        *testing.T
+	conn     net.Conn
+	packetID uint16
+
+	messages chan packets.Packet // PUBLISH packets received
+	subacks  chan packets.Packet // SUBACK packets received
+}
+
+// newTestServer returns a serving broker allowing any client, and a test
+// client connected to it over an in-memory pipe. Hooks under test can be
+// added once it is serving. Both are closed when the test ends.
+func newTestServer(t *testing.T) (*mqtt.Server, *testClient) {
+	t.Helper()
+	server := mqtt.New(&mqtt.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	if err := server.AddHook(new(AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	listener := newPipeListener()
+	if err := server.AddListener(listeners.NewNet("pipe", listener)); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+
+	conn, err := listener.dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := &testClient{
+		t:        t,
+		conn:     conn,
+		messages: make(chan packets.Packet, 64),
+		subacks:  make(chan packets.Packet, 1),
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	cl.write(packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Connect},
+		ProtocolVersion: 5,
+		Connect: packets.ConnectParams{
+			ProtocolName:     []byte("MQTT"),
+			ClientIdentifier: "test-client",
+			Clean:            true,
+			Keepalive:        30,
+		},
+	})
+	reader := bufio.NewReader(conn)
+	connack, err := readPacket(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connack.FixedHeader.Type != packets.Connack || connack.ReasonCode != packets.CodeSuccess.Code {
+		t.Fatalf("got packet type %d with reason code %#x, want a successful CONNACK", connack.FixedHeader.Type, connack.ReasonCode)
+	}
+	go cl.read(reader)
+	return server, cl
+}
+
+// newMoveTestServer returns a test server with a MoveCommandHook on the
+// default command and feedback topics, and a client connected to it.
+// configure, if not nil, sets up the hook before it is added.
+func newMoveTestServer(t *testing.T, configure func(h *MoveCommandHook)) (*mqtt.Server, *MoveCommandHook, *testClient) {
+	t.Helper()
+	server, client := newTestServer(t)
+	hook := &MoveCommandHook{
+		server:        server,
+		commandTopic:  "unity/commands/move",
+		feedbackTopic: "unity/feedback/move_complete",
+		errorTopic:    "unity/feedback/errors",
+	}
+	if configure != nil {
+		configure(hook)
+	}
+	if err := server.AddHook(hook, nil); err != nil {
+		t.Fatal(err)
+	}
+	return server, hook, client
+}
+
+// subscribeInline subscribes the server's inline client to filter and
+// returns the messages it receives. Unlike the test client's, its messages
+// keep the QoS they were published with.
+func subscribeInline(t *testing.T, server *mqtt.Server, filter string) <-chan packets.Packet {
+	t.Helper()
+	received := make(chan packets.Packet, 16)
+	err := server.Subscribe(filter, 1, func(cl *mqtt.Client, sub packets.Subscription, pk packets.Packet) {
+		received <- pk
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return received
+}
+
+// decodeFeedback unmarshals the move feedback in pk, failing the test if it
+// isn't valid.
+func decodeFeedback(t *testing.T, pk packets.Packet) MoveCompletionFeedback {
+	t.Helper()
+	var feedback MoveCompletionFeedback
+	if err := json.Unmarshal(pk.Payload, &feedback); err != nil {
+		t.Fatalf("invalid feedback %s: %v", pk.Payload, err)
+	}
+	return feedback
+}
+
+// readPacket reads and decodes one MQTT v5 packet sent by the broker.
+func readPacket(r *bufio.Reader) (packets.Packet, error) {
+	pk := packets.Packet{ProtocolVersion: 5}
+	b, err := r.ReadByte()
+	if err != nil {
+		return pk, err
+	}
+	if err := pk.FixedHeader.Decode(b); err != nil {
+		return pk, err
+	}
+	n, _, err := packets.DecodeLength(r)
+	if err != nil {
+		return pk, err
+	}
+	pk.FixedHeader.Remaining = n
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return pk, err
+	}
+
+	switch pk.FixedHeader.Type {
+	case packets.Connack:
+		err = pk.ConnackDecode(buf)
+	case packets.Publish:
+		err = pk.PublishDecode(buf)
+	case packets.Suback:
+		err = pk.SubackDecode(buf)
+	}
+	return pk, err
+}
+
+// read delivers the packets the broker sends until the connection closes.
+func (c *testClient) read(r *bufio.Reader) {
+	for {
+		pk, err := readPacket(r)
+		if err != nil {
+			close(c.messages)
+			return
+		}
+		switch pk.FixedHeader.Type {
+		case packets.Publish:
+			c.messages <- pk
+		case packets.Suback:
+			c.subacks <- pk
+		}
+	}
+}
+
+// write encodes pk and sends it to the broker. Response topics and
+// correlation data are only encoded when response information is allowed.
+func (c *testClient) write(pk packets.Packet) {
+	c.t.Helper()
+	pk.Mods.AllowResponseInfo = true
+	var buf bytes.Buffer
+	var err error
+	switch pk.FixedHeader.Type {
+	case packets.Connect:
+		err = pk.ConnectEncode(&buf)
+	case packets.Publish:
+		err = pk.PublishEncode(&buf)
+	case packets.Subscribe:
+		err = pk.SubscribeEncode(&buf)
+	}
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// subscribe subscribes to filter at QoS 0 and waits for the broker to
+// acknowledge it.
+func (c *testClient) subscribe(filter string) {
+	c.t.Helper()
+	c.packetID++
+	c.write(packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Subscribe, Qos: 1},
+		ProtocolVersion: 5,
+		PacketID:        c.packetID,
+		Filters:         packets.Subscriptions{{Filter: filter}},
+	})
+	select {
+	case ack := <-c.subacks:
+		if len(ack.ReasonCodes) != 1 || ack.ReasonCodes[0] >= packets.ErrUnspecifiedError.Code {
+			c.t.Fatalf("subscribing to %s refused with reason codes %v", filter, ack.ReasonCodes)
+		}
+	case <-time.After(time.Second):
+		c.t.Fatalf("no SUBACK for %s", filter)
+	}
+}
+
+// publish publishes payload to topic at QoS 0 with the given MQTT v5
+// properties.
+func (c *testClient) publish(topic string, payload []byte, props packets.Properties) {
+	c.t.Helper()
+	c.write(packets.Packet{
+		FixedHeader:     packets.FixedHeader{Type: packets.Publish},
+		ProtocolVersion: 5,
+		TopicName:       topic,
+		Payload:         payload,
+		Properties:      props,
+	})
+}
+
+// next returns the next message the client receives, failing the test if
+// none arrives within a second.
+func (c *testClient) next() packets.Packet {
+	c.t.Helper()
+	select {
+	case pk, ok := <-c.messages:
+		if !ok {
+			c.t.Fatal("connection closed waiting for a message")
+		}
+		return pk
+	case <-time.After(time.Second):
+		c.t.Fatal("no message received")
+	}
+	return packets.Packet{}
+}
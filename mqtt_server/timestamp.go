@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// Formats for the timestamps in feedback messages.
+const (
+	TimestampRFC3339     = "rfc3339"     // 2006-01-02T15:04:05Z07:00
+	TimestampRFC3339Nano = "rfc3339nano" // RFC 3339 with fractional seconds
+	TimestampUnix        = "unix"        // seconds since the Unix epoch
+	TimestampUnixMilli   = "unixmilli"   // milliseconds since the Unix epoch
+)
+
+// validTimestampFormat reports whether format is one of the timestamp formats.
+func validTimestampFormat(format string) bool {
+	switch format {
+	case TimestampRFC3339, TimestampRFC3339Nano, TimestampUnix, TimestampUnixMilli:
+		return true
+	}
+	return false
+}
+
+// formatTimestamp formats t in the given timestamp format. Unix times are
+// formatted as decimal strings, so the timestamp field keeps the same JSON
+// type whatever the format. Unknown formats fall back to RFC 3339.
+func formatTimestamp(format string, t time.Time) string {
+	switch format {
+	case TimestampRFC3339Nano:
+		return t.Format(time.RFC3339Nano)
+	case TimestampUnix:
+		return strconv.FormatInt(t.Unix(), 10)
+	case TimestampUnixMilli:
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+)
+
+// loadTLSConfig returns a TLS configuration for the TCP listener using the
+// certificate and key paths in MQTT_TLS_CERT and MQTT_TLS_KEY. It returns nil
+// when neither variable is set, and an error if only one is set or the
+// certificate can't be loaded, so a bad cert fails fast at startup.
+//
+// If MQTT_TLS_CLIENT_CA is also set, clients must present a certificate
+// signed by one of the PEM CA certificates in that file, and the TLS
+// handshake fails for those that don't.
+func loadTLSConfig() (*tls.Config, error) {
+	certFile := os.Getenv("MQTT_TLS_CERT")
+	keyFile := os.Getenv("MQTT_TLS_KEY")
+	caFile := os.Getenv("MQTT_TLS_CLIENT_CA")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, errors.New("MQTT_TLS_CLIENT_CA requires MQTT_TLS_CERT and MQTT_TLS_KEY to be set")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both MQTT_TLS_CERT and MQTT_TLS_KEY must be set to enable TLS")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate %s: %w", certFile, err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in client CA file %s", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// peerCommonName returns the common name of the verified certificate the
+// client presented over TLS, or "" if it connected without one.
+func peerCommonName(cl *mqtt.Client) string {
+	conn, ok := cl.Net.Conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Limits of the topic activity tracked for the /topics endpoint. Message
+// counts are kept per minute for the last topicActivityMinutes minutes, which
+// is also the longest window that can be asked for. Topics idle for that long
+// are forgotten, and at most maxTrackedTopics are tracked at once so clients
+// publishing to ever-changing topics can't exhaust memory.
+const (
+	topicActivityMinutes = 60
+	maxTrackedTopics     = 10000
+)
+
+// TopicHook counts the messages published to each topic, so the /topics
+// endpoint can show which topics the agent and sensors actually use.
+type TopicHook struct {
+	mqtt.HookBase
+
+	mu        sync.Mutex
+	topics    map[string]*topicActivity // Activity of recently used topics, keyed on topic name
+	lastSweep time.Time
+}
+
+// topicActivity is the number of messages published to a topic in each of
+// the last topicActivityMinutes minutes.
+type topicActivity struct {
+	counts      [topicActivityMinutes]uint64
+	minutes     [topicActivityMinutes]int64 // Unix minute each element of counts is for
+	lastMessage time.Time
+}
+
+// TopicInfo describes a recently used topic in the /topics endpoint.
+type TopicInfo struct {
+	Topic         string    `json:"topic"`
+	Messages      uint64    `json:"messages"`    // Messages published within the window
+	Subscribers   int       `json:"subscribers"` // Clients currently subscribed, including members of shared subscriptions
+	LastMessageAt time.Time `json:"last_message_at"`
+}
+
+// ID returns the ID of the hook.
+func (h *TopicHook) ID() string {
+	return "TopicHook"
+}
+
+// Provides indicates the methods that the hook provides.
+func (h *TopicHook) Provides(p byte) bool {
+	return p == mqtt.OnPublish
+}
+
+// Init initializes the hook's internal state. It is called by server.AddHook.
+func (h *TopicHook) Init(config any) error {
+	h.topics = make(map[string]*topicActivity)
+	h.lastSweep = time.Now()
+	return nil
+}
+
+// OnPublish counts a message published to pk.TopicName. The packet is passed
+// on unchanged.
+func (h *TopicHook) OnPublish(cl *mqtt.Client, pk packets.Packet) (packets.Packet, error) {
+	now := time.Now()
+	minute := now.Unix() / 60
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if now.Sub(h.lastSweep) >= time.Minute {
+		for topic, a := range h.topics {
+			if now.Sub(a.lastMessage) >= topicActivityMinutes*time.Minute {
+				delete(h.topics, topic)
+			}
+		}
+		h.lastSweep = now
+	}
+
+	a, ok := h.topics[pk.TopicName]
+	if !ok {
+		if len(h.topics) >= maxTrackedTopics {
+			return pk, nil
+		}
+		a = new(topicActivity)
+		h.topics[pk.TopicName] = a
+	}
+	i := minute % topicActivityMinutes
+	if a.minutes[i] != minute {
+		a.minutes[i], a.counts[i] = minute, 0
+	}
+	a.counts[i]++
+	a.lastMessage = now
+	return pk, nil
+}
+
+// Topics returns the topics with messages published within window, sorted by
+// name, with their message counts over the window. Counts are kept per
+// minute, so window is rounded up to whole minutes.
+func (h *TopicHook) Topics(server *mqtt.Server, window time.Duration) []TopicInfo {
+	now := time.Now()
+	minute := now.Unix() / 60
+	minutes := min(int64((window+time.Minute-1)/time.Minute), topicActivityMinutes)
+
+	h.mu.Lock()
+	topics := []TopicInfo{}
+	for topic, a := range h.topics {
+		if now.Sub(a.lastMessage) > window {
+			continue
+		}
+		info := TopicInfo{Topic: topic, LastMessageAt: a.lastMessage}
+		for i, m := range a.minutes {
+			if m > minute-minutes {
+				info.Messages += a.counts[i]
+			}
+		}
+		topics = append(topics, info)
+	}
+	h.mu.Unlock()
+
+	for i := range topics {
+		subs := server.Topics.Subscribers(topics[i].Topic)
+		topics[i].Subscribers = len(subs.Subscriptions)
+		for _, group := range subs.Shared {
+			topics[i].Subscribers += len(group)
+		}
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].Topic < topics[j].Topic
+	})
+	return topics
+}
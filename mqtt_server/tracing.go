@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Move commands are traced with OpenTelemetry spans exported to a collector
+// over OTLP/HTTP. A command carrying a W3C traceparent user property
+// continues the agent's trace; others start a new one.
+
+const (
+	traceServiceName    = "mqtt_bridge"
+	traceFlushInterval  = 5 * time.Second
+	traceMaxPending     = 2048 // Spans buffered for export, beyond which new spans are dropped
+	traceExportTimeout  = 10 * time.Second
+	traceScopeName      = "mqtt_server"
+	traceparentProperty = "traceparent" // MQTT v5 user property trace context is read from
+	tracestateProperty  = "tracestate"  // MQTT v5 user property vendor trace state is read from
+)
+
+// tracePropagator reads W3C Trace Context from command user properties.
+var tracePropagator = propagation.TraceContext{}
+
+// tracer starts a span for each move command and exports the finished spans
+// in batches every traceFlushInterval. A nil tracer records nothing.
+type tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// newTracer returns a tracer exporting to the OTLP/HTTP traces URL endpoint,
+// e.g. http://localhost:4318/v1/traces, or nil if endpoint is empty. It
+// exports until close.
+func newTracer(endpoint string) (*tracer, error) {
+	if endpoint == "" {
+		return nil, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(endpoint),
+		otlptracehttp.WithTimeout(traceExportTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %w", err)
+	}
+	return newTracerWithExporter(exporter), nil
+}
+
+// newTracerWithExporter returns a tracer exporting with exporter.
+func newTracerWithExporter(exporter sdktrace.SpanExporter) *tracer {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithBatchTimeout(traceFlushInterval),
+			sdktrace.WithMaxQueueSize(traceMaxPending)),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(traceServiceName))),
+	)
+	return &tracer{provider: provider, tracer: provider.Tracer(traceScopeName)}
+}
+
+// close exports any spans still buffered and stops exporting.
+func (t *tracer) close() {
+	if t == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), traceExportTimeout)
+	defer cancel()
+	if err := t.provider.Shutdown(ctx); err != nil {
+		slog.Warn("failed to export trace spans", "error", err)
+	}
+}
+
+// traceSpan is the span of one move command, from its PUBLISH arriving to its
+// feedback being published.
+type traceSpan struct {
+	span     trace.Span
+	finished sync.Once
+}
+
+// start begins a span for the command cl published as pk, continuing the
+// trace in its traceparent user property if it has a valid one.
+func (t *tracer) start(cl *mqtt.Client, pk packets.Packet) *traceSpan {
+	if t == nil {
+		return nil
+	}
+	_, span := t.tracer.Start(traceContext(pk.Properties.User), "move "+pk.TopicName,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			attribute.String("messaging.system", "mqtt"),
+			attribute.String("messaging.destination.name", pk.TopicName),
+			attribute.String("messaging.client_id", cl.ID),
+		))
+	return &traceSpan{span: span}
+}
+
+// traceContext returns a context carrying the remote span context in the
+// traceparent and tracestate user properties of a command, or a context
+// without one if there is no valid traceparent.
+func traceContext(props []packets.UserProperty) context.Context {
+	carrier := propagation.MapCarrier{}
+	for _, p := range props {
+		if p.Key == traceparentProperty || p.Key == tracestateProperty {
+			if _, ok := carrier[p.Key]; !ok {
+				carrier[p.Key] = p.Val
+			}
+		}
+	}
+	return tracePropagator.Extract(context.Background(), carrier)
+}
+
+// setAttr records an attribute of the span.
+func (s *traceSpan) setAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.span.SetAttributes(attribute.String(key, value))
+}
+
+// finish ends the span with the command's status and queues it for export.
+// Statuses other than success and no_op mark the span as an error. Only the
+// first call has any effect.
+func (s *traceSpan) finish(status string) {
+	if s == nil {
+		return
+	}
+	s.finished.Do(func() {
+		s.span.SetAttributes(attribute.String("move.status", status))
+		if status == "success" || status == "no_op" {
+			s.span.SetStatus(codes.Ok, "")
+		} else {
+			s.span.SetStatus(codes.Error, status)
+		}
+		s.span.End()
+	})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTraceContext(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		traceparent string
+		valid       bool
+	}{
+		{"valid", testTraceparent, true},
+		{"future version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"zero trace ID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"zero parent ID", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"short trace ID", "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false},
+		{"not hex", "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01", false},
+		{"empty", "", false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			props := []packets.UserProperty{{Key: traceparentProperty, Val: tt.traceparent}}
+			sc := trace.SpanContextFromContext(traceContext(props))
+			if sc.IsValid() != tt.valid {
+				t.Fatalf("got valid %v for %q, want %v", sc.IsValid(), tt.traceparent, tt.valid)
+			}
+			if tt.valid && (sc.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID().String() != "00f067aa0ba902b7" || !sc.IsRemote()) {
+				t.Errorf("got trace ID %s and span ID %s, want those of the traceparent", sc.TraceID(), sc.SpanID())
+			}
+		})
+	}
+}
+
+// recordingExporter keeps the spans exported to it, including across
+// shutdown, unlike tracetest's in-memory exporter.
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (e *recordingExporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *recordingExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+func TestTracerFinish(t *testing.T) {
+	exporter := new(recordingExporter)
+	tr := newTracerWithExporter(exporter)
+	cl := &mqtt.Client{ID: "agent"}
+
+	traced := tr.start(cl, packets.Packet{
+		TopicName:  "unity/commands/move",
+		Properties: packets.Properties{User: []packets.UserProperty{{Key: traceparentProperty, Val: testTraceparent}}},
+	})
+	traced.setAttr("move.request_id", "req-1")
+	traced.finish("success")
+	traced.finish("failed") // Ignored, the span has already finished
+	tr.start(cl, packets.Packet{TopicName: "unity/commands/move"}).finish("failed")
+	tr.start(cl, packets.Packet{TopicName: "unity/commands/move"}) // Never finished, so not exported
+	tr.close()                                                     // Before the flush interval, so spans are only exported by close
+
+	spans := exporter.spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans exported, want 2", len(spans))
+	}
+	joined, root := spans[0], spans[1]
+	if joined.Name() != "move unity/commands/move" || joined.SpanKind() != trace.SpanKindConsumer {
+		t.Errorf("got span %q of kind %v, want move unity/commands/move of kind consumer", joined.Name(), joined.SpanKind())
+	}
+	if joined.Parent().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || joined.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("got parent %v, want the traceparent's span", joined.Parent())
+	}
+	if joined.Status().Code != codes.Ok {
+		t.Errorf("got status %v for a successful move, want ok", joined.Status())
+	}
+	attrs := make(map[string]string)
+	for _, a := range joined.Attributes() {
+		attrs[string(a.Key)] = a.Value.AsString()
+	}
+	if attrs["move.status"] != "success" || attrs["move.request_id"] != "req-1" || attrs["messaging.client_id"] != "agent" {
+		t.Errorf("got attributes %v, want move.status success, move.request_id req-1 and messaging.client_id agent", attrs)
+	}
+
+	if root.Parent().IsValid() {
+		t.Errorf("got parent %v for a command without traceparent, want a root span", root.Parent())
+	}
+	if root.Status().Code != codes.Error || root.Status().Description != "failed" {
+		t.Errorf("got status %v for a failed move, want an error", root.Status())
+	}
+
+	var nilTracer *tracer
+	nilTracer.start(cl, packets.Packet{}).finish("success") // Records nothing, without panicking
+	nilTracer.close()
+}
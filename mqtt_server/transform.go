@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// CoordinateTransform converts positions between the agent's coordinate
+// system and the scene's, by reordering the axes and flipping their signs.
+// A nil transform is the identity.
+//
+// For example an agent using a right-handed Z-up frame drives Unity's
+// left-handed Y-up frame with axes [x, z, y], which swaps y and z.
+type CoordinateTransform struct {
+	Axes [3]string `yaml:"axes" json:"axes"` // agent axis, x, y or z, each scene axis x, y, z is taken from
+	Flip [3]bool   `yaml:"flip" json:"flip"` // negate scene axis x, y, z after remapping
+}
+
+// validate returns an error unless the axes are x, y and z in some order.
+func (t CoordinateTransform) validate() error {
+	seen := make(map[string]bool)
+	for _, axis := range t.Axes {
+		if !slices.Contains([]string{"x", "y", "z"}, axis) {
+			return fmt.Errorf("coordinate_transform axes must each be x, y or z, got %q", axis)
+		}
+		if seen[axis] {
+			return fmt.Errorf("coordinate_transform axes must use each of x, y and z once, got %v", t.Axes)
+		}
+		seen[axis] = true
+	}
+	return nil
+}
+
+// axisIndex returns the position of the agent axis each scene axis is taken
+// from.
+func (t CoordinateTransform) axisIndex(i int) int {
+	return int(t.Axes[i][0] - 'x')
+}
+
+// sign returns -1 if scene axis i is flipped, else 1.
+func (t CoordinateTransform) sign(i int) float64 {
+	if t.Flip[i] {
+		return -1
+	}
+	return 1
+}
+
+// toScene converts pos from agent to scene coordinates. pos must have 3
+// elements.
+func (t *CoordinateTransform) toScene(pos []float64) []float64 {
+	if t == nil {
+		return pos
+	}
+	scene := make([]float64, 3)
+	for i := range scene {
+		scene[i] = t.sign(i) * pos[t.axisIndex(i)]
+	}
+	return scene
+}
+
+// toAgent converts pos from scene to agent coordinates, undoing toScene. pos
+// must have 3 elements, or be nil.
+func (t *CoordinateTransform) toAgent(pos []float64) []float64 {
+	if t == nil || pos == nil {
+		return pos
+	}
+	agent := make([]float64, 3)
+	for i, v := range pos {
+		agent[t.axisIndex(i)] = t.sign(i) * v
+	}
+	return agent
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// WebsocketListener is an MQTT-over-WebSocket listener which, unlike the
+// mochi built-in, only upgrades connections on a single configurable path
+// (e.g. /mqtt). The address is bound in Init so that bind errors surface from
+// server.AddListener the same way they do for the TCP listener.
+type WebsocketListener struct {
+	sync.RWMutex
+	id        string
+	address   string
+	path      string
+	listen    net.Listener
+	server    *http.Server
+	upgrader  *websocket.Upgrader
+	establish listeners.EstablishFn
+	log       *slog.Logger
+	end       uint32
+}
+
+// NewWebsocketListener returns a new WebsocketListener serving on address at path.
+func NewWebsocketListener(id, address, path string) *WebsocketListener {
+	if path == "" {
+		path = "/"
+	}
+
+	return &WebsocketListener{
+		id:      id,
+		address: address,
+		path:    path,
+		upgrader: &websocket.Upgrader{
+			Subprotocols: []string{"mqtt"},
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+	}
+}
+
+// ID returns the id of the listener.
+func (l *WebsocketListener) ID() string {
+	return l.id
+}
+
+// Address returns the address of the listener.
+func (l *WebsocketListener) Address() string {
+	if l.listen != nil {
+		return l.listen.Addr().String()
+	}
+	return l.address
+}
+
+// Protocol returns the protocol of the listener.
+func (l *WebsocketListener) Protocol() string {
+	return "ws"
+}
+
+// Init binds the listener address and prepares the HTTP server.
+func (l *WebsocketListener) Init(log *slog.Logger) error {
+	l.log = log
+
+	ln, err := net.Listen("tcp", l.address)
+	if err != nil {
+		return err
+	}
+	l.listen = ln
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(l.path, l.handler)
+	l.server = &http.Server{
+		Handler:      mux,
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: 60 * time.Second,
+	}
+
+	return nil
+}
+
+// handler upgrades and handles an incoming websocket connection.
+func (l *WebsocketListener) handler(w http.ResponseWriter, r *http.Request) {
+	c, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		l.log.Warn("websocket upgrade failed", "error", err, "listener", l.id, "remote", r.RemoteAddr)
+		return
+	}
+	defer c.Close()
+
+	err = l.establish(l.id, &wsConn{Conn: c.UnderlyingConn(), c: c})
+	if err != nil {
+		l.log.Warn("websocket connection failed", "error", err, "listener", l.id, "remote", r.RemoteAddr)
+	}
+}
+
+// Serve starts accepting websocket connections, and calls the connection
+// establishment callback for any received.
+func (l *WebsocketListener) Serve(establish listeners.EstablishFn) {
+	l.establish = establish
+
+	err := l.server.Serve(l.listen)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) && atomic.LoadUint32(&l.end) == 0 {
+		l.log.Error("failed to serve.", "error", err, "listener", l.id)
+	}
+}
+
+// Close closes the listener and any client connections.
+func (l *WebsocketListener) Close(closeClients listeners.CloseFn) {
+	l.Lock()
+	defer l.Unlock()
+
+	if atomic.CompareAndSwapUint32(&l.end, 0, 1) {
+		closeClients(l.id)
+	}
+
+	if l.server != nil {
+		_ = l.server.Close()
+	}
+}
+
+// wsConn adapts a websocket connection to the net.Conn stream the broker
+// expects, reading across message boundaries.
+type wsConn struct {
+	net.Conn
+	c *websocket.Conn
+	r io.Reader
+
+	wmu sync.Mutex
+}
+
+// Read reads the next bytes of the current binary message, advancing to the
+// next message when the current one is exhausted.
+func (ws *wsConn) Read(p []byte) (int, error) {
+	for {
+		if ws.r == nil {
+			op, r, err := ws.c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			if op != websocket.BinaryMessage {
+				continue
+			}
+			ws.r = r
+		}
+
+		n, err := ws.r.Read(p)
+		if errors.Is(err, io.EOF) {
+			ws.r = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Write writes p as a single binary message.
+func (ws *wsConn) Write(p []byte) (int, error) {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+
+	if err := ws.c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the underlying websocket connection.
+func (ws *wsConn) Close() error {
+	return ws.c.Close()
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// YearlyYield represents the structure for our yearly yield data.
+type YearlyYield struct {
+	Year  int     `json:"year"`
+	Yield float64 `json:"yield"`
+}
+
+// defaultYearlyYields are served when no yields file is available.
+var defaultYearlyYields = []YearlyYield{
+	{Year: 2020, Yield: 25.5},
+	{Year: 2021, Yield: 26.8},
+	{Year: 2022, Yield: 28.1},
+	{Year: 2023, Yield: 27.9},
+}
+
+// loadYearlyYields reads a JSON array of yearly yields from path.
+func loadYearlyYields(path string) ([]YearlyYield, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading yields: %w", err)
+	}
+
+	var yields []YearlyYield
+	if err := json.Unmarshal(data, &yields); err != nil {
+		return nil, fmt.Errorf("parsing yields %s: %w", path, err)
+	}
+	return yields, nil
+}